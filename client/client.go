@@ -0,0 +1,451 @@
+// Package client is a Go client for the replicated key-value store.
+//
+// A Session remembers the causal metadata returned by every request and sends it with the next one, so callers never
+// have to thread the "causal-metadata" object by hand. Requests that the replica can't serve yet because of a causal
+// dependency (503 causal_dependency), or turns away because of its rate limits (429), are retried with backoff.
+// Requests to a replica that can't be reached, or can't serve anyone right now (503 not_ready, shutting_down or
+// no_quorum), fail over to the next replica in the view. Any other error, e.g. a write that too few replicas
+// acknowledged in time (503 ack_timeout), is returned as it is.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata is the causal metadata the replicas attach to every response
+type Metadata struct {
+	ReqVector       []int `json:"ReqVector"`
+	ReqIpIndex      int   `json:"ReqIpIndex"`
+	IsReqFromClient bool  `json:"IsReqFromClient"`
+}
+
+// ErrNotFound is returned when the key does not exist
+var ErrNotFound = errors.New("client: key does not exist")
+
+// ErrNoReplicas is returned when none of the replicas the session knows about could be reached
+var ErrNoReplicas = errors.New("client: no replica could be reached")
+
+// the codes of the 503s a replica answers when it can't serve anyone right now, so the request goes to another one
+var failoverCodes = map[string]bool{"not_ready": true, "shutting_down": true, "no_quorum": true}
+
+// StatusError is returned when a replica answers with an error status
+type StatusError struct {
+	StatusCode int
+	// Code is the machine-readable error code the replica sent, e.g. "key_not_found"
+	Code    string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: replica returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Is lets errors.Is(err, ErrNotFound) match a 404 from the replica
+func (e *StatusError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Session talks to the replicas on behalf of one client, carrying its causal metadata between requests
+// A Session is safe for concurrent use, but requests made from it share (and merge) a single causal history
+type Session struct {
+	// HTTPClient is used for every request; defaults to a client with a 5 second timeout
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request that hit a causal dependency (503 causal_dependency) or a rate limit
+	// (429) is retried
+	MaxRetries int
+	// InitialBackoff is how long we wait before the first retry; it doubles on every retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Scheme is "https" for replicas serving TLS; defaults to "http"
+	Scheme string
+	// Token is sent as "Authorization: Bearer <token>" to replicas with access control on
+	Token string
+
+	mu       sync.Mutex
+	replicas []string // socket addresses, e.g. "10.10.0.2:8090"
+	current  int      // index in replicas of the replica we send requests to
+	metadata *Metadata
+}
+
+// NewSession creates a session that sends requests to the given replicas, starting with the first one
+func NewSession(replicas ...string) *Session {
+	return &Session{
+		HTTPClient:     &http.Client{Timeout: 5 * time.Second},
+		MaxRetries:     8,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Scheme:         "http",
+		replicas:       append([]string(nil), replicas...),
+	}
+}
+
+// Metadata returns a copy of the causal metadata the session will send with its next request, or nil if it
+// hasn't talked to a replica yet
+func (s *Session) Metadata() *Metadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.metadata == nil {
+		return nil
+	}
+	return s.metadata.copy()
+}
+
+// copy returns a copy of the metadata that shares nothing with it
+func (md *Metadata) copy() *Metadata {
+	copied := *md
+	copied.ReqVector = append([]int(nil), md.ReqVector...)
+	return &copied
+}
+
+// SetMetadata replaces the session's causal metadata, e.g. with one saved from an earlier session
+func (s *Session) SetMetadata(md *Metadata) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if md == nil {
+		s.metadata = nil
+		return
+	}
+	s.metadata = md.copy()
+}
+
+// Replicas returns the replicas the session currently knows about
+func (s *Session) Replicas() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.replicas...)
+}
+
+// Get returns the value stored under key, or ErrNotFound
+func (s *Session) Get(ctx context.Context, key string) (interface{}, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Value, nil
+}
+
+// Put stores value under key, reporting whether the key was created (rather than updated)
+func (s *Session) Put(ctx context.Context, key string, value interface{}) (bool, error) {
+	return s.put(ctx, key, value, nil)
+}
+
+// PutWithTTL stores value under key, to be deleted by the replicas once ttl has passed
+func (s *Session) PutWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error) {
+	seconds := ttl.Seconds()
+	return s.put(ctx, key, value, &seconds)
+}
+
+func (s *Session) put(ctx context.Context, key string, value interface{}, ttl *float64) (bool, error) {
+	if value == nil {
+		return false, errors.New("client: value must not be nil")
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, &request{Value: value, TTL: ttl})
+	if err != nil {
+		return false, err
+	}
+	return resp.Result == "created", nil
+}
+
+// Delete removes key, or returns ErrNotFound if it doesn't exist
+func (s *Session) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, http.MethodDelete, key, nil)
+	return err
+}
+
+// View returns the view of the replica the session is talking to
+func (s *Session) View(ctx context.Context) ([]string, error) {
+	var view []string
+	err := s.failover(ctx, func(replica string) (bool, error) {
+		var err error
+		view, err = s.fetchView(ctx, replica)
+		return err == nil, err
+	})
+	return view, err
+}
+
+// Keys lists the keys starting with prefix on the replica the session is talking to, sorted
+// With access control on, only the keys the session's token may read are listed
+func (s *Session) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	var statusErr error
+	err := s.failover(ctx, func(replica string) (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/kvs?prefix=%s", s.scheme(), replica, url.QueryEscape(prefix)), nil)
+		if err != nil {
+			return false, err
+		}
+		s.authorize(req)
+
+		res, err := s.HTTPClient.Do(req)
+		if err != nil {
+			return false, err
+		}
+		defer res.Body.Close()
+
+		var resp struct {
+			Keys  []string `json:"keys"`
+			Error string   `json:"error"`
+			Code  string   `json:"code"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			return false, fmt.Errorf("client: bad key list from %s: %w", replica, err)
+		}
+		if res.StatusCode >= 300 {
+			statusErr = &StatusError{StatusCode: res.StatusCode, Code: resp.Code, Message: resp.Error}
+		}
+		keys = resp.Keys
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, statusErr
+}
+
+// request is the body of a request to /kvs/{key}
+type request struct {
+	Value          interface{} `json:"value,omitempty"`
+	CausalMetadata *Metadata   `json:"causal-metadata"`
+	TTL            *float64    `json:"ttl,omitempty"`
+}
+
+// response is the body of a response from /kvs/{key}
+type response struct {
+	Result         string      `json:"result"`
+	Value          interface{} `json:"value"`
+	Error          string      `json:"error"`
+	Code           string      `json:"code"`
+	CausalMetadata *Metadata   `json:"causal-metadata"`
+	// how long the replica asked us to wait before trying again, from its Retry-After header
+	retryAfter time.Duration
+}
+
+// do sends a request for key, retrying causal dependency failures and rate limits, and failing over replicas that
+// can't be reached or can't serve anyone
+func (s *Session) do(ctx context.Context, method string, key string, body *request) (*response, error) {
+	if body == nil {
+		body = &request{}
+	}
+
+	backoff := s.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		body.CausalMetadata = s.Metadata()
+		if body.CausalMetadata != nil {
+			body.CausalMetadata.IsReqFromClient = true
+		}
+
+		var resp *response
+		var status int
+		err := s.failover(ctx, func(replica string) (bool, error) {
+			var err error
+			resp, status, err = s.send(ctx, replica, method, key, body)
+			if err != nil {
+				return false, err
+			}
+			if status == http.StatusServiceUnavailable && failoverCodes[resp.Code] {
+				if resp.CausalMetadata != nil {
+					s.merge(resp.CausalMetadata)
+				}
+				return false, &StatusError{StatusCode: status, Code: resp.Code, Message: resp.Error}
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.CausalMetadata != nil {
+			s.merge(resp.CausalMetadata)
+		}
+
+		if status < 300 {
+			return resp, nil
+		}
+		statusErr := &StatusError{StatusCode: status, Code: resp.Code, Message: resp.Error}
+		// a write that wasn't acknowledged in time is applied and still going out, so sending it again would only
+		// make it twice; only a request the replica couldn't take yet is worth another try
+		retryable := status == http.StatusServiceUnavailable && resp.Code == "causal_dependency" || status == http.StatusTooManyRequests
+		if !retryable || attempt >= s.MaxRetries {
+			return nil, statusErr
+		}
+
+		// the replica hasn't seen everything we have yet, so give the broadcasts time to arrive
+		// (or it is turning us away for a while, in which case we wait as long as it asked)
+		wait := backoff
+		if resp.retryAfter > wait {
+			wait = resp.retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// failover calls try with each replica in turn, starting with the current one, until it reports that the
+// replica was reached. Whichever replica answered becomes the current one. If none was, but the last one answered
+// that it couldn't serve the request, its StatusError is returned
+func (s *Session) failover(ctx context.Context, try func(replica string) (bool, error)) error {
+	replicas := s.Replicas()
+	if len(replicas) == 0 {
+		return ErrNoReplicas
+	}
+
+	s.mu.Lock()
+	start := s.current
+	s.mu.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(replicas); i++ {
+		index := (start + i) % len(replicas)
+		reached, err := try(replicas[index])
+		if reached {
+			s.mu.Lock()
+			s.current = index
+			s.mu.Unlock()
+			if i > 0 {
+				// we failed over, so the view may have changed too
+				s.refreshView(ctx, replicas[index])
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		lastErr = err
+	}
+	var statusErr *StatusError
+	if errors.As(lastErr, &statusErr) {
+		return statusErr
+	}
+	return fmt.Errorf("%w: %v", ErrNoReplicas, lastErr)
+}
+
+// send sends a single request to a single replica; an error means the replica couldn't be reached
+func (s *Session) send(ctx context.Context, replica string, method string, key string, body *request) (*response, int, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s://%s/kvs/%s", s.scheme(), replica, url.PathEscape(key)), bytes.NewReader(payload))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.authorize(req)
+
+	res, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	var resp response
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, 0, fmt.Errorf("client: bad response from %s: %w", replica, err)
+	}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		resp.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return &resp, res.StatusCode, nil
+}
+
+// authorize adds the session's token to a request, if it has one
+func (s *Session) authorize(req *http.Request) {
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+}
+
+// scheme returns the URL scheme requests are sent with
+func (s *Session) scheme() string {
+	if s.Scheme == "" {
+		return "http"
+	}
+	return s.Scheme
+}
+
+// fetchView asks a single replica for its view
+func (s *Session) fetchView(ctx context.Context, replica string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/view", s.scheme(), replica), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var resp struct {
+		View []string `json:"view"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("client: bad view from %s: %w", replica, err)
+	}
+	return resp.View, nil
+}
+
+// refreshView adds every replica in the given replica's view that the session doesn't know about yet
+// Replicas are never dropped, since a replica missing from the view may just be recovering
+func (s *Session) refreshView(ctx context.Context, replica string) {
+	view, err := s.fetchView(ctx, replica)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	known := make(map[string]bool, len(s.replicas))
+	for _, addr := range s.replicas {
+		known[addr] = true
+	}
+	for _, addr := range view {
+		addr = strings.TrimSpace(addr)
+		if addr != "" && !known[addr] {
+			s.replicas = append(s.replicas, addr)
+			known[addr] = true
+		}
+	}
+}
+
+// merge folds the metadata of a response into the session's, keeping the largest entry of each vector clock
+func (s *Session) merge(md *Metadata) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.metadata == nil {
+		s.metadata = md.copy()
+		return
+	}
+	// the vector clock grows when a replica joins the cluster, so the response's may be longer than ours
+	for len(s.metadata.ReqVector) < len(md.ReqVector) {
+		s.metadata.ReqVector = append(s.metadata.ReqVector, 0)
+	}
+	for i := range md.ReqVector {
+		if md.ReqVector[i] > s.metadata.ReqVector[i] {
+			s.metadata.ReqVector[i] = md.ReqVector[i]
+		}
+	}
+	s.metadata.ReqIpIndex = md.ReqIpIndex
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// answer is what a fake replica answers one request for a key with
+type answer struct {
+	status int
+	code   string
+}
+
+// fakeReplica answers requests for keys with the given answers in turn (repeating the last), keeping what it was sent
+type fakeReplica struct {
+	*httptest.Server
+	mu       sync.Mutex
+	answers  []answer
+	requests int
+	bodies   []request
+}
+
+// Helper function that starts a fake replica, which the test stops when it ends
+func newFakeReplica(t *testing.T, answers ...answer) *fakeReplica {
+	f := &fakeReplica{answers: answers}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeReplica) serve(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if req.URL.Path == "/view" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"view": []string{f.addr()}})
+		return
+	}
+
+	var body request
+	json.NewDecoder(req.Body).Decode(&body)
+	f.mu.Lock()
+	ans := f.answers[len(f.answers)-1]
+	if f.requests < len(f.answers) {
+		ans = f.answers[f.requests]
+	}
+	f.requests++
+	n := f.requests
+	f.bodies = append(f.bodies, body)
+	f.mu.Unlock()
+
+	resp := map[string]interface{}{"causal-metadata": Metadata{ReqVector: []int{n, 0}}}
+	if ans.status < 300 {
+		resp["result"] = "updated"
+	} else {
+		resp["error"] = "no"
+		resp["code"] = ans.code
+		if ans.status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+	}
+	w.WriteHeader(ans.status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Helper function that returns the address a session reaches the fake replica at
+func (f *fakeReplica) addr() string {
+	return strings.TrimPrefix(f.URL, "http://")
+}
+
+// Helper function that returns how many requests for keys the fake replica has had
+func (f *fakeReplica) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// A request is retried where it is when the replica can't take it yet, sent to another replica when this one can't
+// serve anyone, and returned as it is otherwise
+func TestSessionRetries(t *testing.T) {
+	ok := answer{status: http.StatusOK}
+	tests := []struct {
+		name     string
+		first    []answer // nil for a replica that can't be reached
+		second   []answer
+		wantCode string // of the StatusError returned, if any
+		wantErr  error
+		wantSent [2]int
+	}{
+		{name: "answered", first: []answer{ok}, second: []answer{ok}, wantSent: [2]int{1, 0}},
+		{name: "causal dependency", first: []answer{{503, "causal_dependency"}, {503, "causal_dependency"}, ok}, second: []answer{ok}, wantSent: [2]int{3, 0}},
+		{name: "rate limited", first: []answer{{429, "rate_limited"}, ok}, second: []answer{ok}, wantSent: [2]int{2, 0}},
+		{name: "retries run out", first: []answer{{503, "causal_dependency"}, {503, "causal_dependency"}, {503, "causal_dependency"}}, second: []answer{ok}, wantCode: "causal_dependency", wantSent: [2]int{3, 0}},
+		{name: "ack timeout", first: []answer{{503, "ack_timeout"}}, second: []answer{ok}, wantCode: "ack_timeout", wantSent: [2]int{1, 0}},
+		{name: "no leader", first: []answer{{503, "no_leader"}}, second: []answer{ok}, wantCode: "no_leader", wantSent: [2]int{1, 0}},
+		{name: "not found", first: []answer{{404, "key_not_found"}}, second: []answer{ok}, wantErr: ErrNotFound, wantSent: [2]int{1, 0}},
+		{name: "not ready", first: []answer{{503, "not_ready"}}, second: []answer{ok}, wantSent: [2]int{1, 1}},
+		{name: "shutting down", first: []answer{{503, "shutting_down"}}, second: []answer{ok}, wantSent: [2]int{1, 1}},
+		{name: "no quorum", first: []answer{{503, "no_quorum"}}, second: []answer{ok}, wantSent: [2]int{1, 1}},
+		{name: "unreachable", second: []answer{ok}, wantSent: [2]int{0, 1}},
+		{name: "none ready", first: []answer{{503, "not_ready"}}, second: []answer{{503, "shutting_down"}}, wantCode: "shutting_down", wantSent: [2]int{1, 1}},
+		{name: "none reachable", wantErr: ErrNoReplicas},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var replicas [2]*fakeReplica
+			var addrs []string
+			for i, answers := range [][]answer{tt.first, tt.second} {
+				replicas[i] = newFakeReplica(t, append(answers, ok)...)
+				addrs = append(addrs, replicas[i].addr())
+				if answers == nil {
+					replicas[i].Close()
+				}
+			}
+			s := NewSession(addrs...)
+			s.MaxRetries = 2
+			s.InitialBackoff = time.Millisecond
+
+			_, err := s.Put(context.Background(), "x", 1)
+			var statusErr *StatusError
+			switch {
+			case tt.wantCode != "":
+				if !errors.As(err, &statusErr) || statusErr.Code != tt.wantCode {
+					t.Errorf("Put() = %v, want a StatusError with code %s", err, tt.wantCode)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Put() = %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("Put() = %v", err)
+			}
+			if sent := [2]int{replicas[0].count(), replicas[1].count()}; sent != tt.wantSent {
+				t.Errorf("sent %v requests to the replicas, want %v", sent, tt.wantSent)
+			}
+		})
+	}
+}
+
+// Every request carries the causal metadata of everything the session has seen, merged entry by entry
+func TestSessionMetadata(t *testing.T) {
+	replica := newFakeReplica(t, answer{status: http.StatusOK})
+	s := NewSession(replica.addr())
+	s.SetMetadata(&Metadata{ReqVector: []int{0, 5}})
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.Put(context.Background(), "x", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	want := []*Metadata{
+		{ReqVector: []int{0, 5}, IsReqFromClient: true},
+		{ReqVector: []int{1, 5}, IsReqFromClient: true},
+	}
+	for i, body := range replica.bodies {
+		if !reflect.DeepEqual(body.CausalMetadata, want[i]) {
+			t.Errorf("request %d carried %+v, want %+v", i, body.CausalMetadata, want[i])
+		}
+	}
+	if got := s.Metadata().ReqVector; !reflect.DeepEqual(got, []int{2, 5}) {
+		t.Errorf("session has vector clock %v, want [2 5]", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		ours  []int
+		their []int
+		want  []int
+	}{
+		{ours: nil, their: []int{1, 2}, want: []int{1, 2}},
+		{ours: []int{3, 0}, their: []int{1, 2}, want: []int{3, 2}},
+		{ours: []int{3}, their: []int{1, 2, 4}, want: []int{3, 2, 4}},
+		{ours: []int{3, 4, 5}, their: []int{1}, want: []int{3, 4, 5}},
+	}
+	for _, tt := range tests {
+		s := NewSession()
+		if tt.ours != nil {
+			s.SetMetadata(&Metadata{ReqVector: tt.ours})
+		}
+		s.merge(&Metadata{ReqVector: tt.their})
+		if got := s.Metadata().ReqVector; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("merging %v into %v = %v, want %v", tt.their, tt.ours, got, tt.want)
+		}
+	}
+}
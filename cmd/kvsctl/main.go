@@ -0,0 +1,400 @@
+// Command kvsctl is a command-line client for the replicated key-value store.
+//
+// Usage:
+//
+//	kvsctl [flags] get <key>
+//	kvsctl [flags] put <key> <value>
+//	kvsctl [flags] delete <key>
+//	kvsctl [flags] keys [prefix]
+//	kvsctl [flags] view
+//	kvsctl [flags] status
+//	kvsctl [flags] session [reset]
+//	kvsctl [flags] join <socket-address>
+//	kvsctl [flags] leave <socket-address>
+//
+// Flags may come before or after the command and its arguments, e.g. kvsctl put x 1 -ttl 5s; anything after "--" is
+// taken as it is, so kvsctl put x -- -1 puts -1.
+//
+// The causal metadata of the session is kept in a local file between runs, so consecutive commands see each other's
+// writes no matter which replica serves them. Values are parsed as JSON when possible and sent as strings otherwise.
+//
+// join adds a replica started with JOIN to the cluster, and leave decommissions one; both need -cluster-secret if the
+// cluster has one.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/clevalle/CSE138_Assignment3/client"
+	"github.com/clevalle/CSE138_Assignment3/replica"
+)
+
+// sessionFile is what we keep on disk between runs
+type sessionFile struct {
+	Replicas       []string         `json:"replicas,omitempty"`
+	CausalMetadata *client.Metadata `json:"causal-metadata"`
+}
+
+func main() {
+	flags := flag.NewFlagSet("kvsctl", flag.ExitOnError)
+	replicasFlag := flags.String("replicas", envOr("KVSCTL_REPLICAS", "localhost:8090"), "comma separated socket addresses of the replicas")
+	sessionPath := flags.String("session", defaultSessionPath(), "file the session's causal metadata is kept in")
+	ttl := flags.Duration("ttl", 0, "expire the key after this long (put only)")
+	timeout := flags.Duration("timeout", 10*time.Second, "give up on the command after this long")
+	useTLS := flags.Bool("https", os.Getenv("KVSCTL_HTTPS") != "", "talk to the replicas over https")
+	token := flags.String("token", os.Getenv("KVSCTL_TOKEN"), "API token, for replicas with access control on")
+	caFile := flags.String("cacert", os.Getenv("KVSCTL_CACERT"), "PEM file of CAs to check the replicas' certificates against (https only)")
+	secret := flags.String("cluster-secret", os.Getenv("KVSCTL_CLUSTER_SECRET"), "the cluster's shared secret, to sign join and leave with")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: kvsctl [flags] get|put|delete|keys|view|status|session|join|leave ...")
+		flags.PrintDefaults()
+	}
+	args := parseArgs(flags, os.Args[1:])
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	replicas := splitAddrs(*replicasFlag)
+	saved, err := loadSession(*sessionPath)
+	if err != nil {
+		fail(err)
+	}
+	// replicas learned in earlier runs are tried after the ones given on the command line
+	for _, addr := range saved.Replicas {
+		if !contains(replicas, addr) {
+			replicas = append(replicas, addr)
+		}
+	}
+
+	session := client.NewSession(replicas...)
+	session.SetMetadata(saved.CausalMetadata)
+	session.Token = *token
+	if *useTLS {
+		session.Scheme = "https"
+		if *caFile != "" {
+			tlsConfig, err := loadCAs(*caFile)
+			if err != nil {
+				fail(err)
+			}
+			session.HTTPClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	cmdErr := run(ctx, session, args, *ttl, *secret)
+
+	// the session is saved even if the command failed, since errors still carry causal metadata
+	if err := saveSession(*sessionPath, sessionFile{Replicas: session.Replicas(), CausalMetadata: session.Metadata()}); err != nil {
+		fail(err)
+	}
+	if cmdErr != nil {
+		fail(cmdErr)
+	}
+}
+
+// run carries out a single command against the cluster
+func run(ctx context.Context, session *client.Session, args []string, ttl time.Duration, secret string) error {
+	switch args[0] {
+	case "get":
+		needArgs(args, 2)
+		val, err := session.Get(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		printJSON(val)
+	case "put":
+		needArgs(args, 3)
+		var created bool
+		var err error
+		if ttl > 0 {
+			created, err = session.PutWithTTL(ctx, args[1], parseValue(args[2]), ttl)
+		} else {
+			created, err = session.Put(ctx, args[1], parseValue(args[2]))
+		}
+		if err != nil {
+			return err
+		}
+		if created {
+			fmt.Println("created")
+		} else {
+			fmt.Println("updated")
+		}
+	case "delete":
+		needArgs(args, 2)
+		if err := session.Delete(ctx, args[1]); err != nil {
+			return err
+		}
+		fmt.Println("deleted")
+	case "keys":
+		prefix := ""
+		if len(args) > 1 {
+			prefix = args[1]
+		}
+		keys, err := session.Keys(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+	case "view":
+		view, err := session.View(ctx)
+		if err != nil {
+			return err
+		}
+		for _, addr := range view {
+			fmt.Println(addr)
+		}
+	case "status":
+		// asking for the view first, so replicas we haven't talked to before show up too
+		replicas := session.Replicas()
+		if view, err := session.View(ctx); err == nil {
+			for _, addr := range view {
+				if !contains(replicas, addr) {
+					replicas = append(replicas, addr)
+				}
+			}
+		}
+		printStatus(ctx, os.Stdout, session.HTTPClient.Transport, session.Scheme, replicas)
+	case "session":
+		if len(args) > 1 && args[1] == "reset" {
+			session.SetMetadata(nil)
+		}
+		printJSON(sessionFile{Replicas: session.Replicas(), CausalMetadata: session.Metadata()})
+	case "join", "leave":
+		needArgs(args, 2)
+		transport := session.HTTPClient.Transport
+		if secret != "" {
+			transport = replica.NewSigningTransport(transport, []byte(secret))
+		}
+		result, err := changeMembership(ctx, transport, session.Scheme, session.Replicas(), args[0], args[1])
+		if err != nil {
+			return err
+		}
+		printJSON(result)
+	default:
+		fmt.Fprintf(os.Stderr, "kvsctl: unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+	return nil
+}
+
+// printStatus shows every replica's vector clock and view side by side
+func printStatus(ctx context.Context, w io.Writer, transport http.RoundTripper, scheme string, replicas []string) {
+	httpClient := &http.Client{Transport: transport, Timeout: 2 * time.Second}
+	out := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "REPLICA\tVECTOR CLOCK\tVIEW")
+
+	for _, replica := range replicas {
+		var clock struct {
+			VC []int `json:"VC"`
+		}
+		var view struct {
+			View []string `json:"view"`
+		}
+		err := getJSON(ctx, httpClient, fmt.Sprintf("%s://%s/getVC", scheme, replica), &clock)
+		if err == nil {
+			err = getJSON(ctx, httpClient, fmt.Sprintf("%s://%s/view", scheme, replica), &view)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "%s\tunreachable\t\n", replica)
+			continue
+		}
+		fmt.Fprintf(out, "%s\t%v\t%s\n", replica, clock.VC, strings.Join(view.View, ","))
+	}
+	out.Flush()
+}
+
+// changeMembership asks the first replica that answers to add (join) or decommission (leave) the given replica
+func changeMembership(ctx context.Context, transport http.RoundTripper, scheme string, replicas []string, op string, addr string) (map[string]interface{}, error) {
+	httpClient := &http.Client{Transport: transport}
+	body, err := json.Marshal(map[string]string{"socket-address": addr})
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, target := range replicas {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s://%s/admin/%s", scheme, target, op), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var result map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad answer: %w", target, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %v (%d)", target, result["error"], res.StatusCode)
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("no replica could be reached: %w", lastErr)
+}
+
+func getJSON(ctx context.Context, httpClient *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// loadCAs builds a TLS config that trusts the CAs in the given PEM file
+func loadCAs(path string) (*tls.Config, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+func loadSession(path string) (sessionFile, error) {
+	var saved sessionFile
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return saved, nil
+	}
+	if err != nil {
+		return saved, err
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return saved, fmt.Errorf("reading session %s: %w", path, err)
+	}
+	return saved, nil
+}
+
+func saveSession(path string, saved sessionFile) error {
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// writing to a temporary file first, so a crash never leaves a half written session behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func defaultSessionPath() string {
+	if path := os.Getenv("KVSCTL_SESSION"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".kvsctl-session.json"
+	}
+	return filepath.Join(dir, "kvsctl", "session.json")
+}
+
+// parseArgs parses the flags wherever they are among args, returning the other arguments in order
+// The flag package stops at the first argument that isn't a flag, so we parse again from the one after it, until "--"
+// or the end; a flag it doesn't know ends the command with its usage
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for len(args) > 0 {
+		flags.Parse(args)
+		rest := flags.Args()
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	return positional
+}
+
+// parseValue sends valid JSON as is (numbers, objects, ...) and anything else as a string
+func parseValue(raw string) interface{} {
+	var val interface{}
+	if err := json.Unmarshal([]byte(raw), &val); err == nil && val != nil {
+		return val
+	}
+	return raw
+}
+
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(string(data))
+}
+
+func splitAddrs(raw string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(raw, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func envOr(name string, fallback string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return fallback
+}
+
+func needArgs(args []string, n int) {
+	if len(args) != n {
+		fmt.Fprintf(os.Stderr, "kvsctl: %s takes %d argument(s)\n", args[0], n-1)
+		os.Exit(2)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "kvsctl:", err)
+	os.Exit(1)
+}
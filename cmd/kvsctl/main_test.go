@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clevalle/CSE138_Assignment3/client"
+)
+
+// Flags are taken wherever they are, and "--" ends them
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		want     []string
+		wantTTL  time.Duration
+		wantAddr string
+	}{
+		{args: []string{"get", "x"}, want: []string{"get", "x"}},
+		{args: []string{"-ttl", "5s", "put", "x", "1"}, want: []string{"put", "x", "1"}, wantTTL: 5 * time.Second},
+		{args: []string{"put", "x", "1", "-ttl", "5s"}, want: []string{"put", "x", "1"}, wantTTL: 5 * time.Second},
+		{args: []string{"put", "-ttl=5s", "x", "1"}, want: []string{"put", "x", "1"}, wantTTL: 5 * time.Second},
+		{args: []string{"-replicas", "a:1", "view", "-ttl", "1s"}, want: []string{"view"}, wantTTL: time.Second, wantAddr: "a:1"},
+		{args: []string{"put", "x", "--", "-1", "-ttl"}, want: []string{"put", "x", "-1", "-ttl"}},
+		{args: []string{"--", "-ttl", "5s"}, want: []string{"-ttl", "5s"}},
+		{args: nil, want: nil},
+	}
+	for _, tt := range tests {
+		flags := flag.NewFlagSet("kvsctl", flag.ContinueOnError)
+		ttl := flags.Duration("ttl", 0, "")
+		replicas := flags.String("replicas", "", "")
+
+		got := parseArgs(flags, tt.args)
+		if !reflect.DeepEqual(got, tt.want) || *ttl != tt.wantTTL || *replicas != tt.wantAddr {
+			t.Errorf("parseArgs(%q) = %q with -ttl %v -replicas %q, want %q with -ttl %v -replicas %q",
+				tt.args, got, *ttl, *replicas, tt.want, tt.wantTTL, tt.wantAddr)
+		}
+	}
+}
+
+// status shows each replica's vector clock and view, and the ones it can't reach as such
+func TestPrintStatus(t *testing.T) {
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/getVC":
+			json.NewEncoder(w).Encode(map[string]interface{}{"VC": []int{2, 0, 1}})
+		case "/view":
+			json.NewEncoder(w).Encode(map[string]interface{}{"view": []string{"a:1", "b:2"}})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer replica.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	up := strings.TrimPrefix(replica.URL, "http://")
+	gone := strings.TrimPrefix(down.URL, "http://")
+	var out bytes.Buffer
+	printStatus(context.Background(), &out, nil, "http", []string{up, gone})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := [][]string{
+		{"REPLICA", "VECTOR", "CLOCK", "VIEW"},
+		{up, "[2", "0", "1]", "a:1,b:2"},
+		{gone, "unreachable"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("printed %d lines, want %d:\n%s", len(lines), len(want), out.String())
+	}
+	for i, line := range lines {
+		if got := strings.Fields(line); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("line %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+// A session saved by one run is what the next one starts from
+func TestSessionFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvsctl", "session.json")
+	if saved, err := loadSession(path); err != nil || saved.CausalMetadata != nil || saved.Replicas != nil {
+		t.Fatalf("loadSession() with no file = %+v, %v", saved, err)
+	}
+
+	want := sessionFile{Replicas: []string{"a:1", "b:2"}, CausalMetadata: &client.Metadata{ReqVector: []int{1, 2}, ReqIpIndex: 1}}
+	if err := saveSession(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadSession(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want interface{}
+	}{
+		{raw: "1", want: 1.0},
+		{raw: `"quoted"`, want: "quoted"},
+		{raw: `{"a": true}`, want: map[string]interface{}{"a": true}},
+		{raw: "plain text", want: "plain text"},
+		{raw: "null", want: "null"},
+	}
+	for _, tt := range tests {
+		if got := parseValue(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseValue(%q) = %#v, want %#v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestSplitAddrs(t *testing.T) {
+	got := splitAddrs(" a:1, ,b:2,")
+	if want := []string{"a:1", "b:2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("splitAddrs() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clevalle/CSE138_Assignment3/replica"
+)
+
+// setting is a single option of the replica, which can come from the config file, an env variable or a flag
+// Each source hands over the value as text, and set parses it into the config
+type setting struct {
+	name  string // the key in the config file, and the flag
+	env   string
+	usage string
+	set   func(cfg *replica.Config, raw string) error
+}
+
+// every option, in the order -help lists them
+var settings = []setting{
+	{"socket-address", "SOCKET_ADDRESS", "address the other replicas reach this one at, e.g. 10.10.0.2:8090",
+		func(cfg *replica.Config, raw string) error {
+			if _, _, err := net.SplitHostPort(raw); err != nil {
+				return err
+			}
+			cfg.SocketAddress = raw
+			return nil
+		}},
+	{"view", "VIEW", "comma separated socket addresses of every replica, this one included",
+		func(cfg *replica.Config, raw string) error {
+			cfg.View = nil
+			for _, addr := range strings.Split(raw, ",") {
+				if addr = strings.TrimSpace(addr); addr == "" {
+					continue
+				}
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					return err
+				}
+				cfg.View = append(cfg.View, addr)
+			}
+			return nil
+		}},
+	{"join", "JOIN", "start outside the cluster and wait to be added through POST /admin/join on a member (view isn't needed then)",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.Joining, err = strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("%q is not true or false", raw)
+			}
+			return nil
+		}},
+	{"consensus", "CONSENSUS", "how the view is agreed on: raft, or empty for each replica announcing the changes it sees",
+		func(cfg *replica.Config, raw string) error {
+			if raw != "" && raw != "raft" {
+				return fmt.Errorf("%q is not raft or empty", raw)
+			}
+			cfg.Consensus = raw
+			return nil
+		}},
+	{"linearizable-prefixes", "LINEARIZABLE_PREFIXES", "comma separated key prefixes whose keys are linearizable, through raft (needs consensus raft)",
+		func(cfg *replica.Config, raw string) error {
+			cfg.LinearizablePrefixes = nil
+			for _, prefix := range strings.Split(raw, ",") {
+				if prefix = strings.TrimSpace(prefix); prefix != "" {
+					cfg.LinearizablePrefixes = append(cfg.LinearizablePrefixes, prefix)
+				}
+			}
+			return nil
+		}},
+	{"listen-address", "LISTEN_ADDRESS", "address the API is served on",
+		func(cfg *replica.Config, raw string) error {
+			if _, _, err := net.SplitHostPort(raw); err != nil {
+				return err
+			}
+			cfg.ListenAddress = raw
+			return nil
+		}},
+	{"internal-listen-address", "INTERNAL_LISTEN_ADDRESS", "address the internal API is served on, e.g. :8091 (default: with the API)",
+		func(cfg *replica.Config, raw string) error {
+			if raw != "" {
+				if _, _, err := net.SplitHostPort(raw); err != nil {
+					return err
+				}
+			}
+			cfg.InternalListenAddress = raw
+			return nil
+		}},
+	{"data-dir", "DATA_DIR", "directory the operation log is kept in",
+		func(cfg *replica.Config, raw string) error {
+			cfg.DataDir = raw
+			return nil
+		}},
+	{"compact-log-after", "COMPACT_LOG_AFTER", "how many entries the operation log may hold before superseded ones are dropped",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.CompactLogAfter, err = parseCount(raw)
+			return err
+		}},
+	{"ack-policy", "ACK_POLICY", "how many replicas must get a write before the client is answered: none, one, majority or all",
+		func(cfg *replica.Config, raw string) error {
+			cfg.AckPolicy = replica.AckPolicy(raw)
+			return nil
+		}},
+	{"cluster-secret", "CLUSTER_SECRET", "secret shared by every replica, used to sign requests between them",
+		func(cfg *replica.Config, raw string) error {
+			cfg.ClusterSecret = []byte(raw)
+			return nil
+		}},
+	{"tls-cert-file", "TLS_CERT_FILE", "PEM certificate to serve the API over TLS with",
+		func(cfg *replica.Config, raw string) error {
+			cfg.TLSCertFile = raw
+			return nil
+		}},
+	{"tls-key-file", "TLS_KEY_FILE", "PEM key of the TLS certificate",
+		func(cfg *replica.Config, raw string) error {
+			cfg.TLSKeyFile = raw
+			return nil
+		}},
+	{"tls-ca-file", "TLS_CA_FILE", "PEM file of CAs to check other replicas' certificates against",
+		func(cfg *replica.Config, raw string) error {
+			cfg.TLSCAFile = raw
+			return nil
+		}},
+	{"acl-file", "ACL_FILE", "JSON file of client tokens and roles; turns on access control",
+		func(cfg *replica.Config, raw string) error {
+			cfg.ACLFile = raw
+			return nil
+		}},
+	{"rate-limit", "RATE_LIMIT", "requests a second each client may make to /kvs (0 is no limit)",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.RateLimit, err = parseNumber(raw)
+			return err
+		}},
+	{"rate-burst", "RATE_BURST", "requests a client may make at once before its rate limit kicks in",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.RateBurst, err = parseCount(raw)
+			return err
+		}},
+	{"max-concurrent", "MAX_CONCURRENT", "how many /kvs requests are handled at once (0 is no limit)",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.MaxConcurrent, err = parseCount(raw)
+			return err
+		}},
+	{"startup-delay", "STARTUP_DELAY", "how long to give the other replicas to start before catching up with them",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.StartupDelay, err = parseTimeout(raw)
+			return err
+		}},
+	{"reach-timeout", "REACH_TIMEOUT", "how long a replica has to answer /readyz's check before it is counted as down",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.ReachTimeout, err = parseTimeout(raw)
+			return err
+		}},
+	{"announce-timeout", "ANNOUNCE_TIMEOUT", "how long a replica has to answer before we tell it another went down",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.AnnounceTimeout, err = parseTimeout(raw)
+			return err
+		}},
+	{"request-timeout", "REQUEST_TIMEOUT", "how long any request to another replica may take",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.RequestTimeout, err = parseTimeout(raw)
+			return err
+		}},
+	{"write-timeout", "WRITE_TIMEOUT", "how long a client's write waits for the replicas the ack policy needs before answering 503",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.WriteTimeout, err = parseTimeout(raw)
+			return err
+		}},
+	{"max-send-attempts", "MAX_SEND_ATTEMPTS", "how many times a replica may fail to take a write (other than for a causal dependency) before it is taken to be down",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.MaxSendAttempts, err = parseCount(raw)
+			return err
+		}},
+	{"dependency-timeout", "DEPENDENCY_TIMEOUT", "how long a replica may wait on another replica's write before refusing ours counts as failing to take it",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.DependencyTimeout, err = parseTimeout(raw)
+			return err
+		}},
+	{"max-queued-writes", "MAX_QUEUED_WRITES", "how many writes may wait to be sent to one replica before it is taken to be down",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.MaxQueuedWrites, err = parseCount(raw)
+			return err
+		}},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long to wait on SIGTERM for requests and queued writes to finish before exiting",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.ShutdownTimeout, err = parseTimeout(raw)
+			return err
+		}},
+	{"election-timeout", "ELECTION_TIMEOUT", "how long a raft follower waits to hear from the leader before standing itself",
+		func(cfg *replica.Config, raw string) (err error) {
+			cfg.ElectionTimeout, err = parseTimeout(raw)
+			return err
+		}},
+	{"log-level", "LOG_LEVEL", "lowest level logged: debug, info, warn or error (can be changed at runtime with PUT /log-level)",
+		func(cfg *replica.Config, raw string) error {
+			switch raw {
+			case "debug", "info", "warn", "error":
+				cfg.LogLevel = raw
+				return nil
+			}
+			return fmt.Errorf("%q is not one of debug, info, warn or error", raw)
+		}},
+	{"trace-file", "TRACE_FILE", "file spans are appended to as OTLP JSON; turns on tracing",
+		func(cfg *replica.Config, raw string) error {
+			cfg.TraceFile = raw
+			return nil
+		}},
+	{"trace-endpoint", "TRACE_ENDPOINT", "OTLP/HTTP collector spans are sent to, e.g. http://localhost:4318; turns on tracing",
+		func(cfg *replica.Config, raw string) error {
+			cfg.TraceEndpoint = raw
+			return nil
+		}},
+}
+
+// Helper function that builds the config of the replica, from (lowest precedence first) the defaults, the config
+// file, env variables and command line flags
+// Every problem found is reported at once, so a broken config can be fixed in one go
+func loadConfig(args []string, getenv func(string) string) (replica.Config, error) {
+	cfg := replica.Config{
+		// Service listens on port 8090
+		ListenAddress: ":8090",
+		DataDir:       "data",
+	}
+
+	flags := flag.NewFlagSet("replica", flag.ContinueOnError)
+	configFile := flags.String("config", getenv("CONFIG_FILE"), "JSON config file; env variables and flags override it (env CONFIG_FILE)")
+	flagValues := make(map[string]*string, len(settings))
+	for _, opt := range settings {
+		flagValues[opt.name] = flags.String(opt.name, "", fmt.Sprintf("%s (env %s)", opt.usage, opt.env))
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+	if flags.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	var problems []string
+	failed := make(map[string]bool)
+	apply := func(opt setting, raw string, source string) {
+		if err := opt.set(&cfg, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s from %s: %s", opt.name, source, err))
+			failed[opt.name] = true
+		}
+	}
+
+	if *configFile != "" {
+		fileValues, err := readConfigFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+		for _, opt := range settings {
+			if raw, ok := fileValues[opt.name]; ok {
+				apply(opt, raw, *configFile)
+			}
+		}
+	}
+
+	for _, opt := range settings {
+		if raw := getenv(opt.env); raw != "" {
+			apply(opt, raw, opt.env)
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, opt := range settings {
+			if opt.name == f.Name {
+				apply(opt, *flagValues[opt.name], "-"+opt.name)
+			}
+		}
+	})
+
+	if cfg.SocketAddress == "" && !failed["socket-address"] {
+		problems = append(problems, "socket-address is required")
+	}
+	if len(cfg.View) == 0 && !cfg.Joining && !failed["view"] {
+		problems = append(problems, "view is required")
+	}
+	if len(problems) > 0 {
+		return cfg, fmt.Errorf("invalid config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return cfg, nil
+}
+
+// Helper function that reads the config file, returning every value in it as text
+// Keys the replica doesn't know are an error, so a typo doesn't go unnoticed
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%s: unexpected data after the config object", path)
+	}
+
+	known := make(map[string]bool, len(settings))
+	for _, opt := range settings {
+		known[opt.name] = true
+	}
+
+	values := make(map[string]string, len(raw))
+	var unknown []string
+	for key, val := range raw {
+		if !known[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+		text, err := configText(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		values[key] = text
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s: unknown settings %s", path, strings.Join(unknown, ", "))
+	}
+	return values, nil
+}
+
+// Helper function that turns a value from the config file into the same text an env variable would hold:
+// strings as they are, numbers and booleans as written, and lists of strings joined with commas
+func configText(val json.RawMessage) (string, error) {
+	var text string
+	if err := json.Unmarshal(val, &text); err == nil {
+		return text, nil
+	}
+	var list []string
+	if err := json.Unmarshal(val, &list); err == nil {
+		return strings.Join(list, ","), nil
+	}
+	var scalar interface{}
+	if err := json.Unmarshal(val, &scalar); err == nil {
+		switch scalar.(type) {
+		case float64, bool:
+			return string(bytes.TrimSpace(val)), nil
+		}
+	}
+	return "", fmt.Errorf("must be a string, number, boolean or list of strings")
+}
+
+func parseNumber(raw string) (float64, error) {
+	val, err := strconv.ParseFloat(raw, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative number", raw)
+	}
+	return val, nil
+}
+
+func parseCount(raw string) (int, error) {
+	val, err := strconv.Atoi(raw)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative whole number", raw)
+	}
+	return val, nil
+}
+
+// timeouts are written like "1.5s" or "500ms"
+func parseTimeout(raw string) (time.Duration, error) {
+	val, err := time.ParseDuration(raw)
+	if err != nil || val <= 0 {
+		return 0, fmt.Errorf("%q is not a positive duration", raw)
+	}
+	return val, nil
+}
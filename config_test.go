@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clevalle/CSE138_Assignment3/replica"
+)
+
+// Helper function that writes a config file to a temporary dir, returning its path
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Settings come from the defaults, then the config file, then env variables, then flags, each overriding the ones
+// before it
+func TestLoadConfig(t *testing.T) {
+	file := writeConfigFile(t, `{
+		"socket-address": "10.0.0.1:8090",
+		"view": ["10.0.0.1:8090", "10.0.0.2:8090"],
+		"listen-address": ":1",
+		"request-timeout": "1.5s",
+		"rate-limit": 2.5,
+		"max-send-attempts": 4,
+		"join": false
+	}`)
+	fromFile := replica.Config{
+		SocketAddress:   "10.0.0.1:8090",
+		View:            []string{"10.0.0.1:8090", "10.0.0.2:8090"},
+		ListenAddress:   ":1",
+		DataDir:         "data",
+		RequestTimeout:  1500 * time.Millisecond,
+		RateLimit:       2.5,
+		MaxSendAttempts: 4,
+	}
+	with := func(change func(cfg *replica.Config)) replica.Config {
+		cfg := fromFile
+		change(&cfg)
+		return cfg
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want replica.Config
+	}{
+		{name: "defaults", args: []string{"-socket-address", "10.0.0.1:8090", "-view", "10.0.0.1:8090"},
+			want: replica.Config{SocketAddress: "10.0.0.1:8090", View: []string{"10.0.0.1:8090"}, ListenAddress: ":8090", DataDir: "data"}},
+		{name: "config file from the flag", args: []string{"-config", file}, want: fromFile},
+		{name: "config file from the env", env: map[string]string{"CONFIG_FILE": file}, want: fromFile},
+		{name: "env over the file", args: []string{"-config", file},
+			env: map[string]string{"LISTEN_ADDRESS": ":2", "VIEW": "10.0.0.3:8090, 10.0.0.4:8090"},
+			want: with(func(cfg *replica.Config) {
+				cfg.ListenAddress, cfg.View = ":2", []string{"10.0.0.3:8090", "10.0.0.4:8090"}
+			})},
+		{name: "flags over the env", args: []string{"-config", file, "-listen-address", ":3", "-request-timeout", "2s"},
+			env:  map[string]string{"LISTEN_ADDRESS": ":2", "REQUEST_TIMEOUT": "1s"},
+			want: with(func(cfg *replica.Config) { cfg.ListenAddress, cfg.RequestTimeout = ":3", 2*time.Second })},
+		{name: "empty env variables are unset", args: []string{"-config", file}, env: map[string]string{"LISTEN_ADDRESS": ""},
+			want: fromFile},
+		{name: "joining needs no view", args: []string{"-socket-address", "10.0.0.1:8090", "-join", "true"},
+			want: replica.Config{SocketAddress: "10.0.0.1:8090", Joining: true, ListenAddress: ":8090", DataDir: "data"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(tt.args, func(name string) string { return tt.env[name] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg, tt.want) {
+				t.Errorf("loadConfig() = %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
+
+// A config that can't be used is refused at startup, with every problem in it at once
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		env     map[string]string
+		wantErr []string
+	}{
+		{name: "required settings missing", wantErr: []string{"socket-address is required", "view is required"}},
+		{name: "every bad value",
+			args: []string{"-view", "10.0.0.1:8090", "-request-timeout", "soon", "-max-send-attempts", "-1"},
+			env:  map[string]string{"SOCKET_ADDRESS": "nowhere", "LOG_LEVEL": "loud"},
+			wantErr: []string{"socket-address from SOCKET_ADDRESS", "log-level from LOG_LEVEL", `"loud" is not one of`,
+				`request-timeout from -request-timeout: "soon" is not a positive duration`,
+				`max-send-attempts from -max-send-attempts: "-1" is not a non-negative whole number`}},
+		{name: "a bad value isn't also missing", env: map[string]string{"SOCKET_ADDRESS": "nowhere", "VIEW": "10.0.0.1"},
+			wantErr: []string{"socket-address from SOCKET_ADDRESS", "view from VIEW"}},
+		{name: "bad value in the file", file: `{"socket-address": "10.0.0.1:8090", "view": "10.0.0.1:8090", "join": "maybe"}`,
+			wantErr: []string{`join from `, `"maybe" is not true or false`}},
+		{name: "unknown settings in the file", file: `{"socket-adress": "10.0.0.1:8090", "colour": "blue"}`,
+			wantErr: []string{"unknown settings colour, socket-adress"}},
+		{name: "file that isn't a config object", file: `{"view": ["10.0.0.1:8090"]} {}`,
+			wantErr: []string{"unexpected data after the config object"}},
+		{name: "value of the wrong type in the file", file: `{"view": {"a": 1}}`,
+			wantErr: []string{"view: must be a string, number, boolean or list of strings"}},
+		{name: "arguments that aren't flags", args: []string{"-socket-address", "10.0.0.1:8090", "10.0.0.2:8090"},
+			wantErr: []string{"unexpected arguments [10.0.0.2:8090]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+			_, err := loadConfig(args, func(name string) string { return tt.env[name] })
+			if err == nil {
+				t.Fatal("loadConfig() succeeded")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("loadConfig() error = %q, want it to say %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigText(t *testing.T) {
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{val: `"10.0.0.1:8090"`, want: "10.0.0.1:8090"},
+		{val: `["a", "b"]`, want: "a,b"},
+		{val: `1.5`, want: "1.5"},
+		{val: `true`, want: "true"},
+	}
+	for _, tt := range tests {
+		if got, err := configText([]byte(tt.val)); err != nil || got != tt.want {
+			t.Errorf("configText(%s) = %q, %v, want %q", tt.val, got, err, tt.want)
+		}
+	}
+	for _, val := range []string{`{"a": 1}`, `[1, 2]`} {
+		if got, err := configText([]byte(val)); err == nil {
+			t.Errorf("configText(%s) = %q, want an error", val, got)
+		}
+	}
+}
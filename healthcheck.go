@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// how long the healthcheck waits for the replica to answer
+var healthcheckTimeout = 3 * time.Second
+
+// Used by `healthcheck`, the Dockerfile's HEALTHCHECK: asks the replica running next to it for GET /healthz, finding
+// it from the same config file, env variables and flags the replica reads, so it follows LISTEN_ADDRESS and TLS
+// Returns the exit code, 0 if the replica answered 200
+func runHealthcheck(args []string) int {
+	cfg, err := loadConfig(args, os.Getenv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	host, port, err := net.SplitHostPort(cfg.ListenAddress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	// a replica listening on every interface is reachable on loopback
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.TLSCertFile != "" {
+		scheme = "https"
+		// we're only asking our own replica whether it's up, and its certificate is made out to its socket address
+		// rather than whatever address we reach it on, so there's nothing to gain by checking it
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: true}
+	}
+
+	client := &http.Client{Timeout: healthcheckTimeout, Transport: transport}
+	res, err := client.Get(fmt.Sprintf("%s://%s/healthz", scheme, net.JoinHostPort(host, port)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: %s\n", err)
+		return 1
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "unhealthy: /healthz answered %d\n", res.StatusCode)
+		return 1
+	}
+	return 0
+}
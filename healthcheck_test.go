@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The healthcheck finds the replica where it would listen, over TLS if it would serve it, and passes only if it
+// answers /healthz with a 200
+func TestRunHealthcheck(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+	overTLS := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	// the plain http request sent to it is logged as a failed handshake otherwise
+	overTLS.Config.ErrorLog = log.New(io.Discard, "", 0)
+	overTLS.StartTLS()
+	defer overTLS.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	closed.Close()
+
+	_, healthyPort, _ := net.SplitHostPort(healthy.Listener.Addr().String())
+	replica := []string{"-socket-address", "10.0.0.1:8090", "-view", "10.0.0.1:8090"}
+	tests := []struct {
+		name string
+		args []string
+		env  string // LISTEN_ADDRESS
+		want int
+	}{
+		{name: "healthy", args: []string{"-listen-address", healthy.Listener.Addr().String()}, want: 0},
+		{name: "listening on every interface", env: ":" + healthyPort, want: 0},
+		{name: "unhealthy", args: []string{"-listen-address", unhealthy.Listener.Addr().String()}, want: 1},
+		{name: "TLS", args: []string{"-listen-address", overTLS.Listener.Addr().String(), "-tls-cert-file", "cert.pem"}, want: 0},
+		{name: "plain http to TLS", args: []string{"-listen-address", overTLS.Listener.Addr().String()}, want: 1},
+		{name: "not listening", args: []string{"-listen-address", closed.Listener.Addr().String()}, want: 1},
+		{name: "bad config", args: []string{"-listen-address", healthy.Listener.Addr().String(), "-request-timeout", "soon"}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_ADDRESS", tt.env)
+			args := append(append([]string(nil), replica...), tt.args...)
+			if got := runHealthcheck(args); got != tt.want {
+				t.Errorf("runHealthcheck(%v) = %d, want %d", args, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// aclRule gives read and/or write access to every key starting with Prefix ("" is every key)
+type aclRule struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read"`
+	Write  bool   `json:"write"`
+}
+
+// aclToken is who a token belongs to, and which roles they have
+type aclToken struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// aclConfig is the layout of the access control file, e.g.
+//
+//	{"roles": {"reader": [{"prefix": "public/", "read": true}]},
+//	 "tokens": {"s3cr3t": {"name": "alice", "roles": ["reader"]}}}
+type aclConfig struct {
+	Roles  map[string][]aclRule `json:"roles"`
+	Tokens map[string]aclToken  `json:"tokens"`
+}
+
+// principal is a client that presented a valid token, along with every rule its roles give it
+type principal struct {
+	name  string
+	rules []aclRule
+}
+
+// Helper function that loads the access control file, checking every token only uses roles that exist
+func loadACL(path string) (map[string]*principal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg aclConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	tokens := make(map[string]*principal, len(cfg.Tokens))
+	for token, t := range cfg.Tokens {
+		if token == "" {
+			return nil, fmt.Errorf("%s: empty token for %q", path, t.Name)
+		}
+		p := &principal{name: t.Name}
+		for _, role := range t.Roles {
+			rules, ok := cfg.Roles[role]
+			if !ok {
+				return nil, fmt.Errorf("%s: token for %q has unknown role %q", path, t.Name, role)
+			}
+			p.rules = append(p.rules, rules...)
+		}
+		tokens[token] = p
+	}
+	return tokens, nil
+}
+
+// Helper function that checks if a client may read (or write, if write is set) a key
+func (p *principal) can(key string, write bool) bool {
+	for _, rule := range p.rules {
+		if !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		if (write && rule.Write) || (!write && rule.Read) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function that returns the client a request came from, going by its "Authorization: Bearer <token>" header
+// Returns nil if access control is off, or an error if it is on and the token is missing or unknown
+func (s *Server) authenticate(req *http.Request) (*principal, error) {
+	if s.tokens == nil {
+		return nil, nil
+	}
+
+	token, ok := bearerToken(req)
+	if !ok {
+		return nil, fmt.Errorf("no bearer token")
+	}
+	p, ok := s.tokens[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown token")
+	}
+	return p, nil
+}
+
+// Helper function that returns the token in a request's "Authorization: Bearer" header, if it has one
+func bearerToken(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	return token, header != "" && token != header
+}
+
+// Helper function that checks a client may read (or write) a key, answering 401 or 403 if it may not
+// Returns the client (nil if access control is off) and whether the request may go ahead
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request, key string, write bool) (*principal, bool) {
+	p, err := s.authenticate(req)
+	if err != nil {
+		s.deny(w, req, http.StatusUnauthorized, "", key, err.Error())
+		return nil, false
+	}
+	if p != nil && !p.can(key, write) {
+		access := "read"
+		if write {
+			access = "write"
+		}
+		s.deny(w, req, http.StatusForbidden, p.name, key, "no "+access+" access")
+		return nil, false
+	}
+	return p, true
+}
+
+// Helper function that logs a denied request to the audit log and answers it
+func (s *Server) deny(w http.ResponseWriter, req *http.Request, status int, who string, key string, reason string) {
+	loggerFrom(req.Context()).warn("access denied", "audit", true, "method", req.Method, "path", req.URL.Path, "key", key,
+		"client", who, "remote", req.RemoteAddr, "reason", reason)
+
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, req, errUnauthenticated, nil)
+	} else {
+		writeError(w, req, errForbidden, nil)
+	}
+}
+
+// Helper function that returns a filter letting through only log entries a client may read
+func (p *principal) readable(filter func(logEntry) bool) func(logEntry) bool {
+	if p == nil {
+		return filter
+	}
+	return func(entry logEntry) bool {
+		return filter(entry) && p.can(entry.Key, false)
+	}
+}
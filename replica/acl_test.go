@@ -0,0 +1,151 @@
+package replica
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the access control file the tests below use
+const testACL = `{
+	"roles": {
+		"reader": [{"prefix": "public/", "read": true}],
+		"writer": [{"prefix": "public/", "read": true, "write": true}, {"prefix": "drafts/", "write": true}],
+		"admin": [{"prefix": "", "read": true, "write": true}]
+	},
+	"tokens": {
+		"read-token": {"name": "alice", "roles": ["reader"]},
+		"write-token": {"name": "bob", "roles": ["writer"]},
+		"admin-token": {"name": "carol", "roles": ["reader", "admin"]}
+	}
+}`
+
+// Helper function that writes an access control file to a temporary dir, returning its path
+func writeACL(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+		want    map[string]string // token to name
+	}{
+		{name: "valid", content: testACL,
+			want: map[string]string{"read-token": "alice", "write-token": "bob", "admin-token": "carol"}},
+		{name: "no tokens", content: `{"roles": {"reader": []}}`, want: map[string]string{}},
+		{name: "not JSON", content: `{"roles":`, wantErr: "unexpected end of JSON input"},
+		{name: "unknown role", content: `{"tokens": {"t": {"name": "dave", "roles": ["ghost"]}}}`,
+			wantErr: `token for "dave" has unknown role "ghost"`},
+		{name: "empty token", content: `{"tokens": {"": {"name": "erin"}}}`, wantErr: `empty token for "erin"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := loadACL(writeACL(t, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadACL() error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != len(tt.want) {
+				t.Errorf("got %d tokens, want %d", len(tokens), len(tt.want))
+			}
+			for token, name := range tt.want {
+				if p, ok := tokens[token]; !ok || p.name != name {
+					t.Errorf("token %q is %v, want %s", token, p, name)
+				}
+			}
+		})
+	}
+
+	if _, err := loadACL(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadACL() of a missing file didn't fail")
+	}
+}
+
+// A client may read or write a key if any rule of any of its roles lets it
+func TestPrincipalCan(t *testing.T) {
+	tokens, err := loadACL(writeACL(t, testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token string
+		key   string
+		write bool
+		want  bool
+	}{
+		{token: "read-token", key: "public/a", want: true},
+		{token: "read-token", key: "public/a", write: true},
+		{token: "read-token", key: "private/a"},
+		{token: "read-token", key: "public"},
+		{token: "write-token", key: "public/a", write: true, want: true},
+		{token: "write-token", key: "drafts/a", write: true, want: true},
+		{token: "write-token", key: "drafts/a"},
+		{token: "admin-token", key: "anything", want: true},
+		{token: "admin-token", key: "anything", write: true, want: true},
+	}
+	for _, tt := range tests {
+		if got := tokens[tt.token].can(tt.key, tt.write); got != tt.want {
+			t.Errorf("%s can(%q, write %v) = %v, want %v", tt.token, tt.key, tt.write, got, tt.want)
+		}
+	}
+}
+
+// Requests for a key without a known token are answered 401, and ones the token doesn't give access to 403
+func TestKeyAccess(t *testing.T) {
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+	cfg.ACLFile = writeACL(t, testACL)
+	cfg.ClusterSecret = []byte("secret")
+	s := newServer(t, cfg)
+
+	tests := []struct {
+		name   string
+		method string
+		key    string
+		header string
+		body   string
+		want   int
+	}{
+		{name: "no token", method: "GET", key: "public/a", want: http.StatusUnauthorized},
+		{name: "not a bearer token", method: "GET", key: "public/a", header: "Basic read-token", want: http.StatusUnauthorized},
+		{name: "unknown token", method: "GET", key: "public/a", header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "read without access", method: "GET", key: "private/a", header: "Bearer read-token", want: http.StatusForbidden},
+		{name: "write without access", method: "PUT", key: "public/a", header: "Bearer read-token",
+			body: `{"value": 1}`, want: http.StatusForbidden},
+		{name: "delete without access", method: "DELETE", key: "public/a", header: "Bearer read-token",
+			want: http.StatusForbidden},
+		{name: "write", method: "PUT", key: "public/a", header: "Bearer write-token", body: `{"value": 1}`,
+			want: http.StatusCreated},
+		{name: "read", method: "GET", key: "public/a", header: "Bearer read-token", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/kvs/"+tt.key, strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s /kvs/%s = %d, want %d: %s", tt.method, tt.key, rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package replica
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// headers every request between replicas carries when the cluster has a shared secret
+const (
+	timestampHeader = "X-Cluster-Timestamp"
+	nonceHeader     = "X-Cluster-Nonce"
+	signatureHeader = "X-Cluster-Signature"
+)
+
+// how far a signed request's timestamp may be from our clock; nonces are remembered for this long to stop replays
+var signatureWindow = 30 * time.Second
+
+// the most a signed request's body may hold; the body is read before the signature can be checked, so this is how
+// much anyone can make us read
+var maxSignedBody int64 = 64 << 20
+
+// signingTransport signs every request a replica sends to another replica with the cluster's shared secret
+type signingTransport struct {
+	base   http.RoundTripper
+	secret []byte
+}
+
+// NewSigningTransport returns a transport that signs every request it sends with the cluster's shared secret, the way
+// replicas sign theirs, for tools that use the admin API (e.g. POST /admin/join) of a cluster with a secret
+func NewSigningTransport(base http.RoundTripper, secret []byte) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &signingTransport{base: base, secret: secret}
+}
+
+// peerAuth checks the signature on requests that only replicas may make
+type peerAuth struct {
+	secret []byte
+
+	// nonces we've seen, in two generations of 2*signatureWindow each: a nonce is forgotten when the generation after
+	// the one it was seen in ends, by when its timestamp is too old to be accepted again. Forgetting them is just
+	// dropping the older map, so it costs nothing however many requests we get
+	mu        sync.Mutex
+	nonces    map[string]struct{}
+	oldNonces map[string]struct{}
+	rotated   time.Time // when nonces became the current generation
+}
+
+// Helper function that makes the checker of signatures made with the given secret
+func newPeerAuth(secret []byte) *peerAuth {
+	return &peerAuth{secret: secret, nonces: make(map[string]struct{}), rotated: time.Now()}
+}
+
+// Helper function that computes the signature of a request
+// The signature covers the method, path, timestamp, nonce and a hash of the body, so none of them can be changed
+func sign(secret []byte, method string, uri string, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RoundTrip signs the request and sends it on
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nonceBytes := make([]byte, 12)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// RoundTrippers must not modify the request they were given
+	signed := req.Clone(req.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	signed.ContentLength = int64(len(body))
+	signed.Header.Set(timestampHeader, timestamp)
+	signed.Header.Set(nonceHeader, nonce)
+	signed.Header.Set(signatureHeader, sign(t.secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	return t.base.RoundTrip(signed)
+}
+
+// Helper function that checks the signature of a request, returning why it failed if it did
+// The body is read to check it (up to maxSignedBody), and put back so the handler can read it again
+func (a *peerAuth) verify(w http.ResponseWriter, req *http.Request) error {
+	timestamp := req.Header.Get(timestampHeader)
+	nonce := req.Header.Get(nonceHeader)
+	signature := req.Header.Get(signatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return fmt.Errorf("request is not signed")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	sent := time.Unix(seconds, 0)
+	if skew := time.Since(sent); skew > signatureWindow || skew < -signatureWindow {
+		return fmt.Errorf("timestamp is outside the allowed window")
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxSignedBody))
+	if err != nil {
+		return fmt.Errorf("could not read body (at most %d bytes)", maxSignedBody)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := sign(a.secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("signature does not match")
+	}
+
+	// a valid signature can only be used once
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now := time.Now(); now.Sub(a.rotated) >= 2*signatureWindow {
+		a.oldNonces, a.nonces = a.nonces, make(map[string]struct{})
+		a.rotated = now
+	}
+	_, seen := a.nonces[nonce]
+	_, seenBefore := a.oldNonces[nonce]
+	if seen || seenBefore {
+		return fmt.Errorf("request was replayed")
+	}
+	a.nonces[nonce] = struct{}{}
+	return nil
+}
+
+// Used to wrap a handler so the given methods (or every method, if none are given) can only be used by replicas
+// Does nothing if the cluster has no shared secret
+func (s *Server) requirePeer(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.auth == nil || !methodIn(req.Method, methods) {
+			next(w, req)
+			return
+		}
+
+		if err := s.auth.verify(w, req); err != nil {
+			loggerFrom(req.Context()).warn("rejected unauthenticated replica request", "method", req.Method, "path", req.URL.Path, "remote", req.RemoteAddr, "error", err)
+			w.Header().Set("WWW-Authenticate", "Cluster-HMAC")
+			writeError(w, req, errPeerUnauthenticated, nil)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// Helper function that checks if a method is in the list; an empty list holds every method
+func methodIn(method string, methods []string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
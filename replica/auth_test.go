@@ -0,0 +1,144 @@
+package replica
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper function that makes a request signed the way signingTransport signs them, at the given time
+func signedRequest(secret []byte, uri string, body string, at time.Time, nonce string) *http.Request {
+	req := httptest.NewRequest("POST", uri, strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(nonceHeader, nonce)
+	req.Header.Set(signatureHeader, sign(secret, "POST", uri, timestamp, nonce, []byte(body)))
+	return req
+}
+
+// Only requests signed with the cluster's secret, recently, once, and left as they were signed are let through
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		replay  bool // verify the request once before the one checked
+		wantErr string
+	}{
+		{name: "valid", req: func() *http.Request {
+			return signedRequest(secret, "/internal/replicate", `{"key": "x"}`, now, "n1")
+		}},
+		{name: "unsigned", req: func() *http.Request {
+			return httptest.NewRequest("POST", "/internal/replicate", strings.NewReader(`{"key": "x"}`))
+		}, wantErr: "request is not signed"},
+		{name: "bad signature", req: func() *http.Request {
+			return signedRequest([]byte("not the secret"), "/internal/replicate", `{"key": "x"}`, now, "n2")
+		}, wantErr: "signature does not match"},
+		{name: "stale timestamp", req: func() *http.Request {
+			return signedRequest(secret, "/internal/replicate", `{"key": "x"}`, now.Add(-2*signatureWindow), "n3")
+		}, wantErr: "timestamp is outside the allowed window"},
+		{name: "timestamp in the future", req: func() *http.Request {
+			return signedRequest(secret, "/internal/replicate", `{"key": "x"}`, now.Add(2*signatureWindow), "n4")
+		}, wantErr: "timestamp is outside the allowed window"},
+		{name: "invalid timestamp", req: func() *http.Request {
+			req := signedRequest(secret, "/internal/replicate", `{"key": "x"}`, now, "n5")
+			req.Header.Set(timestampHeader, "yesterday")
+			return req
+		}, wantErr: "invalid timestamp"},
+		{name: "replayed nonce", req: func() *http.Request {
+			return signedRequest(secret, "/internal/replicate", `{"key": "x"}`, now, "n6")
+		}, replay: true, wantErr: "request was replayed"},
+		{name: "tampered body", req: func() *http.Request {
+			req := signedRequest(secret, "/internal/replicate", `{"key": "x"}`, now, "n7")
+			req.Body = httptest.NewRequest("POST", "/", strings.NewReader(`{"key": "y"}`)).Body
+			return req
+		}, wantErr: "signature does not match"},
+		{name: "tampered path", req: func() *http.Request {
+			req := signedRequest(secret, "/internal/replicate", `{"key": "x"}`, now, "n8")
+			req.URL.Path = "/internal/bootstrap"
+			return req
+		}, wantErr: "signature does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newPeerAuth(secret)
+			if tt.replay {
+				if err := auth.verify(httptest.NewRecorder(), tt.req()); err != nil {
+					t.Fatalf("first verify() = %v", err)
+				}
+			}
+			err := auth.verify(httptest.NewRecorder(), tt.req())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verify() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("verify() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The body is still there for the handler to read once the signature has been checked
+func TestVerifyKeepsBody(t *testing.T) {
+	auth := newPeerAuth([]byte("secret"))
+	req := signedRequest([]byte("secret"), "/internal/replicate", `{"key": "x"}`, time.Now(), "n")
+	if err := auth.verify(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(req.Body); err != nil || string(body) != `{"key": "x"}` {
+		t.Errorf("handler reads %q, %v, want the body that was signed", body, err)
+	}
+}
+
+// Requests only replicas may make are answered 401 unless they come through a transport signing with the secret
+func TestRequirePeer(t *testing.T) {
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+	cfg.ClusterSecret = []byte("secret")
+	s := newServer(t, cfg)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		transport http.RoundTripper
+		method    string
+		path      string
+		want      int
+	}{
+		{name: "signed", transport: NewSigningTransport(nil, []byte("secret")), method: "GET", path: "/getKVS",
+			want: http.StatusOK},
+		{name: "unsigned", transport: http.DefaultTransport, method: "GET", path: "/getKVS",
+			want: http.StatusUnauthorized},
+		{name: "other secret", transport: NewSigningTransport(nil, []byte("other")), method: "GET", path: "/getKVS",
+			want: http.StatusUnauthorized},
+		{name: "unsigned method anyone may use", transport: http.DefaultTransport, method: "GET", path: "/view",
+			want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := (&http.Client{Transport: tt.transport}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, res.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") != "Cluster-HMAC" {
+				t.Errorf("WWW-Authenticate = %q, want Cluster-HMAC", res.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
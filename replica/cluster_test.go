@@ -0,0 +1,198 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests tune how often replicas retry, expire keys and snapshot the raft log here, before any replica starts, since
+// a replica's background work can still be finishing after Shutdown returns
+func TestMain(m *testing.M) {
+	retryBackoff = time.Millisecond
+	expiryInterval = 20 * time.Millisecond
+	raftSnapshotEvery = 5
+	os.Exit(m.Run())
+}
+
+// Helper function that returns the config a test replica starts from: its own data dir, short timeouts and no logs
+func testConfig(t *testing.T, addr string, view []string) Config {
+	return Config{
+		SocketAddress:   addr,
+		View:            view,
+		DataDir:         t.TempDir(),
+		StartupDelay:    50 * time.Millisecond,
+		ElectionTimeout: 150 * time.Millisecond,
+		LogOutput:       io.Discard,
+	}
+}
+
+// Helper function that makes a replica without starting it, and stops it when the test ends
+func newServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return s
+}
+
+// Helper function that starts n replicas in this process, each listening on its own port on localhost with its own
+// data dir, and waits until they are all ready; configure, if given, can change each replica's config first
+func startCluster(t *testing.T, n int, configure func(i int, cfg *Config)) []*Server {
+	t.Helper()
+
+	listeners := make([]net.Listener, n)
+	view := make([]string, n)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		view[i] = listener.Addr().String()
+	}
+
+	servers := make([]*Server, n)
+	for i := range servers {
+		cfg := testConfig(t, view[i], view)
+		cfg.Listener = listeners[i]
+		if configure != nil {
+			configure(i, &cfg)
+		}
+		servers[i] = newServer(t, cfg)
+	}
+	for _, s := range servers {
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// runs before the cleanups newServer registered, so they have nothing left to do: a replica shutting down waits
+	// up to 5 seconds on connections that never sent a request, which a replica's client can leave behind after
+	// dialing one more than it needed, so the others' idle connections are closed first
+	t.Cleanup(func() {
+		for i := len(servers) - 1; i >= 0; i-- {
+			for _, other := range servers {
+				other.client.CloseIdleConnections()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			servers[i].Shutdown(ctx)
+			cancel()
+		}
+	})
+
+	// each replica starts by recovering from the others, and writes taken in the middle of that aren't what's tested
+	for _, s := range servers {
+		s := s
+		eventually(t, 10*time.Second, s.sAddress+" to be ready", func() bool {
+			status, _ := call(t, s, http.MethodGet, "/readyz", nil)
+			return status == http.StatusOK
+		})
+	}
+	return servers
+}
+
+// Helper function that sends a request to a replica, returning the status and the decoded JSON body
+func call(t *testing.T, s *Server, method string, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, "http://"+s.sAddress+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	answer := make(map[string]interface{})
+	json.NewDecoder(res.Body).Decode(&answer)
+	return res.StatusCode, answer
+}
+
+// Helper function that has a replica handle a request without it going over the network, returning the answer
+func serve(s *Server, method string, path string, body string) *httptest.ResponseRecorder {
+	return serveHandler(s.Handler(), method, path, body)
+}
+
+// Helper function that has a handler take a request without it going over the network, returning the answer
+func serveHandler(h http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+// Helper function that waits until cond holds, failing the test if it doesn't within the timeout
+func eventually(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Helper function that returns a copy of a replica's store
+func storeOf(s *Server) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	store := make(map[string]interface{}, len(s.store))
+	for key, val := range s.store {
+		store[key] = val
+	}
+	return store
+}
+
+// Helper function that returns a copy of a replica's vector clock
+func clockOf(s *Server) vectorClock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.localVector.clone()
+}
+
+// Helper function that waits until every replica has seen every write, i.e. they all have the same vector clock
+func delivered(t *testing.T, servers []*Server) {
+	t.Helper()
+	eventually(t, 10*time.Second, "every write to reach every replica", func() bool {
+		for _, s := range servers[1:] {
+			if !reflect.DeepEqual(clockOf(servers[0]), clockOf(s)) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Helper function that checks every replica has the same store, and returns it
+func sameStore(t *testing.T, servers []*Server) map[string]interface{} {
+	t.Helper()
+	store := storeOf(servers[0])
+	for _, s := range servers[1:] {
+		if other := storeOf(s); !reflect.DeepEqual(store, other) {
+			t.Errorf("%s has %v, but %s has %v", servers[0].sAddress, store, s.sAddress, other)
+		}
+	}
+	return store
+}
@@ -0,0 +1,152 @@
+package replica
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// apiError is an error a handler answers with: the status, a machine-readable code clients can switch on, and a
+// message for people. Err is the underlying cause, which is logged but never sent
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %s", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// Is lets errors.Is match an apiError by its code, so errors.Is(err, errKeyNotFound) works with any cause attached
+func (e *apiError) Is(target error) bool {
+	t, ok := target.(*apiError)
+	return ok && t.Code == e.Code
+}
+
+// because returns a copy of the error with its cause attached
+func (e *apiError) because(err error) *apiError {
+	copied := *e
+	copied.Err = err
+	return &copied
+}
+
+// saying returns a copy of the error with a more specific message
+func (e *apiError) saying(message string) *apiError {
+	copied := *e
+	copied.Message = message
+	return &copied
+}
+
+// every error a handler answers with
+var (
+	errInvalidRequest       = &apiError{Status: http.StatusBadRequest, Code: "invalid_request", Message: "Request is not valid"}
+	errInvalidJSON          = &apiError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "Request body is not valid JSON"}
+	errKeyTooLong           = &apiError{Status: http.StatusBadRequest, Code: "key_too_long", Message: "Key is too long"}
+	errValueMissing         = &apiError{Status: http.StatusBadRequest, Code: "value_missing", Message: "PUT request does not specify a value"}
+	errInvalidTTL           = &apiError{Status: http.StatusBadRequest, Code: "invalid_ttl", Message: "TTL must be a positive number of seconds, and no more than 100 years"}
+	errReplicationMetadata  = &apiError{Status: http.StatusBadRequest, Code: "replication_metadata", Message: "Replication metadata is not accepted from clients"}
+	errSocketAddressMissing = &apiError{Status: http.StatusBadRequest, Code: "socket_address_missing", Message: "Request does not specify a socket-address"}
+	errInvalidFlag          = &apiError{Status: http.StatusBadRequest, Code: "invalid_flag", Message: "Flag must be 0 or 1"}
+	errInvalidMessage       = &apiError{Status: http.StatusBadRequest, Code: "invalid_message", Message: "Replication message is not valid"}
+	errKeyNotFound          = &apiError{Status: http.StatusNotFound, Code: "key_not_found", Message: "Key does not exist"}
+	errReplicaNotInView     = &apiError{Status: http.StatusNotFound, Code: "replica_not_in_view", Message: "View has no such replica"}
+	errReplicaNotMember     = &apiError{Status: http.StatusNotFound, Code: "replica_not_member", Message: "Cluster has no such replica"}
+	errUnauthenticated      = &apiError{Status: http.StatusUnauthorized, Code: "unauthenticated", Message: "Authentication required"}
+	errPeerUnauthenticated  = &apiError{Status: http.StatusUnauthorized, Code: "peer_unauthenticated", Message: "Replica authentication failed"}
+	errForbidden            = &apiError{Status: http.StatusForbidden, Code: "forbidden", Message: "Access denied"}
+	errMethodNotAllowed     = &apiError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "Method is not supported here"}
+	errReplicaRetired       = &apiError{Status: http.StatusConflict, Code: "replica_retired", Message: "Replica has left the cluster"}
+	errAlreadyMember        = &apiError{Status: http.StatusConflict, Code: "already_member", Message: "Replica is already a member of the cluster"}
+	errStaleViewEpoch       = &apiError{Status: http.StatusConflict, Code: "stale_view_epoch", Message: "View change is from an older epoch than our view"}
+	errMembershipConflict   = &apiError{Status: http.StatusConflict, Code: "membership_conflict", Message: "Membership disagrees with ours; add one replica at a time"}
+	errConfigChange         = &apiError{Status: http.StatusConflict, Code: "config_change", Message: "Raft voters are already being changed; try again"}
+	errRateLimited          = &apiError{Status: http.StatusTooManyRequests, Code: "rate_limited", Message: "Rate limit exceeded"}
+	errOverloaded           = &apiError{Status: http.StatusTooManyRequests, Code: "overloaded", Message: "Too many requests in progress"}
+	errCausalDependency     = &apiError{Status: http.StatusServiceUnavailable, Code: "causal_dependency", Message: "Causal dependencies not satisfied; try again later"}
+	errAckTimeout           = &apiError{Status: http.StatusServiceUnavailable, Code: "ack_timeout", Message: "Write was applied here, but not enough replicas acknowledged it in time"}
+	errPeerUnavailable      = &apiError{Status: http.StatusServiceUnavailable, Code: "peer_unavailable", Message: "No other replica could be reached"}
+	errNotReady             = &apiError{Status: http.StatusServiceUnavailable, Code: "not_ready", Message: "Replica is not ready"}
+	errShuttingDown         = &apiError{Status: http.StatusServiceUnavailable, Code: "shutting_down", Message: "Replica is shutting down"}
+	errHandOff              = &apiError{Status: http.StatusServiceUnavailable, Code: "hand_off_failed", Message: "Queued writes could not be handed off to the other replicas"}
+	errNoLeader             = &apiError{Status: http.StatusServiceUnavailable, Code: "no_leader", Message: "Raft group has no leader right now; try again"}
+	errNoQuorum             = &apiError{Status: http.StatusServiceUnavailable, Code: "no_quorum", Message: "Not enough of the raft group could be reached; try again later"}
+	errConsensusOff         = &apiError{Status: http.StatusNotFound, Code: "consensus_off", Message: "Replica is not running raft (CONSENSUS is not set)"}
+	errInternal             = &apiError{Status: http.StatusInternalServerError, Code: "internal", Message: "Internal server error"}
+	errLogWrite             = &apiError{Status: http.StatusInternalServerError, Code: "log_write_failed", Message: "Write could not be saved to disk"}
+)
+
+// apiHandler is a handler that returns its error rather than writing it, see handle
+type apiHandler func(w http.ResponseWriter, req *http.Request) error
+
+// Used to turn an apiHandler into an http.HandlerFunc that answers any error it returns
+func handle(h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := h(w, req); err != nil {
+			writeError(w, req, err, nil)
+		}
+	}
+}
+
+// Helper function that answers a request with an error, as {"error": <message>, "code": <code>} along with anything
+// else in body (e.g. causal metadata). Errors that aren't apiErrors are answered with 500, without their details
+func writeError(w http.ResponseWriter, req *http.Request, err error, body map[string]interface{}) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = errInternal.because(err)
+	}
+	if apiErr.Status >= 500 {
+		loggerFrom(req.Context()).error("request failed", "method", req.Method, "path", req.URL.Path, "code", apiErr.Code, "error", err)
+	} else if apiErr.Err != nil {
+		loggerFrom(req.Context()).warn("bad request", "method", req.Method, "path", req.URL.Path, "code", apiErr.Code, "error", err)
+	}
+
+	if body == nil {
+		body = make(map[string]interface{})
+	}
+	body["error"] = apiErr.Message
+	body["code"] = apiErr.Code
+	writeJSON(w, apiErr.Status, body)
+}
+
+// Helper function that answers a request with the given status and body as JSON
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	jsonResponse, err := json.Marshal(body)
+	if err != nil {
+		fallbackLogger.error("problem marshalling response", "error", err)
+		status = errInternal.Status
+		jsonResponse, _ = json.Marshal(map[string]interface{}{"error": errInternal.Message, "code": errInternal.Code})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+// Used to wrap the whole API so a panic in any handler is answered with a 500 rather than taking the replica down
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// net/http uses this panic to abort a response on purpose, so let it through
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			loggerFrom(req.Context()).error("panic handling request", "method", req.Method, "path", req.URL.Path, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			writeError(w, req, errInternal.because(fmt.Errorf("panic: %v", p)), nil)
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
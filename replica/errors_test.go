@@ -0,0 +1,138 @@
+package replica
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Refining an error leaves the original as it was, and the refined one still matches it
+func TestAPIError(t *testing.T) {
+	cause := errors.New("unexpected EOF")
+	refined := errInvalidJSON.because(cause).saying("View is not valid JSON")
+
+	if errInvalidJSON.Err != nil || errInvalidJSON.Message != "Request body is not valid JSON" {
+		t.Errorf("refining changed the original to %+v", errInvalidJSON)
+	}
+	if !errors.Is(refined, errInvalidJSON) || errors.Is(refined, errInvalidRequest) {
+		t.Error("errors.Is doesn't match the refined error by its code")
+	}
+	if !errors.Is(fmt.Errorf("handling PUT: %w", refined), cause) {
+		t.Error("errors.Is doesn't find the cause of a wrapped error")
+	}
+	if want := "invalid_json: View is not valid JSON: unexpected EOF"; refined.Error() != want {
+		t.Errorf("Error() = %q, want %q", refined.Error(), want)
+	}
+}
+
+// Errors are answered with their status and code, along with the rest of the body; errors that aren't apiErrors are
+// answered 500 without saying what they were
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		body     map[string]interface{}
+		want     int
+		wantBody map[string]interface{}
+	}{
+		{name: "api error", err: errKeyNotFound, want: http.StatusNotFound,
+			wantBody: map[string]interface{}{"error": errKeyNotFound.Message, "code": errKeyNotFound.Code}},
+		{name: "with a cause", err: errInvalidJSON.because(errors.New("secret detail")), want: http.StatusBadRequest,
+			wantBody: map[string]interface{}{"error": errInvalidJSON.Message, "code": errInvalidJSON.Code}},
+		{name: "wrapped", err: fmt.Errorf("applying: %w", errCausalDependency), want: http.StatusServiceUnavailable,
+			wantBody: map[string]interface{}{"error": errCausalDependency.Message, "code": errCausalDependency.Code}},
+		{name: "with the rest of the body", err: errKeyNotFound, body: map[string]interface{}{"causal-metadata": "m"},
+			want:     http.StatusNotFound,
+			wantBody: map[string]interface{}{"error": errKeyNotFound.Message, "code": errKeyNotFound.Code, "causal-metadata": "m"}},
+		{name: "not an api error", err: errors.New("secret detail"), want: http.StatusInternalServerError,
+			wantBody: map[string]interface{}{"error": errInternal.Message, "code": errInternal.Code}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeError(rec, httptest.NewRequest("GET", "/kvs/x", nil), tt.err, tt.body)
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if rec.Code != tt.want || fmt.Sprint(body) != fmt.Sprint(tt.wantBody) {
+			t.Errorf("%s: answered %d %v, want %d %v", tt.name, rec.Code, body, tt.want, tt.wantBody)
+		}
+		if rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: Content-Type = %q", tt.name, rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// A handler that panics gets a 500 and the panic is logged, and the replica carries on
+func TestRecoverPanics(t *testing.T) {
+	var logged bytes.Buffer
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+	cfg.LogOutput = &logged
+	s := newServer(t, cfg)
+	h := s.withRequestID(recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		var store map[string]interface{}
+		store["x"] = 1
+	})))
+
+	rec := serveHandler(h, "GET", "/panic", "")
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), `"code":"internal"`) {
+		t.Errorf("panicking handler answered %d %s, want 500 internal", rec.Code, rec.Body)
+	}
+	if !strings.Contains(logged.String(), `"msg":"panic handling request"`) {
+		t.Errorf("the panic wasn't logged: %s", logged.String())
+	}
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("aborting handler panicked with %v, want http.ErrAbortHandler to go through", p)
+		}
+	}()
+	serveHandler(h, "GET", "/abort", "")
+}
+
+// Nothing a client sends brings a replica down; it is answered with what was wrong with it
+func TestBadRequests(t *testing.T) {
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		want     int
+		wantCode string
+	}{
+		{method: "PUT", path: "/kvs/x", body: `{"value":`, want: http.StatusBadRequest, wantCode: errInvalidJSON.Code},
+		{method: "PUT", path: "/kvs/x", body: `[1, 2]`, want: http.StatusBadRequest, wantCode: errInvalidJSON.Code},
+		{method: "PUT", path: "/kvs/x", body: `{}`, want: http.StatusBadRequest, wantCode: errValueMissing.Code},
+		{method: "PUT", path: "/kvs/" + strings.Repeat("k", 51), body: `{"value": 1}`, want: http.StatusBadRequest,
+			wantCode: errKeyTooLong.Code},
+		{method: "GET", path: "/kvs/missing", want: http.StatusNotFound, wantCode: errKeyNotFound.Code},
+		{method: "PUT", path: "/view", body: `{"socket-address":`, want: http.StatusBadRequest, wantCode: errInvalidJSON.Code},
+		{method: "DELETE", path: "/view", body: `not json`, want: http.StatusBadRequest, wantCode: errInvalidJSON.Code},
+		{method: "GET", path: "/down/abc", want: http.StatusBadRequest, wantCode: errInvalidFlag.Code},
+		{method: "GET", path: "/down/2", want: http.StatusBadRequest, wantCode: errInvalidFlag.Code},
+		{method: "POST", path: "/internal/replicate", body: `{"seq": "one"}`, want: http.StatusBadRequest,
+			wantCode: errInvalidJSON.Code},
+	}
+	for _, tt := range tests {
+		rec := serve(s, tt.method, tt.path, tt.body)
+		var body struct{ Code string }
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != tt.want || body.Code != tt.wantCode {
+			t.Errorf("%s %s %s = %d %s, want %d %s", tt.method, tt.path, tt.body, rec.Code, rec.Body, tt.want, tt.wantCode)
+		}
+	}
+
+	if rec := serve(s, "PUT", "/kvs/x", `{"value": 1}`); rec.Code != http.StatusCreated {
+		t.Errorf("PUT after the bad requests = %d %s, want 201", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,174 @@
+package replica
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Version is the version of the replica /status reports; set it when building, e.g.
+// go build -ldflags "-X github.com/clevalle/CSE138_Assignment3/replica.Version=v1.2.0"
+var Version = "dev"
+
+// peerStatus is how replication to one other replica is going, as /status reports it
+type peerStatus struct {
+	Pending int    `json:"pending"`  // writes queued for the replica that haven't been sent yet
+	LastSeq uint64 `json:"last-seq"` // sequence number of the last write queued for it
+}
+
+// Handler function that answers as long as the process is up and serving, for liveness probes
+func (s *Server) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// Handler function that answers 200 once the replica should be sent requests, and 503 until then: the store has to be
+// loaded from the operation log, recovery (didIDie) has to be over, and enough of the other replicas in our view have
+// to be reachable for our ack policy (one or majority) to be met. A replica started with JOIN isn't ready until it has
+// been added to the cluster, and with raft, a replica isn't ready while it knows of no leader. Every check is reported,
+// passed or not
+func (s *Server) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	loaded := !s.startedAt.IsZero()
+	recovered := s.recovered
+	draining := s.draining
+	joining := s.joining
+	var peers []string
+	for _, replicaIP := range s.replicaArray {
+		if replicaIP != s.sAddress {
+			peers = append(peers, replicaIP)
+		}
+	}
+	s.mu.Unlock()
+
+	checks := make(map[string]interface{})
+	ready := true
+	if loaded {
+		checks["store"] = "loaded"
+	} else {
+		checks["store"] = "not loaded"
+		ready = false
+	}
+	if recovered {
+		checks["recovery"] = "done"
+	} else {
+		checks["recovery"] = "in progress"
+		ready = false
+	}
+
+	if draining {
+		checks["shutdown"] = "in progress"
+		ready = false
+	}
+	if joining {
+		checks["membership"] = "waiting to be added"
+		ready = false
+	}
+
+	// with raft, the view can't change without a leader, so a replica that doesn't know of one can't be sure of its view
+	if s.raft != nil {
+		if leader := s.raftLeader(); leader != "" {
+			checks["consensus"] = "leader is " + leader
+		} else {
+			checks["consensus"] = "no leader"
+			ready = false
+		}
+	}
+
+	reachable := s.countReachable(req.Context(), peers)
+	needed := s.ackPolicy.needed(len(peers))
+	if s.ackPolicy == AckAll {
+		// AckAll waits for every replica that is up, and a replica that's down is dropped from the view the first
+		// time a write can't reach it, so writes never wait on one; being unready because of it would only make
+		// every replica left unready at once
+		needed = 0
+	}
+	checks["peers"] = fmt.Sprintf("%d of %d reachable, %d needed by ack policy %s", reachable, len(peers), needed, s.ackPolicy)
+	if reachable < needed {
+		ready = false
+	}
+
+	response := map[string]interface{}{"ready": ready, "checks": checks}
+	if !ready {
+		writeError(w, req, errNotReady, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Helper function that checks every given replica at once, returning how many answered within ReachTimeout
+func (s *Server) countReachable(ctx context.Context, replicas []string) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reachable := 0
+	for _, replicaIP := range replicas {
+		wg.Add(1)
+		go func(replicaIP string) {
+			defer wg.Done()
+			if s.isReachable(ctx, replicaIP, s.cfg.ReachTimeout) {
+				mu.Lock()
+				reachable++
+				mu.Unlock()
+			}
+		}(replicaIP)
+	}
+	wg.Wait()
+	return reachable
+}
+
+// Handler function that reports what the replica is up to: its view and membership, vector clock, how many writes are
+// waiting to be sent to each other replica, where the raft group stands (if there is one), whether it has recovered,
+// how long it has been up and which version it is
+func (s *Server) handleStatus(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	startedAt := s.startedAt
+	response := map[string]interface{}{
+		"replica":      s.sAddress,
+		"version":      Version,
+		"view":         append([]string(nil), s.replicaArray...),
+		"view-epoch":   s.viewEpoch,
+		"members":      append([]string(nil), s.members...),
+		"retired":      s.currentMembership().Retired,
+		"joining":      s.joining,
+		"vector-clock": s.localVector.clone(),
+		"keys":         len(s.store),
+		"ack-policy":   s.ackPolicy,
+		"recovered":    s.recovered,
+	}
+	queues := make(map[string]*peerQueue, len(s.peers))
+	for addr, queue := range s.peers {
+		queues[addr] = queue
+	}
+	// replicas we never had to send anything to have nothing pending
+	for _, replicaIP := range s.replicaArray {
+		if _, ok := queues[replicaIP]; !ok && replicaIP != s.sAddress {
+			queues[replicaIP] = nil
+		}
+	}
+	s.mu.Unlock()
+
+	replication := make(map[string]peerStatus, len(queues))
+	for addr, queue := range queues {
+		var status peerStatus
+		if queue != nil {
+			queue.mu.Lock()
+			status.Pending = len(queue.pending)
+			status.LastSeq = queue.nextSeq
+			queue.mu.Unlock()
+		}
+		replication[addr] = status
+	}
+	response["replication"] = replication
+	if s.raft != nil {
+		response["raft"] = s.raftStatus(false)
+	}
+
+	if startedAt.IsZero() {
+		response["uptime"] = 0.0
+	} else {
+		response["started"] = startedAt.UTC().Format(time.RFC3339)
+		response["uptime"] = time.Since(startedAt).Seconds()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
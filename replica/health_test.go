@@ -0,0 +1,134 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper function that asks a replica whether it is ready, returning the status and the checks it reported
+func readyzOf(t *testing.T, s *Server) (int, map[string]string) {
+	t.Helper()
+	rec := serve(s, "GET", "/readyz", "")
+	var body struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Ready != (rec.Code == http.StatusOK) {
+		t.Errorf("/readyz answered %d with ready %v", rec.Code, body.Ready)
+	}
+	return rec.Code, body.Checks
+}
+
+func TestHealthz(t *testing.T) {
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	if rec := serve(s, "GET", "/healthz", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"ok"`) {
+		t.Errorf("GET /healthz = %d %s, want 200 ok", rec.Code, rec.Body)
+	}
+}
+
+// A replica is ready once it has loaded its store and recovered, while enough of the others are reachable for its ack
+// policy; it isn't while it waits to join the cluster or shuts down
+func TestReadyz(t *testing.T) {
+	unstarted := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	if code, checks := readyzOf(t, unstarted); code != http.StatusServiceUnavailable ||
+		checks["store"] != "not loaded" || checks["recovery"] != "in progress" {
+		t.Errorf("replica that hasn't started answered %d %v, want 503 with its store not loaded", code, checks)
+	}
+
+	cfg := testConfig(t, "127.0.0.1:1", nil)
+	cfg.Joining = true
+	joining := newServer(t, cfg)
+	if err := joining.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if code, checks := readyzOf(t, joining); code != http.StatusServiceUnavailable || checks["membership"] != "waiting to be added" {
+		t.Errorf("joining replica answered %d %v, want 503 waiting to be added", code, checks)
+	}
+
+	servers := startCluster(t, 3, func(i int, cfg *Config) {
+		cfg.AckPolicy = AckMajority
+		cfg.ReachTimeout = 200 * time.Millisecond
+	})
+	steps := []struct {
+		name       string
+		stop       *Server
+		want       int
+		wantChecks map[string]string
+	}{
+		{name: "every replica up", want: http.StatusOK,
+			wantChecks: map[string]string{"store": "loaded", "recovery": "done", "peers": "2 of 2 reachable, 1 needed by ack policy majority"}},
+		{name: "enough replicas up", stop: servers[2], want: http.StatusOK,
+			wantChecks: map[string]string{"peers": "1 of 2 reachable, 1 needed by ack policy majority"}},
+		{name: "too few replicas up", stop: servers[1], want: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"store": "loaded", "recovery": "done", "peers": "0 of 2 reachable, 1 needed by ack policy majority"}},
+		{name: "shutting down", stop: servers[0], want: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"shutdown": "in progress"}},
+	}
+	for _, step := range steps {
+		if step.stop == servers[0] {
+			// shutting down announces we are leaving, which the others are no longer up to hear
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			servers[0].Shutdown(ctx)
+			cancel()
+		} else if step.stop != nil {
+			// stopped without leaving the view, as if it had crashed
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			step.stop.Stop(ctx)
+			cancel()
+		}
+		code, checks := readyzOf(t, servers[0])
+		if code != step.want {
+			t.Errorf("%s: /readyz = %d %v, want %d", step.name, code, checks, step.want)
+		}
+		for name, want := range step.wantChecks {
+			if checks[name] != want {
+				t.Errorf("%s: check %s is %q, want %q", step.name, name, checks[name], want)
+			}
+		}
+	}
+}
+
+// /status reports the replica's view, clock and keys, and how far replication to each other replica has got
+func TestStatus(t *testing.T) {
+	servers := startCluster(t, 2, nil)
+	if status, body := call(t, servers[0], "PUT", "/kvs/x", map[string]interface{}{"value": 1}); status != http.StatusCreated {
+		t.Fatalf("PUT = %d %v, want 201", status, body)
+	}
+	peer := servers[1].sAddress
+
+	var status struct {
+		Replica     string                `json:"replica"`
+		Version     string                `json:"version"`
+		View        []string              `json:"view"`
+		VectorClock vectorClock           `json:"vector-clock"`
+		Keys        int                   `json:"keys"`
+		Recovered   bool                  `json:"recovered"`
+		Replication map[string]peerStatus `json:"replication"`
+		Started     string                `json:"started"`
+		Uptime      float64               `json:"uptime"`
+	}
+	eventually(t, 5*time.Second, "the write to reach "+peer, func() bool {
+		rec := serve(servers[0], "GET", "/status", "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status.Replication[peer] == peerStatus{Pending: 0, LastSeq: 1}
+	})
+
+	if status.Replica != servers[0].sAddress || status.Version != Version || len(status.View) != 2 {
+		t.Errorf("status is %+v, want replica %s at version %s with both in its view", status, servers[0].sAddress, Version)
+	}
+	if !status.VectorClock.equal(vectorClock{1, 0}) || status.Keys != 1 || !status.Recovered {
+		t.Errorf("status is %+v, want clock [1 0] and the one key, recovered", status)
+	}
+	if _, err := time.Parse(time.RFC3339, status.Started); err != nil || status.Uptime <= 0 {
+		t.Errorf("started %q and up %v seconds, want a start time and some uptime", status.Started, status.Uptime)
+	}
+}
@@ -0,0 +1,244 @@
+package replica
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// replicationMessage is how one replica sends a write it logged to another, through /internal/replicate
+type replicationMessage struct {
+	Stream      string      `json:"stream"` // which replica (and run of it) sent this
+	Seq         uint64      `json:"seq"`    // position of this write in the stream
+	Key         string      `json:"key"`
+	Op          string      `json:"op"` // "put" or "delete"
+	Value       interface{} `json:"value,omitempty"`
+	ExpiresAt   *int64      `json:"expires-at,omitempty"`
+	VectorClock vectorClock `json:"vector-clock"`
+	Origin      int         `json:"origin"` // vector index of the replica that first accepted the write
+	RequestID   string      `json:"request-id,omitempty"`
+	ViewEpoch   uint64      `json:"view-epoch"` // epoch of the sender's view when it sent this, see view.go
+}
+
+// Helper function used to turn an entry of our log into the message the other replicas expect
+func newReplicationMessage(stream string, seq uint64, viewEpoch uint64, entry logEntry) replicationMessage {
+	return replicationMessage{
+		Stream:      stream,
+		Seq:         seq,
+		Key:         entry.Key,
+		Op:          entry.Op,
+		Value:       entry.Value,
+		ExpiresAt:   entry.ExpiresAt,
+		VectorClock: entry.VectorClock,
+		Origin:      entry.Origin,
+		RequestID:   entry.RequestID,
+		ViewEpoch:   viewEpoch,
+	}
+}
+
+// Used to build the router for the API only replicas use
+func (s *Server) internalRouter(r *mux.Router) {
+	r.HandleFunc("/internal/replicate", s.requirePeer(handle(s.handleReplicate))).Methods("POST")
+	r.HandleFunc("/internal/members", s.requirePeer(handle(s.handleMembers))).Methods("GET", "POST")
+	r.HandleFunc("/internal/bootstrap", s.requirePeer(handle(s.handleBootstrap))).Methods("POST")
+	if s.raft != nil {
+		r.HandleFunc("/internal/raft/vote", s.requirePeer(handle(s.handleRaftVote))).Methods("POST")
+		r.HandleFunc("/internal/raft/append", s.requirePeer(handle(s.handleRaftAppend))).Methods("POST")
+		r.HandleFunc("/internal/raft/snapshot", s.requirePeer(handle(s.handleRaftSnapshot))).Methods("POST")
+		r.HandleFunc("/internal/raft/propose", s.requirePeer(handle(s.handleRaftPropose))).Methods("POST")
+		r.HandleFunc("/internal/raft/read-index", s.requirePeer(handle(s.handleRaftReadIndex))).Methods("POST")
+	}
+}
+
+// Helper function that returns where a replica serves its internal API
+// If we serve it on its own listener, every replica is expected to serve it on the same port we do
+func (s *Server) internalAddress(replicaIP string) string {
+	if addr, ok := s.cfg.InternalAddresses[replicaIP]; ok {
+		return addr
+	}
+	port := ""
+	if s.cfg.InternalListener != nil {
+		_, port, _ = net.SplitHostPort(s.cfg.InternalListener.Addr().String())
+	} else if s.cfg.InternalListenAddress != "" {
+		_, port, _ = net.SplitHostPort(s.cfg.InternalListenAddress)
+	}
+	if port == "" {
+		return replicaIP
+	}
+	host, _, err := net.SplitHostPort(replicaIP)
+	if err != nil {
+		return replicaIP
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Handler function that applies a write another replica broadcast to us
+// We apply writes from each replica in the order it accepted them (CBCAST): the sender's index of the vector clock must
+// be exactly one more than ours, and every other index no bigger than ours, or we answer 503 and the sender tries
+// again later. Every write we dealt with is acknowledged with its sequence number, and a write we already applied is
+// acknowledged again without applying it twice; once our log has failed, nothing more is, since we couldn't keep it
+// across a restart. Every answer carries the epoch of our view, as every write carries the
+// sender's, so whichever of us is on an older view finds out and catches up (see syncView)
+func (s *Server) handleReplicate(w http.ResponseWriter, req *http.Request) error {
+	response := make(map[string]interface{})
+	var apiErr *apiError
+	var lsn int64 // of the entry we logged for the write, if we applied it
+
+	var msg replicationMessage
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		return errInvalidJSON.because(err)
+	}
+
+	s.mu.Lock()
+	// until we are bootstrapped we have no store to apply the write to; it is sent again until we take it
+	if s.joining {
+		s.mu.Unlock()
+		return errNotReady
+	}
+	log := loggerFrom(req.Context()).with("key", msg.Key, "op", msg.Op, "origin", msg.Origin, "seq", msg.Seq)
+	log.debug("replicated write received", "vector_clock", s.localVector, "message_vector_clock", msg.VectorClock)
+
+	origin := msg.Origin
+	if origin < 0 || origin == s.vectorIndex || (msg.Op != "put" && msg.Op != "delete") {
+		// nothing the sender can do will make this message valid, so it is acknowledged and dropped
+		apiErr = errInvalidMessage
+	} else if origin >= len(s.members) {
+		// a write from a replica that joined while we weren't looking; once we hear about it, we can take the write
+		apiErr = errCausalDependency
+	} else if err := s.logFailed(); err != nil {
+		log.error("replicated write refused, the log has failed", "error", err)
+		apiErr = errLogWrite
+	} else if s.alreadyApplied(msg) {
+		response["result"] = "duplicate"
+	} else {
+		_, causal := s.tracer.start(req.Context(), "causal check", spanInternal,
+			"vector_clock", s.localVector.clone(), "message_vector_clock", msg.VectorClock)
+		//check for consistency violations
+		for i := 0; i < len(msg.VectorClock); i++ {
+			if i == origin {
+				if msg.VectorClock[i] != s.localVector.at(i)+1 {
+					apiErr = errCausalDependency
+				}
+			} else if msg.VectorClock[i] > s.localVector.at(i) {
+				apiErr = errCausalDependency
+			}
+		}
+
+		if apiErr != nil {
+			causal.fail(apiErr)
+		}
+		causal.finish()
+
+		if apiErr == nil {
+			_, apply := s.tracer.start(req.Context(), "apply", spanInternal, "key", msg.Key, "op", msg.Op)
+			if entry, err := s.applyReplicated(msg); err != nil {
+				log.error("replicated write not applied, the log has failed", "error", err)
+				apiErr = errLogWrite
+				apply.fail(apiErr)
+			} else {
+				lsn = entry.LSN
+				response["result"] = "applied"
+				apply.set("vector_clock", s.localVector.clone())
+			}
+			apply.finish()
+		}
+	}
+
+	// a sender on a newer view than ours has seen view changes we missed
+	var newerView string
+	if msg.ViewEpoch > s.viewEpoch && origin >= 0 && origin < len(s.members) {
+		newerView = s.members[origin]
+		log.info("peer is on a newer view", "epoch", s.viewEpoch, "peer_epoch", msg.ViewEpoch)
+	}
+	response["view-epoch"] = s.viewEpoch
+
+	// acknowledging every message we dealt with, so the sender stops resending it
+	// (a causal violation isn't dealt with yet, so the sender has to try again later, as does one we couldn't log)
+	if apiErr != errCausalDependency && apiErr != errLogWrite {
+		if msg.Stream != "" && msg.Seq > s.received[msg.Stream] {
+			s.received[msg.Stream] = msg.Seq
+		}
+		response["ack"] = msg.Seq
+	}
+	if apiErr != nil {
+		log.debug("replicated write refused", "error", apiErr.Code, "vector_clock", s.localVector)
+	} else {
+		log.info("replicated write "+response["result"].(string), "vector_clock", s.localVector)
+	}
+	s.mu.Unlock()
+
+	// the ack is only sent once the write is on disk here
+	if err := s.syncLog(lsn); err != nil {
+		log.error("replicated write not synced", "error", err)
+		apiErr = errLogWrite
+		delete(response, "ack")
+	}
+
+	if newerView != "" {
+		go s.syncView(newerView)
+	}
+	if apiErr == errCausalDependency {
+		s.metrics.causalViolation("replica")
+	}
+	if apiErr != nil {
+		writeError(w, req, apiErr, response)
+	} else {
+		writeJSON(w, http.StatusOK, response)
+	}
+	return nil
+}
+
+// Helper function that checks if we already applied a write, either because we already acknowledged its sequence
+// number or because our vector clock already covers it; must be called with s.mu held
+func (s *Server) alreadyApplied(msg replicationMessage) bool {
+	if msg.Stream != "" && msg.Seq <= s.received[msg.Stream] {
+		return true
+	}
+	return msg.VectorClock.at(msg.Origin) <= s.localVector.at(msg.Origin)
+}
+
+// Helper function used to apply a write that passed the causal check, merge its vector clock into ours and log it,
+// returning the entry it logged (none, for a delete of a key we don't have); a write that can't be logged is undone
+// Must be called with s.mu held
+func (s *Server) applyReplicated(msg replicationMessage) (logEntry, error) {
+	before := s.keyState(msg.Key)
+	clock := s.localVector.clone()
+
+	changed := true
+	if msg.Op == "put" {
+		s.setValue(msg.Key, msg.Value)
+		if msg.ExpiresAt != nil {
+			s.expiries[msg.Key] = keyExpiry{ExpiresAt: *msg.ExpiresAt, Owner: msg.Origin}
+		} else {
+			delete(s.expiries, msg.Key)
+		}
+	} else if _, ok := s.store[msg.Key]; ok {
+		s.deleteValue(msg.Key)
+		delete(s.expiries, msg.Key)
+	} else {
+		changed = false
+	}
+
+	// set the local clock to the max of the local clock and the message's clock
+	s.localVector.merge(msg.VectorClock)
+
+	if !changed {
+		return logEntry{}, nil
+	}
+	entry, err := s.appendLog(logEntry{
+		Key:         msg.Key,
+		Op:          msg.Op,
+		Value:       msg.Value,
+		ExpiresAt:   msg.ExpiresAt,
+		VectorClock: s.localVector.clone(),
+		Origin:      msg.Origin,
+		RequestID:   msg.RequestID,
+	})
+	if err != nil {
+		s.restoreKey(msg.Key, before)
+		s.localVector = clock
+	}
+	return entry, err
+}
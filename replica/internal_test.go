@@ -0,0 +1,160 @@
+package replica
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Writes from each replica are applied in the order it took them, and everything dealt with is acknowledged: writes
+// that arrive early are refused until the ones before them have come, and writes seen already aren't applied again
+func TestHandleReplicate(t *testing.T) {
+	view := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	s := newServer(t, testConfig(t, view[0], view))
+
+	steps := []struct {
+		name       string
+		msg        replicationMessage
+		want       int
+		wantCode   string
+		wantResult string
+		wantAck    bool
+	}{
+		{name: "first write", msg: replicationMessage{Stream: "b", Seq: 1, Key: "x", Op: "put", Value: 1.0, VectorClock: vectorClock{0, 1, 0}, Origin: 1},
+			want: http.StatusOK, wantResult: "applied", wantAck: true},
+		{name: "write sent before the one it follows", msg: replicationMessage{Stream: "b", Seq: 3, Key: "y", Op: "put", Value: 3.0, VectorClock: vectorClock{0, 3, 0}, Origin: 1},
+			want: http.StatusServiceUnavailable, wantCode: errCausalDependency.Code},
+		{name: "the write it follows", msg: replicationMessage{Stream: "b", Seq: 2, Key: "x", Op: "delete", VectorClock: vectorClock{0, 2, 0}, Origin: 1},
+			want: http.StatusOK, wantResult: "applied", wantAck: true},
+		{name: "sent again", msg: replicationMessage{Stream: "b", Seq: 2, Key: "x", Op: "delete", VectorClock: vectorClock{0, 2, 0}, Origin: 1},
+			want: http.StatusOK, wantResult: "duplicate", wantAck: true},
+		{name: "the early write again", msg: replicationMessage{Stream: "b", Seq: 3, Key: "y", Op: "put", Value: 3.0, VectorClock: vectorClock{0, 3, 0}, Origin: 1},
+			want: http.StatusOK, wantResult: "applied", wantAck: true},
+		{name: "write that saw another replica's", msg: replicationMessage{Stream: "c", Seq: 1, Key: "z", Op: "put", Value: 4.0, VectorClock: vectorClock{0, 3, 1}, Origin: 2},
+			want: http.StatusOK, wantResult: "applied", wantAck: true},
+		{name: "write that saw one we haven't", msg: replicationMessage{Stream: "c", Seq: 2, Key: "z", Op: "put", Value: 5.0, VectorClock: vectorClock{0, 4, 2}, Origin: 2},
+			want: http.StatusServiceUnavailable, wantCode: errCausalDependency.Code},
+		{name: "our own write", msg: replicationMessage{Stream: "a", Seq: 1, Key: "x", Op: "put", Value: 6.0, VectorClock: vectorClock{1, 0, 0}, Origin: 0},
+			want: http.StatusBadRequest, wantCode: errInvalidMessage.Code, wantAck: true},
+		{name: "unknown op", msg: replicationMessage{Stream: "c", Seq: 2, Key: "z", Op: "append", VectorClock: vectorClock{0, 3, 2}, Origin: 2},
+			want: http.StatusBadRequest, wantCode: errInvalidMessage.Code, wantAck: true},
+	}
+	for _, step := range steps {
+		body, err := json.Marshal(step.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := serve(s, "POST", "/internal/replicate", string(body))
+		var answer struct {
+			Code   string  `json:"code"`
+			Result string  `json:"result"`
+			Ack    *uint64 `json:"ack"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &answer)
+		if rec.Code != step.want || answer.Code != step.wantCode || answer.Result != step.wantResult {
+			t.Errorf("%s: answered %d %s, want %d %s %s", step.name, rec.Code, rec.Body, step.want, step.wantCode, step.wantResult)
+		}
+		if acked := answer.Ack != nil && *answer.Ack == step.msg.Seq; acked != step.wantAck {
+			t.Errorf("%s: acked %v, want %v: %s", step.name, acked, step.wantAck, rec.Body)
+		}
+	}
+
+	if store := storeOf(s); len(store) != 2 || store["y"] != 3.0 || store["z"] != 4.0 {
+		t.Errorf("store is %v, want y = 3 and z = 4", store)
+	}
+	if clock := clockOf(s); !clock.equal(vectorClock{0, 3, 1}) {
+		t.Errorf("vector clock is %v, want [0 3 1]", clock)
+	}
+}
+
+// Clients can't pass their writes off as replicated ones through /kvs to skip the causal check
+func TestClientReplicationMetadata(t *testing.T) {
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+
+	tests := []struct {
+		name     string
+		body     string
+		want     int
+		wantCode string
+	}{
+		{name: "replication metadata", body: `{"value": 1, "causal-metadata": {"ReqVector": [5], "IsReqFromClient": false}}`,
+			want: http.StatusBadRequest, wantCode: errReplicationMetadata.Code},
+		{name: "client metadata", body: `{"value": 1, "causal-metadata": {"ReqVector": [0], "IsReqFromClient": true}}`,
+			want: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		rec := serve(s, "PUT", "/kvs/x", tt.body)
+		var answer struct{ Code string }
+		json.Unmarshal(rec.Body.Bytes(), &answer)
+		if rec.Code != tt.want || answer.Code != tt.wantCode {
+			t.Errorf("%s: PUT = %d %s, want %d %s", tt.name, rec.Code, rec.Body, tt.want, tt.wantCode)
+		}
+	}
+}
+
+// The internal API is only served with the client API when it has no listener of its own
+func TestInternalHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	shared := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	if shared.InternalHandler() != nil {
+		t.Error("InternalHandler() isn't nil without an internal listener")
+	}
+	if rec := serve(shared, "POST", "/internal/replicate", "{"); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /internal/replicate with the client API = %d, want 400 for the bad JSON", rec.Code)
+	}
+
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+	cfg.InternalListener = listener
+	separate := newServer(t, cfg)
+	if rec := serve(separate, "POST", "/internal/replicate", "{"); rec.Code != http.StatusNotFound {
+		t.Errorf("POST /internal/replicate on the client API = %d, want 404", rec.Code)
+	}
+	internal := separate.InternalHandler()
+	if internal == nil {
+		t.Fatal("InternalHandler() is nil with an internal listener")
+	}
+	rec := serveHandler(internal, "POST", "/internal/replicate", "{")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /internal/replicate on the internal API = %d, want 400 for the bad JSON", rec.Code)
+	}
+	if rec := serveHandler(internal, "GET", "/kvs/x", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /kvs/x on the internal API = %d, want 404", rec.Code)
+	}
+}
+
+func TestInternalAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   string
+	}{
+		{name: "with the client API", change: func(cfg *Config) {}, want: "10.0.0.2:8090"},
+		{name: "own listen address", change: func(cfg *Config) { cfg.InternalListenAddress = ":8091" }, want: "10.0.0.2:8091"},
+		{name: "own listener", change: func(cfg *Config) { cfg.InternalListener = listener }, want: "10.0.0.2:" + port},
+		{name: "given", change: func(cfg *Config) {
+			cfg.InternalListenAddress = ":8091"
+			cfg.InternalAddresses = map[string]string{"10.0.0.2:8090": "internal-2:9000"}
+		}, want: "internal-2:9000"},
+	}
+	for _, tt := range tests {
+		cfg := testConfig(t, "10.0.0.1:8090", []string{"10.0.0.1:8090", "10.0.0.2:8090"})
+		tt.change(&cfg)
+		s := newServer(t, cfg)
+		if got := s.internalAddress("10.0.0.2:8090"); got != tt.want {
+			t.Errorf("%s: internalAddress() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
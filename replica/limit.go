@@ -0,0 +1,130 @@
+package replica
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// buckets of clients idle for this long are forgotten (they'd be full again anyway)
+var bucketIdleTimeout = 10 * time.Minute
+
+// bucket is the token bucket of a single client
+type bucket struct {
+	tokens float64
+	last   time.Time // when tokens was last topped up
+}
+
+// rateLimiter gives every client a token bucket, refilled at rate tokens a second up to burst
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Helper function that takes a token from the client's bucket
+// Returns whether there was one, and if not, how long until there will be
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > bucketIdleTimeout {
+		for id, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(l.buckets, id)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Helper function that returns who a request counts against: the token it sent if that is a known one, or else its
+// IP address. Tokens are told apart rather than names, since several tokens may share a name; they are hashed so the
+// buckets don't hold them
+func (s *Server) clientIdentity(req *http.Request) string {
+	if p, err := s.authenticate(req); err == nil && p != nil {
+		token, _ := bearerToken(req)
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Used to wrap the /kvs handlers so no client makes more requests than its rate limit allows, and no more than the
+// concurrency limit are handled at once. Requests over either limit are answered 429 with a Retry-After header.
+// Replicas talk to each other through the internal API, which is never limited
+// Once the replica is shutting down, or until it has joined the cluster, no requests are taken at all
+func (s *Server) admit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.isDraining() {
+			writeError(w, req, errShuttingDown, nil)
+			return
+		}
+		if s.isJoining() {
+			writeError(w, req, errNotReady.saying("Replica has not joined the cluster yet"), nil)
+			return
+		}
+
+		if s.limiter != nil {
+			if ok, wait := s.limiter.allow(s.clientIdentity(req), time.Now()); !ok {
+				tooManyRequests(w, req, wait, errRateLimited)
+				return
+			}
+		}
+
+		if s.inFlight != nil {
+			select {
+			case s.inFlight <- struct{}{}:
+				defer func() { <-s.inFlight }()
+			default:
+				tooManyRequests(w, req, time.Second, errOverloaded)
+				return
+			}
+		}
+		next(w, req)
+	}
+}
+
+// Helper function that answers 429, telling the client how many seconds to wait before trying again
+func tooManyRequests(w http.ResponseWriter, req *http.Request, wait time.Duration, err *apiError) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, req, err, nil)
+}
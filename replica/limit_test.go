@@ -0,0 +1,127 @@
+package replica
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A client can make up to burst requests at once, then one every 1/rate seconds, and is told how long to wait
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	steps := []struct {
+		at       time.Duration // since the first request
+		client   string
+		want     bool
+		wantWait time.Duration
+	}{
+		{at: 0, client: "a", want: true},
+		{at: 0, client: "a", want: true},
+		{at: 0, client: "a", want: true},
+		{at: 0, client: "a", want: false, wantWait: 500 * time.Millisecond},
+		{at: 0, client: "b", want: true},
+		{at: 250 * time.Millisecond, client: "a", want: false, wantWait: 250 * time.Millisecond},
+		{at: 500 * time.Millisecond, client: "a", want: true},
+		{at: 500 * time.Millisecond, client: "a", want: false, wantWait: 500 * time.Millisecond},
+		// however long it has been, the bucket holds no more than burst
+		{at: time.Minute, client: "a", want: true},
+		{at: time.Minute, client: "a", want: true},
+		{at: time.Minute, client: "a", want: true},
+		{at: time.Minute, client: "a", want: false, wantWait: 500 * time.Millisecond},
+	}
+	l := newRateLimiter(2, 3)
+	for i, step := range steps {
+		ok, wait := l.allow(step.client, start.Add(step.at))
+		if ok != step.want || wait != step.wantWait {
+			t.Errorf("step %d: allow(%s) at %v = %v, %v, want %v, %v", i, step.client, step.at, ok, wait, step.want, step.wantWait)
+		}
+	}
+}
+
+func TestNewRateLimiterBurst(t *testing.T) {
+	tests := []struct {
+		rate  float64
+		burst int
+		want  float64
+	}{
+		{rate: 10, burst: 20, want: 20},
+		{rate: 2.5, burst: 0, want: 3},
+		{rate: 0.5, burst: 0, want: 1},
+	}
+	for _, tt := range tests {
+		if got := newRateLimiter(tt.rate, tt.burst).burst; got != tt.want {
+			t.Errorf("newRateLimiter(%v, %d) has burst %v, want %v", tt.rate, tt.burst, got, tt.want)
+		}
+	}
+}
+
+// Clients with a known token are told apart by the token, even when two tokens share a name, and others by their IP
+func TestClientIdentity(t *testing.T) {
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+	cfg.ACLFile = writeACL(t, `{"tokens": {"laptop-token": {"name": "alice"}, "phone-token": {"name": "alice"}}}`)
+	cfg.ClusterSecret = []byte("secret")
+	s := newServer(t, cfg)
+
+	identity := func(remote string, token string) string {
+		req := httptest.NewRequest("GET", "/kvs/x", nil)
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return s.clientIdentity(req)
+	}
+
+	laptop := identity("10.0.0.1:1000", "laptop-token")
+	if phone := identity("10.0.0.1:1000", "phone-token"); laptop == phone {
+		t.Errorf("two tokens for alice share the bucket %s", laptop)
+	}
+	if other := identity("10.0.0.2:2000", "laptop-token"); other != laptop {
+		t.Errorf("the same token from another address counts against %s, want %s", other, laptop)
+	}
+	if strings.Contains(laptop, "laptop-token") {
+		t.Errorf("bucket %s holds the token itself", laptop)
+	}
+	for _, token := range []string{"", "unknown-token"} {
+		if got := identity("10.0.0.1:1000", token); got != "ip:10.0.0.1" {
+			t.Errorf("identity with token %q = %s, want ip:10.0.0.1", token, got)
+		}
+	}
+}
+
+// A client over its rate limit is answered 429 with a Retry-After in whole seconds, and other clients aren't held up
+func TestRateLimited(t *testing.T) {
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+	cfg.RateLimit = 0.5
+	cfg.RateBurst = 1
+	s := newServer(t, cfg)
+
+	steps := []struct {
+		remote    string
+		want      int
+		wantRetry string
+	}{
+		{remote: "10.0.0.1:1000", want: http.StatusCreated},
+		{remote: "10.0.0.1:1001", want: http.StatusTooManyRequests, wantRetry: "2"},
+		{remote: "10.0.0.2:1000", want: http.StatusOK},
+	}
+	for i, step := range steps {
+		req := httptest.NewRequest("PUT", "/kvs/x", strings.NewReader(`{"value": 1}`))
+		req.RemoteAddr = step.remote
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+
+		if rec.Code != step.want || rec.Header().Get("Retry-After") != step.wantRetry {
+			t.Errorf("step %d: PUT from %s = %d with Retry-After %q, want %d with %q: %s", i, step.remote, rec.Code,
+				rec.Header().Get("Retry-After"), step.want, step.wantRetry, rec.Body)
+		}
+		if step.want == http.StatusTooManyRequests {
+			var body struct{ Code string }
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != errRateLimited.Code {
+				t.Errorf("step %d: body %s, want code %s", i, rec.Body, errRateLimited.Code)
+			}
+		}
+	}
+}
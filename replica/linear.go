@@ -0,0 +1,191 @@
+package replica
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Keys under one of Config.LinearizablePrefixes are linearizable rather than causally consistent: a write to one goes
+// through the raft group's log (see raft.go) instead of being broadcast, and is applied by every replica in the log's
+// order, once a majority has it. A read is served once this replica has applied the log up to the leader's commit
+// index, as the leader confirmed it still is with a quorum (a read index), so it sees every write that finished
+// before it started. These keys are kept apart from the rest of the store: they have no place in the vector clock or
+// recovery, since the raft log is what keeps them. Every write applied to one is still put in the operation log, so
+// /changes and /watch see them, but replaying the operation log leaves them to the raft log
+
+// linearValue is the value of a linearizable key, and when it expires
+type linearValue struct {
+	Value     interface{}
+	ExpiresAt int64 // unix time in milliseconds, 0 if the key doesn't expire
+}
+
+// Helper function that checks if the key has outlived its TTL; every replica takes it as gone from then on, whether
+// or not it has pruned it yet
+func (v linearValue) expired() bool {
+	return v.ExpiresAt != 0 && time.Now().UnixMilli() >= v.ExpiresAt
+}
+
+// Helper function that checks if a key is under one of the linearizable prefixes
+func (s *Server) isLinearizable(key string) bool {
+	for _, prefix := range s.cfg.LinearizablePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function that applies a committed write to a linearizable key, returning its result ("created", "updated",
+// "deleted" or "not found"); must be called with s.mu held
+func (s *Server) applyLinear(index int64, cmd raftCommand) string {
+	current, ok := s.linear[cmd.Key]
+	exists := ok && !current.expired()
+
+	result := "created"
+	if cmd.Op == "delete" {
+		delete(s.linear, cmd.Key)
+		if !exists {
+			return "not found"
+		}
+		result = "deleted"
+	} else {
+		s.linear[cmd.Key] = linearValue{Value: cmd.Value, ExpiresAt: cmd.ExpiresAt}
+		if exists {
+			result = "updated"
+		}
+	}
+	s.logLinear(index, cmd)
+	return result
+}
+
+// Helper function that puts a write to a linearizable key in the operation log, unless a restart is only applying the
+// raft log again and the write is there already; must be called with s.mu held
+func (s *Server) logLinear(index int64, cmd raftCommand) {
+	if index <= s.linearLogged {
+		return
+	}
+	s.linearLogged = index
+
+	entry := logEntry{Key: cmd.Key, Op: cmd.Op, Value: cmd.Value, VectorClock: s.localVector.clone(), Origin: s.vectorIndex, RaftIndex: index}
+	if cmd.ExpiresAt != 0 {
+		expiresAt := cmd.ExpiresAt
+		entry.ExpiresAt = &expiresAt
+	}
+	// the raft log is what the key is restored from, so a write missing here is only missing from the streams, and
+	// appendLog has already said why
+	s.appendLog(entry)
+}
+
+// Helper function that drops every linearizable key whose TTL has run out; they already read as gone, so this only
+// frees them, and needs no agreement. Must be called with s.mu held
+func (s *Server) pruneLinear() {
+	for key, val := range s.linear {
+		if val.expired() {
+			delete(s.linear, key)
+		}
+	}
+}
+
+// Handler function that handles a client's request for a linearizable key, from handleKey
+// Causal metadata plays no part: it is handed back as it came, so the client's causal reads and writes carry on as
+// before. A group without a leader is waited on for a few election timeouts before answering 503 no_leader, and a
+// leader without a quorum answers 503 no_quorum at once; either way nothing takes longer than RequestTimeout
+func (s *Server) handleLinearKey(w http.ResponseWriter, req *http.Request, key string, reqVals message) error {
+	response := make(map[string]interface{})
+	if reqVals.CausalMetadata != nil {
+		response["causal-metadata"] = reqVals.CausalMetadata
+	}
+
+	var cmd raftCommand
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		if len(key) > 50 {
+			return errKeyTooLong
+		}
+		if reqVals.Value == nil {
+			return errValueMissing
+		}
+		if !validTTL(reqVals.TTL) {
+			return errInvalidTTL
+		}
+		cmd = raftCommand{Op: "put", Key: key, Value: reqVals.Value}
+		if reqVals.TTL != nil {
+			// replicas all need to agree on when the key expires, so the log has the deadline rather than the TTL
+			cmd.ExpiresAt = time.Now().Add(time.Duration(*reqVals.TTL * float64(time.Second))).UnixMilli()
+		}
+	case "DELETE":
+		cmd = raftCommand{Op: "delete", Key: key}
+	default:
+		return errMethodNotAllowed
+	}
+	if req.Method != "GET" && s.isDraining() {
+		return errShuttingDown
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), s.cfg.RequestTimeout)
+	defer cancel()
+	ctx, sp := s.tracer.start(ctx, "linearizable "+strings.ToLower(req.Method), spanInternal, "key", key)
+	defer sp.finish()
+	log := loggerFrom(req.Context()).with("key", key, "method", req.Method)
+
+	if req.Method == "GET" {
+		var index int64
+		err := s.untilLeader(ctx, func() (err error) {
+			index, err = s.readIndex(ctx)
+			return err
+		})
+		if err == nil {
+			if waitErr := s.raft.waitApplied(ctx, index); waitErr != nil {
+				err = errNoQuorum.saying("Replica could not catch up with the raft log in time").because(waitErr)
+			}
+		}
+		if err != nil {
+			sp.fail(err)
+			return err
+		}
+		sp.set("read_index", index)
+
+		s.mu.Lock()
+		val, ok := s.linear[key]
+		s.mu.Unlock()
+		if !ok || val.expired() {
+			writeError(w, req, errKeyNotFound, response)
+			return nil
+		}
+		response["result"] = "found"
+		response["value"] = val.Value
+		if val.ExpiresAt != 0 {
+			response["ttl"] = keyExpiry{ExpiresAt: val.ExpiresAt}.remaining().Seconds()
+		}
+		writeJSON(w, http.StatusOK, response)
+		return nil
+	}
+
+	var outcome raftOutcome
+	err := s.untilLeader(ctx, func() (err error) {
+		outcome, err = s.propose(ctx, cmd, false)
+		return err
+	})
+	if err != nil {
+		log.warn("linearizable write failed", "error", err)
+		sp.fail(err)
+		return err
+	}
+	sp.set("index", outcome.Index, "result", outcome.Result)
+	log.info("linearizable write committed", "index", outcome.Index, "result", outcome.Result)
+
+	status := http.StatusOK
+	switch outcome.Result {
+	case "not found":
+		writeError(w, req, errKeyNotFound, response)
+		return nil
+	case "created":
+		status = http.StatusCreated
+	}
+	response["result"] = outcome.Result
+	writeJSON(w, status, response)
+	return nil
+}
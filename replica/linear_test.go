@@ -0,0 +1,270 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// raftNetwork lets a test cut replicas of a raft group off from each other: the transport it makes for a replica fails
+// every raft request to or from an isolated replica, and every append to a lagging one
+type raftNetwork struct {
+	mu       sync.Mutex
+	isolated string
+	lagging  string
+}
+
+type raftNetworkTransport struct {
+	network *raftNetwork
+	from    string
+}
+
+// Helper function that returns the transport a replica at the address sends its requests to other replicas through
+func (n *raftNetwork) transport(from string) http.RoundTripper {
+	return &raftNetworkTransport{network: n, from: from}
+}
+
+// Helper function that sets which replica is isolated and which is lagging ("" for none)
+func (n *raftNetwork) set(isolated string, lagging string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated, n.lagging = isolated, lagging
+}
+
+func (t *raftNetworkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.network.mu.Lock()
+	isolated, lagging := t.network.isolated, t.network.lagging
+	t.network.mu.Unlock()
+
+	raft := strings.HasPrefix(req.URL.Path, "/internal/raft/")
+	cut := raft && isolated != "" && (t.from == isolated || req.URL.Host == isolated)
+	behind := req.URL.Path == "/internal/raft/append" && req.URL.Host == lagging
+	if cut || behind {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &cutError{req.URL.Host}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// cutError is what a request the network drops fails with
+type cutError struct{ host string }
+
+func (e *cutError) Error() string { return "network to " + e.host + " is cut" }
+
+// Helper function that starts a raft group of three replicas whose keys under "lin-" are linearizable, talking to
+// each other through the network, and returns them with the one the others have as their leader
+func startLinearCluster(t *testing.T, network *raftNetwork, electionTimeout time.Duration) ([]*Server, *Server) {
+	t.Helper()
+	servers := startCluster(t, 3, func(i int, cfg *Config) {
+		cfg.Consensus = "raft"
+		cfg.LinearizablePrefixes = []string{"lin-"}
+		cfg.ElectionTimeout = electionTimeout
+		cfg.Transport = network.transport(cfg.SocketAddress)
+	})
+	// the network heals before the replicas stop, so they can hand off as they would
+	t.Cleanup(func() { network.set("", "") })
+
+	var leader *Server
+	eventually(t, 10*time.Second, "the group to agree on a leader", func() bool {
+		addr := servers[0].raftLeader()
+		for _, s := range servers {
+			if s.raftLeader() != addr {
+				return false
+			}
+			if s.sAddress == addr {
+				leader = s
+			}
+		}
+		return leader != nil
+	})
+	return servers, leader
+}
+
+// Helper function that has a replica handle a request for a key, returning the status and the decoded JSON body
+// Safe to call from another goroutine than the test's
+func serveKey(t *testing.T, ctx context.Context, s *Server, method string, key string, body string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(method, "/kvs/"+key, strings.NewReader(body)).WithContext(ctx))
+	answer := make(map[string]interface{})
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		t.Errorf("%s %s answered %d with %q: %v", method, key, rec.Code, rec.Body, err)
+	}
+	return rec.Code, answer
+}
+
+// Every replica answers for a linearizable key as the group's log has it: a write is seen by a read on any replica as
+// soon as it is answered, and a key is gone everywhere once the deadline its TTL gave it has passed
+func TestLinearKey(t *testing.T) {
+	servers, _ := startLinearCluster(t, &raftNetwork{}, 150*time.Millisecond)
+	ctx := context.Background()
+
+	steps := []struct {
+		on        int // the replica the request is sent to
+		method    string
+		key       string
+		body      string
+		want      int
+		wantCode  string
+		wantValue interface{}
+	}{
+		{on: 0, method: "GET", key: "lin-a", want: http.StatusNotFound, wantCode: errKeyNotFound.Code},
+		{on: 1, method: "PUT", key: "lin-a", body: `{"value": 1}`, want: http.StatusCreated},
+		{on: 2, method: "GET", key: "lin-a", want: http.StatusOK, wantValue: 1.0},
+		{on: 0, method: "PUT", key: "lin-a", body: `{"value": 2}`, want: http.StatusOK},
+		{on: 1, method: "GET", key: "lin-a", want: http.StatusOK, wantValue: 2.0},
+		{on: 2, method: "DELETE", key: "lin-a", want: http.StatusOK},
+		{on: 0, method: "GET", key: "lin-a", want: http.StatusNotFound, wantCode: errKeyNotFound.Code},
+		{on: 1, method: "DELETE", key: "lin-a", want: http.StatusNotFound, wantCode: errKeyNotFound.Code},
+		{on: 0, method: "PUT", key: "lin-" + strings.Repeat("k", 50), body: `{"value": 1}`, want: http.StatusBadRequest,
+			wantCode: errKeyTooLong.Code},
+		{on: 0, method: "PUT", key: "lin-b", body: `{}`, want: http.StatusBadRequest, wantCode: errValueMissing.Code},
+		{on: 0, method: "PUT", key: "lin-b", body: `{"value": 1, "ttl": -1}`, want: http.StatusBadRequest,
+			wantCode: errInvalidTTL.Code},
+	}
+	for i, step := range steps {
+		status, answer := serveKey(t, ctx, servers[step.on], step.method, step.key, step.body)
+		if status != step.want || (step.wantCode != "" && answer["code"] != step.wantCode) {
+			t.Fatalf("step %d: %s %s on replica %d = %d %v, want %d %s", i, step.method, step.key, step.on, status, answer,
+				step.want, step.wantCode)
+		}
+		if step.wantValue != nil && answer["value"] != step.wantValue {
+			t.Fatalf("step %d: GET %s on replica %d = %v, want %v", i, step.key, step.on, answer["value"], step.wantValue)
+		}
+	}
+
+	// the log has when the key expires rather than its TTL, so every replica has it expire at the same time
+	if status, answer := serveKey(t, ctx, servers[1], "PUT", "lin-ttl", `{"value": 1, "ttl": 0.3}`); status != http.StatusCreated {
+		t.Fatalf("PUT lin-ttl = %d %v", status, answer)
+	}
+	var deadline int64
+	for _, s := range servers {
+		status, answer := serveKey(t, ctx, s, "GET", "lin-ttl", "")
+		ttl, _ := answer["ttl"].(float64)
+		if status != http.StatusOK || ttl <= 0 || ttl > 0.3 {
+			t.Errorf("GET lin-ttl on %s = %d with ttl %v, want 200 with at most 0.3", s.sAddress, status, answer["ttl"])
+		}
+		s.mu.Lock()
+		expiresAt := s.linear["lin-ttl"].ExpiresAt
+		s.mu.Unlock()
+		if deadline == 0 {
+			deadline = expiresAt
+		} else if expiresAt != deadline {
+			t.Errorf("%s has lin-ttl expire at %d, want %d like the others", s.sAddress, expiresAt, deadline)
+		}
+	}
+	time.Sleep(time.Until(time.UnixMilli(deadline)))
+	for _, s := range servers {
+		if status, answer := serveKey(t, ctx, s, "GET", "lin-ttl", ""); status != http.StatusNotFound {
+			t.Errorf("GET lin-ttl on %s once it expired = %d %v, want 404", s.sAddress, status, answer)
+		}
+	}
+}
+
+// A replica the leader's appends haven't reached waits for them before answering a read, rather than answer with what
+// it has, and gives up with no_quorum if they don't come in time
+func TestLinearReadIndex(t *testing.T) {
+	network := &raftNetwork{}
+	// long enough that the lagging replica doesn't stand for election while the test runs
+	servers, leader := startLinearCluster(t, network, time.Second)
+	var follower *Server
+	for _, s := range servers {
+		if s != leader {
+			follower = s
+		}
+	}
+	ctx := context.Background()
+
+	if status, answer := serveKey(t, ctx, leader, "PUT", "lin-x", `{"value": 1}`); status != http.StatusCreated {
+		t.Fatalf("PUT lin-x = %d %v", status, answer)
+	}
+	eventually(t, 5*time.Second, "the follower to apply the first write", func() bool {
+		follower.mu.Lock()
+		defer follower.mu.Unlock()
+		return follower.linear["lin-x"].Value == 1.0
+	})
+
+	network.set("", follower.sAddress)
+	if status, answer := serveKey(t, ctx, leader, "PUT", "lin-x", `{"value": 2}`); status != http.StatusOK {
+		t.Fatalf("PUT lin-x without the follower = %d %v", status, answer)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	status, answer := serveKey(t, timeout, follower, "GET", "lin-x", "")
+	cancel()
+	if status != http.StatusServiceUnavailable || answer["code"] != errNoQuorum.Code {
+		t.Errorf("GET lin-x on the lagging follower = %d %v, want 503 %s", status, answer, errNoQuorum.Code)
+	}
+
+	type result struct {
+		status int
+		answer map[string]interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		status, answer := serveKey(t, ctx, follower, "GET", "lin-x", "")
+		done <- result{status, answer}
+	}()
+	select {
+	case res := <-done:
+		t.Fatalf("GET lin-x on the lagging follower answered %d %v before it caught up", res.status, res.answer)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	network.set("", "")
+	select {
+	case res := <-done:
+		if res.status != http.StatusOK || res.answer["value"] != 2.0 {
+			t.Errorf("GET lin-x once the follower caught up = %d %v, want 200 with 2", res.status, res.answer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GET lin-x on the follower didn't answer once it caught up")
+	}
+}
+
+// A replica cut off from the rest of the group answers 503 rather than anything it can't be sure of: no_quorum if it
+// was the leader, no_leader if it wasn't
+func TestLinearUnavailable(t *testing.T) {
+	tests := []struct {
+		name     string
+		leader   bool // whether the replica cut off is the leader
+		wantCode string
+	}{
+		{name: "leader", leader: true, wantCode: errNoQuorum.Code},
+		{name: "follower", leader: false, wantCode: errNoLeader.Code},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := &raftNetwork{}
+			servers, leader := startLinearCluster(t, network, 150*time.Millisecond)
+			if status, answer := serveKey(t, context.Background(), leader, "PUT", "lin-x", `{"value": 1}`); status != http.StatusCreated {
+				t.Fatalf("PUT lin-x = %d %v", status, answer)
+			}
+			cut := leader
+			if !tt.leader {
+				for _, s := range servers {
+					if s != leader {
+						cut = s
+					}
+				}
+			}
+			network.set(cut.sAddress, "")
+			// long enough for the leader to notice it hasn't heard from a quorum
+			time.Sleep(2 * 150 * time.Millisecond)
+
+			for _, req := range []struct{ method, body string }{{"GET", ""}, {"PUT", `{"value": 2}`}, {"DELETE", ""}} {
+				status, answer := serveKey(t, context.Background(), cut, req.method, "lin-x", req.body)
+				if status != http.StatusServiceUnavailable || answer["code"] != tt.wantCode {
+					t.Errorf("%s lin-x = %d %v, want 503 %s", req.method, status, answer, tt.wantCode)
+				}
+			}
+		})
+	}
+}
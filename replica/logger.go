@@ -0,0 +1,223 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel is how important a log line is; lines below the logger's level are dropped
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+	// above every level a logger can be set to, so its lines are never dropped; for changes to how we log itself
+	levelAudit
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	if l == levelAudit {
+		return "audit"
+	}
+	if l < levelDebug || l > levelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// Helper function that parses a level from its name, e.g. "debug"
+func parseLevel(name string) (logLevel, error) {
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+}
+
+// logSink is where a logger and every logger derived from it write, and the level they share
+type logSink struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level int32 // a logLevel, read and changed atomically so it can be changed while we run
+}
+
+// logger writes one JSON object per line: the time, level and message, then its fields and the line's own
+type logger struct {
+	sink   *logSink
+	fields []interface{} // name, value pairs added to every line
+}
+
+func newLogger(out io.Writer, level logLevel) *logger {
+	return &logger{sink: &logSink{out: out, level: int32(level)}}
+}
+
+// used when a request somehow reaches a handler without going through withRequestID
+var fallbackLogger = newLogger(os.Stderr, levelInfo)
+
+// Helper function that returns a logger adding the given name, value pairs to every line, on top of ours
+func (l *logger) with(fields ...interface{}) *logger {
+	combined := make([]interface{}, 0, len(l.fields)+len(fields))
+	combined = append(combined, l.fields...)
+	combined = append(combined, fields...)
+	return &logger{sink: l.sink, fields: combined}
+}
+
+func (l *logger) level() logLevel {
+	return logLevel(atomic.LoadInt32(&l.sink.level))
+}
+
+// Helper function that changes the level of this logger and every logger sharing its sink
+func (l *logger) setLevel(level logLevel) {
+	atomic.StoreInt32(&l.sink.level, int32(level))
+}
+
+func (l *logger) debug(msg string, fields ...interface{}) { l.log(levelDebug, msg, fields) }
+func (l *logger) info(msg string, fields ...interface{})  { l.log(levelInfo, msg, fields) }
+func (l *logger) warn(msg string, fields ...interface{})  { l.log(levelWarn, msg, fields) }
+func (l *logger) error(msg string, fields ...interface{}) { l.log(levelError, msg, fields) }
+func (l *logger) audit(msg string, fields ...interface{}) { l.log(levelAudit, msg, fields) }
+
+// Helper function that writes a single line, if its level is at least the logger's
+func (l *logger) log(level logLevel, msg string, fields []interface{}) {
+	if level < l.level() {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeLogField(&buf, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeLogField(&buf, "level", level.String())
+	buf.WriteByte(',')
+	writeLogField(&buf, "msg", msg)
+	for _, pairs := range [][]interface{}{l.fields, fields} {
+		for i := 0; i < len(pairs); i += 2 {
+			name := fmt.Sprint(pairs[i])
+			var val interface{} = "(missing)"
+			if i+1 < len(pairs) {
+				val = pairs[i+1]
+			}
+			buf.WriteByte(',')
+			writeLogField(&buf, name, val)
+		}
+	}
+	buf.WriteString("}\n")
+
+	l.sink.mu.Lock()
+	l.sink.out.Write(buf.Bytes())
+	l.sink.mu.Unlock()
+}
+
+// Helper function that writes "name":value; errors are written as their message, and anything JSON can't encode
+// as its fmt representation
+func writeLogField(buf *bytes.Buffer, name string, val interface{}) {
+	encodedName, _ := json.Marshal(name)
+	buf.Write(encodedName)
+	buf.WriteByte(':')
+
+	if err, ok := val.(error); ok {
+		val = err.Error()
+	}
+	encoded, err := json.Marshal(val)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(val))
+	}
+	buf.Write(encoded)
+}
+
+// requestIDHeader carries the id of a request from a client through every replica it reaches
+const requestIDHeader = "X-Request-ID"
+
+// request ids clients pick are only kept if they look like one, so they can't inject anything into our logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+type requestContextKey struct{}
+
+// requestContext is what withRequestID hands the handlers of a request
+type requestContext struct {
+	id  string
+	log *logger
+}
+
+// Helper function that makes a random request id
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Used to wrap the whole API so every request has an id: the one it came with in X-Request-ID (from a client, or from
+// the replica that first got the write), or a new one. The id is sent back in X-Request-ID, and every line the
+// request's handlers log carries it
+func (s *Server) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		rc := &requestContext{id: id, log: s.log.with("request_id", id)}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestContextKey{}, rc)))
+	})
+}
+
+// Helper function that returns the id of the request a context belongs to, or "" if it has none
+func requestIDFrom(ctx context.Context) string {
+	if rc, ok := ctx.Value(requestContextKey{}).(*requestContext); ok {
+		return rc.id
+	}
+	return ""
+}
+
+// Helper function that returns the logger of the request a context belongs to
+func loggerFrom(ctx context.Context) *logger {
+	if rc, ok := ctx.Value(requestContextKey{}).(*requestContext); ok {
+		return rc.log
+	}
+	return fallbackLogger
+}
+
+// Handler function that reports (GET) or changes (PUT {"level": "debug"}) the level we log at, while we run
+// Only replicas and operators with the cluster secret may change it (see router), since raising it hides the warnings
+// access control and replication log; every change is logged at the audit level, which no level hides
+func (s *Server) handleLogLevel(w http.ResponseWriter, req *http.Request) error {
+	if req.Method == "PUT" {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return errInvalidJSON.because(err)
+		}
+		level, err := parseLevel(body.Level)
+		if err != nil {
+			return errInvalidRequest.saying(err.Error())
+		}
+		previous := s.log.level()
+		s.log.setLevel(level)
+		loggerFrom(req.Context()).audit("log level changed", "level", level.String(), "previous", previous.String(), "remote", req.RemoteAddr)
+	} else if req.Method != "GET" {
+		return errMethodNotAllowed
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"level": s.log.level().String()})
+	return nil
+}
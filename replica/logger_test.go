@@ -0,0 +1,222 @@
+package replica
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper function that reads the lines a logger wrote, each decoded from its JSON object
+func logLines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("log line %q isn't a JSON object: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+// Lines below the level are dropped, except audit lines, and each line carries the logger's fields and its own
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	log := newLogger(&out, levelWarn).with("replica", "10.0.0.1:8090")
+
+	log.debug("dropped")
+	log.info("dropped")
+	log.warn("kept", "error", errors.New("connection refused"), "attempts", 3)
+	log.error("kept", "peer")
+	log.audit("kept", "values", func() {})
+
+	lines := logLines(t, &out)
+	want := []map[string]interface{}{
+		{"level": "warn", "replica": "10.0.0.1:8090", "error": "connection refused", "attempts": 3.0},
+		{"level": "error", "replica": "10.0.0.1:8090", "peer": "(missing)"},
+		{"level": "audit", "replica": "10.0.0.1:8090"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d lines, want %d: %s", len(lines), len(want), out.String())
+	}
+	for i, fields := range want {
+		if lines[i]["msg"] != "kept" || lines[i]["time"] == nil {
+			t.Errorf("line %d is %v, want a time and the message", i, lines[i])
+		}
+		for name, val := range fields {
+			if lines[i][name] != val {
+				t.Errorf("line %d has %s = %v, want %v", i, name, lines[i][name], val)
+			}
+		}
+	}
+	if _, ok := lines[2]["values"].(string); !ok {
+		t.Errorf("a value JSON can't encode was logged as %v, want its fmt representation", lines[2]["values"])
+	}
+
+	// every logger derived from the same one shares its level
+	out.Reset()
+	log.setLevel(levelDebug)
+	log.with("key", "x").debug("kept")
+	if lines := logLines(t, &out); len(lines) != 1 || lines[0]["key"] != "x" {
+		t.Errorf("after lowering the level logged %v, want the debug line", lines)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    logLevel
+		wantErr bool
+	}{
+		{name: "debug", want: levelDebug},
+		{name: "info", want: levelInfo},
+		{name: "warn", want: levelWarn},
+		{name: "error", want: levelError},
+		{name: "audit", want: levelInfo, wantErr: true},
+		{name: "INFO", want: levelInfo, wantErr: true},
+		{name: "", want: levelInfo, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLevel(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseLevel(%q) = %v, %v, want %v with error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// A request keeps the id it came with if it looks like one, and gets a new one otherwise; either way the id is sent
+// back and carried by every line logged handling it
+func TestWithRequestID(t *testing.T) {
+	var out bytes.Buffer
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+	cfg.LogOutput = &out
+	s := newServer(t, cfg)
+	var seen string
+	h := s.withRequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = requestIDFrom(req.Context())
+		loggerFrom(req.Context()).warn("handled")
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "given", header: "client-1:req.42", keep: true},
+		{name: "none"},
+		{name: "not an id", header: `x","level":"audit`},
+		{name: "too long", header: strings.Repeat("a", 65)},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		req := httptest.NewRequest("GET", "/kvs/x", nil)
+		if tt.header != "" {
+			req.Header.Set(requestIDHeader, tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		id := rec.Header().Get(requestIDHeader)
+		if tt.keep && id != tt.header || !tt.keep && (id == tt.header || !validRequestID.MatchString(id)) {
+			t.Errorf("%s: sent back request id %q for %q", tt.name, id, tt.header)
+		}
+		if seen != id {
+			t.Errorf("%s: handler saw request id %q, want %q", tt.name, seen, id)
+		}
+		if lines := logLines(t, &out); len(lines) != 1 || lines[0]["request_id"] != id || lines[0]["level"] != "warn" {
+			t.Errorf("%s: logged %v, want one line with request id %q", tt.name, lines, id)
+		}
+	}
+}
+
+// The id of the client request behind a write goes along with it, so the replicas it reaches log it under that id
+func TestRequestIDReplicated(t *testing.T) {
+	servers := startCluster(t, 2, nil)
+	req, err := http.NewRequest("PUT", "http://"+servers[0].sAddress+"/kvs/x", strings.NewReader(`{"value": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(requestIDHeader, "client-write-1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT = %d, want 201", res.StatusCode)
+	}
+
+	all := func(logEntry) bool { return true }
+	for i, s := range servers {
+		eventually(t, 5*time.Second, "the write to be logged", func() bool { return len(s.readLog(1, all, nil)) > 0 })
+		if entries := s.readLog(1, all, nil); entries[0].RequestID != "client-write-1" {
+			t.Errorf("replica %d logged the write under request id %q, want client-write-1", i, entries[0].RequestID)
+		}
+	}
+}
+
+// The level can be read by anyone but, with a cluster secret, only changed by a request signed with it; every change
+// is logged whatever the level
+func TestHandleLogLevel(t *testing.T) {
+	var out bytes.Buffer
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+	cfg.LogOutput = &out
+	cfg.ClusterSecret = []byte("secret")
+	s := newServer(t, cfg)
+
+	nonce := 0
+	signedPut := func(body string) *http.Request {
+		req := httptest.NewRequest("PUT", "/log-level", strings.NewReader(body))
+		nonce++
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(nonceHeader, strconv.Itoa(nonce))
+		req.Header.Set(signatureHeader, sign(cfg.ClusterSecret, "PUT", "/log-level", timestamp, strconv.Itoa(nonce), []byte(body)))
+		return req
+	}
+	steps := []struct {
+		name      string
+		req       *http.Request
+		want      int
+		wantLevel string
+	}{
+		{name: "read", req: httptest.NewRequest("GET", "/log-level", nil), want: http.StatusOK, wantLevel: "info"},
+		{name: "unsigned change", req: httptest.NewRequest("PUT", "/log-level", strings.NewReader(`{"level": "debug"}`)),
+			want: http.StatusUnauthorized, wantLevel: "info"},
+		{name: "signed change", req: signedPut(`{"level": "error"}`), want: http.StatusOK, wantLevel: "error"},
+		{name: "unknown level", req: signedPut(`{"level": "loud"}`), want: http.StatusBadRequest, wantLevel: "error"},
+		{name: "bad JSON", req: signedPut(`{"level":`), want: http.StatusBadRequest, wantLevel: "error"},
+		{name: "other method", req: httptest.NewRequest("DELETE", "/log-level", nil), want: http.StatusMethodNotAllowed,
+			wantLevel: "error"},
+	}
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, step.req)
+		if rec.Code != step.want {
+			t.Errorf("%s: answered %d %s, want %d", step.name, rec.Code, rec.Body, step.want)
+		}
+		if got := s.log.level().String(); got != step.wantLevel {
+			t.Errorf("%s: level is %s, want %s", step.name, got, step.wantLevel)
+		}
+	}
+
+	var audited []map[string]interface{}
+	for _, line := range logLines(t, &out) {
+		if line["msg"] == "log level changed" {
+			audited = append(audited, line)
+		}
+	}
+	if len(audited) != 1 || audited[0]["previous"] != "info" {
+		t.Errorf("audit lines are %v, want the one change from info", audited)
+	}
+}
@@ -0,0 +1,576 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// membership is every replica the cluster has ever had, in the order they joined it, and the ones that left since
+// A replica's position in Members is its index in the vector clock, so Members only ever grows: a replica that leaves
+// keeps its slot (the writes it made are still in everyone's clock) and is added to Retired instead
+type membership struct {
+	Members []string `json:"members"`
+	Retired []string `json:"retired"`
+}
+
+// membershipUpdate is what a replica sends the others through /internal/members when the membership changes
+type membershipUpdate struct {
+	membership
+	Joining string `json:"joining,omitempty"` // the replica being added, which takes no writes until it is bootstrapped
+}
+
+// bootstrapMessage is everything a replica being added needs to start taking requests, see handleBootstrap
+type bootstrapMessage struct {
+	From        string                 `json:"from"`
+	Membership  membership             `json:"membership"`
+	View        []string               `json:"view"`
+	VectorClock vectorClock            `json:"vector-clock"`
+	ViewEpoch   uint64                 `json:"view-epoch"`
+	KVS         map[string]interface{} `json:"KVS"`
+	TTL         map[string]keyExpiry   `json:"TTL"`
+}
+
+// the file the membership is kept in, in the data dir, once it differs from the view we were started with
+const membershipFile = "members.json"
+
+// Helper function that reads the membership we saved before a restart, or returns nil if we never saved one
+func loadMembership(dataDir string) (*membership, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, membershipFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m membership
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", membershipFile, err)
+	}
+	return &m, nil
+}
+
+// Helper function that writes our membership to the data dir, so a restart doesn't go back to the view we were
+// started with; must be called with s.mu held
+func (s *Server) saveMembership() {
+	if s.dataDir == "" {
+		return
+	}
+	// a membership always marshals
+	data, _ := json.Marshal(s.currentMembership())
+
+	// synced through a temporary file, so a crash leaves either the old membership or the new one behind
+	err := os.MkdirAll(s.dataDir, 0755)
+	if err == nil {
+		err = writeFileSynced(filepath.Join(s.dataDir, membershipFile), append(data, '\n'))
+	}
+	if err != nil {
+		s.log.error("problem saving membership", "error", err)
+	}
+}
+
+// Helper function that returns a copy of our membership; must be called with s.mu held
+func (s *Server) currentMembership() membership {
+	m := membership{Members: append([]string(nil), s.members...), Retired: []string{}}
+	for _, addr := range s.members {
+		if s.retired[addr] {
+			m.Retired = append(m.Retired, addr)
+		}
+	}
+	return m
+}
+
+// Helper function that folds another replica's membership into ours: members we didn't know about yet are added to
+// the vector clock and the view, and retired ones are taken out of the view along with anything queued for them
+// Both memberships must list the members they share in the same order, or errMembershipConflict is returned
+// Must be called with s.mu held
+func (s *Server) mergeMembership(m membership) (changed bool, apiErr *apiError) {
+	shared := len(s.members)
+	if len(m.Members) < shared {
+		shared = len(m.Members)
+	}
+	for i := 0; i < shared; i++ {
+		if s.members[i] != m.Members[i] {
+			return false, errMembershipConflict
+		}
+	}
+
+	for _, addr := range m.Members[shared:] {
+		s.members = append(s.members, addr)
+		if !s.retired[addr] && containsVal(addr, s.replicaArray) < 0 {
+			s.replicaArray = append(s.replicaArray, addr)
+			s.viewArray = append(s.viewArray, addr)
+		}
+		s.log.info("replica joined the cluster", "peer", addr, "index", len(s.members)-1)
+		changed = true
+	}
+	s.localVector = s.localVector.copyOf(len(s.members))
+
+	for _, addr := range m.Retired {
+		if s.retired[addr] || containsVal(addr, s.members) < 0 {
+			continue
+		}
+		s.retired[addr] = true
+		if i := containsVal(addr, s.replicaArray); i >= 0 {
+			s.replicaArray = removeVal(i, s.replicaArray)
+		}
+		if i := containsVal(addr, s.viewArray); i >= 0 {
+			s.viewArray = removeVal(i, s.viewArray)
+		}
+		// the replica handed off everything it had before it left, so nothing we still have queued for it matters
+		if queue, ok := s.peers[addr]; ok {
+			for _, dropped := range queue.drain() {
+				dropped.rep.report(false)
+			}
+			delete(s.peers, addr)
+		}
+		s.log.info("replica left the cluster", "peer", addr)
+		changed = true
+	}
+
+	if changed {
+		// both kinds of change change the view too; with raft, the epoch only moves when the group records it
+		if s.raft == nil {
+			s.nextViewEpoch()
+		}
+		s.saveMembership()
+	}
+	return changed, nil
+}
+
+// Helper function that checks if we are still waiting to be bootstrapped by the replica adding us to the cluster
+func (s *Server) isJoining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.joining
+}
+
+// Decommissioned is closed once the replica has left the cluster through POST /admin/leave and shut down, at which
+// point the process running it can exit
+func (s *Server) Decommissioned() <-chan struct{} {
+	return s.decommissioned
+}
+
+// Helper function that decodes the socket address an admin request is about
+func decodeSocketAddress(req *http.Request) (string, error) {
+	var body map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return "", errInvalidJSON.because(err)
+	}
+	addr := body["socket-address"]
+	if addr == "" {
+		return "", errSocketAddressMissing
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", errInvalidRequest.saying("socket-address must be host:port")
+	}
+	return addr, nil
+}
+
+// Helper function that returns the replica every join goes through, so only one replica ever hands out slots of the
+// vector clock: the earliest member still in our view. Must be called with s.mu held
+func (s *Server) joinCoordinator() string {
+	for _, addr := range s.members {
+		if !s.retired[addr] && containsVal(addr, s.replicaArray) >= 0 {
+			return addr
+		}
+	}
+	return s.sAddress
+}
+
+// Handler function that adds a new replica to the cluster
+// The replica gets the next slot of the vector clock. Joins all go through one replica (see joinCoordinator), which
+// makes them one at a time, so two new replicas never get the same slot; a member that isn't it passes the request on.
+// Every other replica in our view is told first, and hands off the writes it has queued before it answers, so the copy
+// of our store the new replica is then bootstrapped with holds every write that isn't also queued for it. Replicas that
+// don't take the change are asked again until RequestTimeout, so it doesn't stop partway through the view. The new
+// replica has to be running with JOIN set; asking again for a replica that was added but never bootstrapped (or that
+// not every replica was told about) finishes the job
+func (s *Server) handleJoin(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errMethodNotAllowed
+	}
+	addr, err := decodeSocketAddress(req)
+	if err != nil {
+		return err
+	}
+	log := loggerFrom(req.Context()).with("peer", addr)
+
+	s.mu.Lock()
+	if s.joining {
+		s.mu.Unlock()
+		return errNotReady
+	}
+	// a request another member passed on is ours to handle, even if our views disagree on who should
+	if coordinator := s.joinCoordinator(); coordinator != s.sAddress && req.URL.Query().Get("forwarded") == "" {
+		s.mu.Unlock()
+		return s.forwardAdmin(w, req, coordinator, "/admin/join?forwarded=true", addr)
+	}
+	s.mu.Unlock()
+
+	s.joinMu.Lock()
+	defer s.joinMu.Unlock()
+
+	s.mu.Lock()
+	if s.retired[addr] {
+		s.mu.Unlock()
+		return errReplicaRetired
+	}
+	added := containsVal(addr, s.members) < 0
+	update := membershipUpdate{membership: s.currentMembership(), Joining: addr}
+	if added {
+		update.Members = append(update.Members, addr)
+	}
+	var peers []string
+	for _, replicaIP := range s.replicaArray {
+		if replicaIP != s.sAddress && replicaIP != addr {
+			peers = append(peers, replicaIP)
+		}
+	}
+	s.mu.Unlock()
+
+	ctx, sp := s.tracer.start(req.Context(), "join", spanInternal, "peer", addr, "index", containsVal(addr, update.Members))
+	defer sp.finish()
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	if err := s.announceMembership(ctx, peers, update); err != nil {
+		log.warn("could not tell every replica about new replica", "error", err)
+		sp.fail(err)
+		if errors.Is(err, errMembershipConflict) {
+			return errMembershipConflict.because(err)
+		}
+		return errPeerUnavailable.saying("Not every replica could be told about the new replica; try again").because(err)
+	}
+
+	s.mu.Lock()
+	if _, apiErr := s.mergeMembership(update.membership); apiErr != nil {
+		s.mu.Unlock()
+		sp.fail(apiErr)
+		return apiErr
+	}
+	// marshalling while we still hold the lock, since the maps keep changing once we let go
+	snapshot, err := json.Marshal(bootstrapMessage{
+		From:        s.sAddress,
+		Membership:  s.currentMembership(),
+		View:        s.replicaArray,
+		VectorClock: s.localVector,
+		ViewEpoch:   s.viewEpoch,
+		KVS:         s.store,
+		TTL:         s.expiries,
+	})
+	index := s.indexOf(addr)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	status, _, err := s.postPeer(ctx, s.internalAddress(addr), "/internal/bootstrap", snapshot)
+	if err == nil && status != http.StatusOK && status != http.StatusConflict {
+		err = fmt.Errorf("/internal/bootstrap answered %d", status)
+	}
+	if err != nil {
+		log.warn("could not bootstrap new replica", "error", err)
+		sp.fail(err)
+		return errPeerUnavailable.saying("New replica could not be bootstrapped; try again").because(err)
+	}
+
+	result := "joined"
+	if status == http.StatusConflict {
+		// it was bootstrapped by an earlier request, and kept what it got then
+		result = "already a member"
+	}
+
+	// with raft, the group has to agree on it too (which an earlier request may not have gotten to)
+	if s.raft != nil {
+		if err := s.joinRaft(ctx, addr); err != nil {
+			log.warn("could not add new replica to the raft group", "error", err)
+			sp.fail(err)
+			return err
+		}
+	}
+	log.info("replica added to the cluster", "index", index, "result", result)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": result, "index": index, "members": update.Members})
+	return nil
+}
+
+// Handler function that decommissions a replica: it stops taking writes, hands off every write it has queued to the
+// other replicas, tells them it is leaving for good (they take it out of their views, but it keeps its slot of the
+// vector clock), answers, and then shuts down. A request for another replica is passed on to it
+// If the writes can't be handed off, the replica goes back to taking requests and nothing changes
+func (s *Server) handleLeave(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errMethodNotAllowed
+	}
+	addr, err := decodeSocketAddress(req)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	member := containsVal(addr, s.members) >= 0
+	retired := s.retired[addr]
+	s.mu.Unlock()
+	if !member {
+		return errReplicaNotMember
+	}
+	if retired {
+		return errReplicaRetired
+	}
+	if addr != s.sAddress {
+		return s.forwardAdmin(w, req, addr, "/admin/leave", addr)
+	}
+
+	s.mu.Lock()
+	if s.draining || s.joining {
+		s.mu.Unlock()
+		return errShuttingDown
+	}
+	var peers []string
+	for _, replicaIP := range s.replicaArray {
+		if replicaIP != s.sAddress {
+			peers = append(peers, replicaIP)
+		}
+	}
+	if len(peers) == 0 {
+		s.mu.Unlock()
+		return errPeerUnavailable.saying("No other replica to hand off to")
+	}
+	update := membershipUpdate{membership: s.currentMembership()}
+	update.Retired = append(update.Retired, s.sAddress)
+	// no more writes from clients or expiring keys from here on
+	s.draining = true
+	s.mu.Unlock()
+
+	log := loggerFrom(req.Context())
+	log.info("leaving the cluster", "view", peers)
+	ctx, sp := s.tracer.start(req.Context(), "leave", spanInternal, "view", peers)
+	defer sp.finish()
+
+	handOffCtx, cancel := context.WithTimeout(ctx, s.cfg.ShutdownTimeout)
+	defer cancel()
+	err = s.drainQueues(handOffCtx)
+	if err == nil && s.raft != nil {
+		// with raft, the group agrees we are out of the view, and stops counting on our vote, before anyone retires us
+		if err = s.leaveRaft(handOffCtx); err != nil {
+			s.mu.Lock()
+			s.draining = false
+			s.mu.Unlock()
+			log.warn("could not leave the raft group", "error", err)
+			sp.fail(err)
+			return err
+		}
+	}
+	if err == nil {
+		err = s.announceMembership(handOffCtx, peers, update)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.draining = false
+		s.mu.Unlock()
+		log.warn("could not leave the cluster", "error", err)
+		sp.fail(err)
+		return errHandOff.because(err)
+	}
+
+	s.mu.Lock()
+	s.mergeMembership(update.membership)
+	s.mu.Unlock()
+	log.info("left the cluster")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "decommissioned"})
+
+	// Shutdown waits for this request to be answered, so it can't run on this goroutine
+	go func() {
+		if err := s.Shutdown(context.Background()); err != nil {
+			s.log.warn("problem shutting down after leaving the cluster", "error", err)
+		}
+		close(s.decommissioned)
+	}()
+	return nil
+}
+
+// Helper function that passes an admin request about the given replica on to another replica (the one leaving, or the
+// one joins go through), and answers with whatever it answered
+func (s *Server) forwardAdmin(w http.ResponseWriter, req *http.Request, target string, path string, addr string) error {
+	// a map of strings always marshals
+	body, _ := json.Marshal(map[string]string{"socket-address": addr})
+	status, answer, err := s.postPeer(req.Context(), target, path, body)
+	if err != nil {
+		return errPeerUnavailable.because(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(answer)
+	return nil
+}
+
+// Helper function that sends a membership update to every given replica
+// Every replica is sent it, whether or not the ones before took it, and the ones that didn't are sent it again, backing
+// off like replication does, until they all have or ctx is done. Replicas take the same update any number of times, so
+// this never leaves some of them with a change the rest don't know about for longer than that. A replica whose
+// membership conflicts with the update won't take it however often it is asked, so that ends it at once
+func (s *Server) announceMembership(ctx context.Context, peers []string, update membershipUpdate) error {
+	// a membership always marshals
+	body, _ := json.Marshal(update)
+	remaining := peers
+	backoff := retryBackoff
+	for {
+		var failed []string
+		var lastErr error
+		for _, replicaIP := range remaining {
+			status, _, err := s.postPeer(ctx, s.internalAddress(replicaIP), "/internal/members", body)
+			if err == nil && status == errMembershipConflict.Status {
+				return fmt.Errorf("%s: %w", replicaIP, errMembershipConflict)
+			}
+			if err == nil && status != http.StatusOK {
+				err = fmt.Errorf("/internal/members answered %d", status)
+			}
+			if err != nil {
+				failed = append(failed, replicaIP)
+				lastErr = fmt.Errorf("%s: %w", replicaIP, err)
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		s.log.debug("membership update not taken yet", "peers", failed, "error", lastErr)
+		remaining = failed
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%d of %d replicas did not take the update: %w", len(failed), len(peers), lastErr)
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// Handler function that answers our membership (GET), or takes another replica's update of it (POST)
+// Before taking an update, every write we have queued is handed off (other than to a replica being added, which can't
+// take writes yet), so the replica changing the membership knows no write of ours is only on its way to anyone
+func (s *Server) handleMembers(w http.ResponseWriter, req *http.Request) error {
+	if req.Method == "GET" {
+		s.mu.Lock()
+		m := s.currentMembership()
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, m)
+		return nil
+	}
+
+	var update membershipUpdate
+	if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+		return errInvalidJSON.because(err)
+	}
+	if err := s.drainQueues(req.Context(), update.Joining); err != nil {
+		return errHandOff.because(err)
+	}
+
+	s.mu.Lock()
+	changed, apiErr := s.mergeMembership(update.membership)
+	m := s.currentMembership()
+	s.mu.Unlock()
+	if apiErr != nil {
+		return apiErr
+	}
+
+	loggerFrom(req.Context()).info("membership updated", "changed", changed, "members", m.Members, "retired", m.Retired)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "updated", "members": m.Members, "retired": m.Retired})
+	return nil
+}
+
+// Handler function that installs the state a replica adding us to the cluster sent us: its membership, view, store
+// and vector clock. From then on we are a member like any other. A replica that is already a member answers 409
+func (s *Server) handleBootstrap(w http.ResponseWriter, req *http.Request) error {
+	var msg bootstrapMessage
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		return errInvalidJSON.because(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.joining {
+		return errAlreadyMember
+	}
+	index := containsVal(s.sAddress, msg.Membership.Members)
+	if index < 0 {
+		return errInvalidMessage.saying("Bootstrap does not make this replica a member")
+	}
+
+	s.members = append([]string(nil), msg.Membership.Members...)
+	for _, addr := range msg.Membership.Retired {
+		s.retired[addr] = true
+	}
+	s.replicaArray = append([]string(nil), msg.View...)
+	if containsVal(s.sAddress, s.replicaArray) < 0 {
+		s.replicaArray = append(s.replicaArray, s.sAddress)
+	}
+	s.viewArray = append([]string(nil), s.replicaArray...)
+	s.observeViewEpoch(msg.ViewEpoch)
+	s.vectorIndex = index
+	s.localVector = msg.VectorClock.copyOf(len(s.members))
+
+	if msg.KVS == nil {
+		msg.KVS = make(map[string]interface{})
+	}
+	if msg.TTL == nil {
+		msg.TTL = make(map[string]keyExpiry)
+	}
+	oldStore, oldExpiries := s.store, s.expiries
+	s.replaceStore(msg.KVS)
+	s.expiries = msg.TTL
+	s.logRecovery(oldStore, oldExpiries, s.store, s.expiries, s.localVector, s.indexOf(msg.From))
+
+	s.joining = false
+	s.recovered = true
+	s.saveMembership()
+	loggerFrom(req.Context()).info("joined the cluster", "from", msg.From, "index", index, "keys", len(s.store), "vector_clock", s.localVector)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "joined", "index": index})
+	return nil
+}
+
+// Helper function used by recovery to pick up membership changes another replica saw while we were down
+func (s *Server) catchUpMembership(ctx context.Context, replicaIP string) {
+	var m membership
+	if err := s.getPeerJSON(ctx, s.internalAddress(replicaIP), "/internal/members", &m); err != nil {
+		s.log.warn("could not get membership", "peer", replicaIP, "error", err)
+		return
+	}
+	s.mu.Lock()
+	_, apiErr := s.mergeMembership(m)
+	s.mu.Unlock()
+	if apiErr != nil {
+		s.log.error("membership disagrees with peer's", "peer", replicaIP, "peer_members", m.Members)
+	}
+}
+
+// Helper function that POSTs a JSON body to a path of another replica, returning the status and body it answered with
+func (s *Server) postPeer(ctx context.Context, replicaIP string, path string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.peerURL(replicaIP, path), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+
+	answer, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, answer, nil
+}
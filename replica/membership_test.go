@@ -0,0 +1,50 @@
+package replica
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The membership a replica saves is the one it starts with after a restart, and saving it leaves nothing else behind
+func TestSaveMembership(t *testing.T) {
+	members := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	cfg := testConfig(t, members[0], members)
+	cfg.DataDir = filepath.Join(cfg.DataDir, "not-made-yet")
+	s := newServer(t, cfg)
+
+	tests := []struct {
+		name    string
+		retired []string
+	}{
+		{name: "first save", retired: []string{}},
+		{name: "replaced", retired: []string{members[2]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.mu.Lock()
+			for _, addr := range tt.retired {
+				s.retired[addr] = true
+			}
+			s.saveMembership()
+			s.mu.Unlock()
+
+			saved, err := loadMembership(cfg.DataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := membership{Members: members, Retired: tt.retired}
+			if saved == nil || !reflect.DeepEqual(*saved, want) {
+				t.Errorf("loaded %+v, want %+v", saved, want)
+			}
+			files, err := os.ReadDir(cfg.DataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[0].Name() != membershipFile {
+				t.Errorf("data dir holds %v, want only %s", files, membershipFile)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package replica
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// upper bounds, in seconds, of the request latency histogram buckets
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestLabels are what requests are counted by
+type requestLabels struct {
+	route  string
+	method string
+	code   int
+}
+
+// routeLabels are what request latencies are measured by
+type routeLabels struct {
+	route  string
+	method string
+}
+
+// histogram counts observations into latencyBuckets (each count is just that bucket's, not cumulative)
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// sendCounts are how many writes one replica got from us, and how many sends to it failed
+type sendCounts struct {
+	success uint64
+	failure uint64
+}
+
+// metrics holds the counters /metrics reports; anything that can be read off the replica's state (the view, store
+// and vector clock) is read when /metrics is asked for instead
+type metrics struct {
+	mu               sync.Mutex
+	requests         map[requestLabels]uint64
+	latencies        map[routeLabels]*histogram
+	causalViolations map[string]uint64 // by who sent the write: "client" or "replica"
+	sends            map[string]*sendCounts
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:         make(map[requestLabels]uint64),
+		latencies:        make(map[routeLabels]*histogram),
+		causalViolations: make(map[string]uint64),
+		sends:            make(map[string]*sendCounts),
+	}
+}
+
+// Helper function used to record a request that was answered
+func (m *metrics) observeRequest(route string, method string, code int, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestLabels{route: route, method: method, code: code}]++
+
+	labels := routeLabels{route: route, method: method}
+	h, ok := m.latencies[labels]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.latencies[labels] = h
+	}
+	seconds := took.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// Helper function used to record a write we turned away with a 503 because of its causal dependencies
+func (m *metrics) causalViolation(source string) {
+	m.mu.Lock()
+	m.causalViolations[source]++
+	m.mu.Unlock()
+}
+
+// Helper function used to record one attempt to send a write to a replica
+func (m *metrics) send(replicaIP string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts, exists := m.sends[replicaIP]
+	if !exists {
+		counts = &sendCounts{}
+		m.sends[replicaIP] = counts
+	}
+	if ok {
+		counts.success++
+	} else {
+		counts.failure++
+	}
+}
+
+// statusRecorder remembers the status a handler answered with
+// It passes Flush on, since /watch and /changes stream their responses
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Used as router middleware to count every request and how long it took, by the route it matched
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := routeOf(req)
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			s.metrics.observeRequest(route, req.Method, status, time.Since(start))
+		}()
+		next.ServeHTTP(recorder, req)
+	})
+}
+
+// Helper function that returns the template of the route a request matched, e.g. "/kvs/{key}"
+func routeOf(req *http.Request) string {
+	if current := mux.CurrentRoute(req); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+// Handler function that reports the replica's metrics in the Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	s.writeRequestMetrics(out)
+	s.writeReplicationMetrics(out)
+	s.writeStateMetrics(out)
+}
+
+// Helper function that writes the request counters and latencies
+func (s *Server) writeRequestMetrics(out *bufio.Writer) {
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHelp(out, "kvs_http_requests_total", "counter", "HTTP requests answered, by route, method and status code.")
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, labels := range requests {
+		writeSample(out, "kvs_http_requests_total", float64(m.requests[labels]),
+			"route", labels.route, "method", labels.method, "code", strconv.Itoa(labels.code))
+	}
+
+	writeHelp(out, "kvs_http_request_duration_seconds", "histogram", "How long HTTP requests took to answer, by route and method.")
+	routes := make([]routeLabels, 0, len(m.latencies))
+	for labels := range m.latencies {
+		routes = append(routes, labels)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, labels := range routes {
+		h := m.latencies[labels]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			writeSample(out, "kvs_http_request_duration_seconds_bucket", float64(cumulative),
+				"route", labels.route, "method", labels.method, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		writeSample(out, "kvs_http_request_duration_seconds_bucket", float64(h.count),
+			"route", labels.route, "method", labels.method, "le", "+Inf")
+		writeSample(out, "kvs_http_request_duration_seconds_sum", h.sum, "route", labels.route, "method", labels.method)
+		writeSample(out, "kvs_http_request_duration_seconds_count", float64(h.count), "route", labels.route, "method", labels.method)
+	}
+
+	writeHelp(out, "kvs_causal_violations_total", "counter", "Writes answered 503 because their causal dependencies weren't satisfied, by who sent them.")
+	for _, source := range []string{"client", "replica"} {
+		writeSample(out, "kvs_causal_violations_total", float64(m.causalViolations[source]), "source", source)
+	}
+}
+
+// Helper function that writes how replication to each other replica is going
+func (s *Server) writeReplicationMetrics(out *bufio.Writer) {
+	m := s.metrics
+	m.mu.Lock()
+	peers := make([]string, 0, len(m.sends))
+	for addr := range m.sends {
+		peers = append(peers, addr)
+	}
+	sort.Strings(peers)
+	writeHelp(out, "kvs_replication_sends_total", "counter", "Attempts to send a write to another replica, by replica and whether it was acknowledged.")
+	for _, addr := range peers {
+		writeSample(out, "kvs_replication_sends_total", float64(m.sends[addr].success), "peer", addr, "result", "success")
+		writeSample(out, "kvs_replication_sends_total", float64(m.sends[addr].failure), "peer", addr, "result", "failure")
+	}
+	m.mu.Unlock()
+
+	s.mu.Lock()
+	queues := make(map[string]*peerQueue, len(s.peers))
+	for addr, queue := range s.peers {
+		queues[addr] = queue
+	}
+	s.mu.Unlock()
+
+	peers = peers[:0]
+	for addr := range queues {
+		peers = append(peers, addr)
+	}
+	sort.Strings(peers)
+	writeHelp(out, "kvs_replication_queued", "gauge", "Writes waiting to be sent to another replica.")
+	for _, addr := range peers {
+		queue := queues[addr]
+		queue.mu.Lock()
+		queued := len(queue.pending)
+		queue.mu.Unlock()
+		writeSample(out, "kvs_replication_queued", float64(queued), "peer", addr)
+	}
+}
+
+// Helper function that writes the metrics read off the replica's state
+func (s *Server) writeStateMetrics(out *bufio.Writer) {
+	s.mu.Lock()
+	viewSize := len(s.replicaArray)
+	viewEpoch := s.viewEpoch
+	keys := len(s.store)
+	bytes := s.storeBytes
+	vc := s.localVector.clone()
+	s.mu.Unlock()
+
+	writeHelp(out, "kvs_view_size", "gauge", "Replicas in this replica's view, itself included.")
+	writeSample(out, "kvs_view_size", float64(viewSize))
+	writeHelp(out, "kvs_view_epoch", "gauge", "Epoch of this replica's view, which goes up with every change to it.")
+	writeSample(out, "kvs_view_epoch", float64(viewEpoch))
+	writeHelp(out, "kvs_store_keys", "gauge", "Keys in the store.")
+	writeSample(out, "kvs_store_keys", float64(keys))
+	writeHelp(out, "kvs_store_bytes", "gauge", "Size of the store: every key plus its value encoded as JSON.")
+	writeSample(out, "kvs_store_bytes", float64(bytes))
+	writeHelp(out, "kvs_vector_clock", "gauge", "Entries of this replica's vector clock, by index.")
+	for i, val := range vc {
+		writeSample(out, "kvs_vector_clock", float64(val), "index", strconv.Itoa(i))
+	}
+
+	if s.raft != nil {
+		s.writeRaftMetrics(out)
+	}
+}
+
+// Helper function that writes the metrics of the raft group, as this replica sees it
+func (s *Server) writeRaftMetrics(out *bufio.Writer) {
+	r := s.raft
+	r.mu.Lock()
+	term := r.term
+	leader := r.role == raftLeader
+	commitIndex := r.commitIndex
+	applied := r.lastApplied
+	r.mu.Unlock()
+
+	writeHelp(out, "kvs_raft_term", "gauge", "Current raft term.")
+	writeSample(out, "kvs_raft_term", float64(term))
+	writeHelp(out, "kvs_raft_leader", "gauge", "1 if this replica is the raft leader, 0 otherwise.")
+	if leader {
+		writeSample(out, "kvs_raft_leader", 1)
+	} else {
+		writeSample(out, "kvs_raft_leader", 0)
+	}
+	writeHelp(out, "kvs_raft_commit_index", "gauge", "Index of the last raft log entry known to be committed.")
+	writeSample(out, "kvs_raft_commit_index", float64(commitIndex))
+	writeHelp(out, "kvs_raft_applied_index", "gauge", "Index of the last raft log entry applied to the view.")
+	writeSample(out, "kvs_raft_applied_index", float64(applied))
+}
+
+// Helper function that writes the HELP and TYPE lines of a metric
+func writeHelp(out *bufio.Writer, name string, kind string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Helper function that writes one sample; labels are given as name, value pairs
+func writeSample(out *bufio.Writer, name string, val float64, labels ...string) {
+	out.WriteString(name)
+	if len(labels) > 0 {
+		out.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			fmt.Fprintf(out, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		out.WriteByte('}')
+	}
+	fmt.Fprintf(out, " %s\n", strconv.FormatFloat(val, 'g', -1, 64))
+}
+
+// label values escape backslashes, quotes and newlines
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(val string) string {
+	return labelEscaper.Replace(val)
+}
@@ -0,0 +1,143 @@
+package replica
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper function that reads the samples in a /metrics answer, by their name and labels as written
+func parseMetrics(t *testing.T, text string) map[string]float64 {
+	t.Helper()
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(text, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		val, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q has no value: %v", line, err)
+		}
+		samples[line[:i]] = val
+	}
+	return samples
+}
+
+// /metrics counts requests by the route they matched and what they were answered, and reads the rest off the replica
+func TestMetrics(t *testing.T) {
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{method: "PUT", path: "/kvs/x", body: `{"value": "abc"}`},
+		{method: "GET", path: "/kvs/x"},
+		{method: "GET", path: "/kvs/missing"},
+		{method: "PUT", path: "/kvs/y", body: `{"value": 1, "causal-metadata": {"ReqVector": [5], "IsReqFromClient": true}}`},
+		{method: "GET", path: "/nowhere"},
+	}
+	for _, req := range requests {
+		serve(s, req.method, req.path, req.body)
+	}
+	s.metrics.send("127.0.0.1:2", true)
+	s.metrics.send("127.0.0.1:2", false)
+	s.metrics.send("127.0.0.1:2", true)
+
+	rec := serve(s, "GET", "/metrics", "")
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", got)
+	}
+	samples := parseMetrics(t, rec.Body.String())
+
+	want := map[string]float64{
+		`kvs_http_requests_total{route="/kvs/{key:.+}",method="PUT",code="201"}`:                 1,
+		`kvs_http_requests_total{route="/kvs/{key:.+}",method="PUT",code="503"}`:                 1,
+		`kvs_http_requests_total{route="/kvs/{key:.+}",method="GET",code="200"}`:                 1,
+		`kvs_http_requests_total{route="/kvs/{key:.+}",method="GET",code="404"}`:                 1,
+		`kvs_http_request_duration_seconds_count{route="/kvs/{key:.+}",method="GET"}`:            2,
+		`kvs_http_request_duration_seconds_bucket{route="/kvs/{key:.+}",method="GET",le="+Inf"}`: 2,
+		`kvs_causal_violations_total{source="client"}`:                                           1,
+		`kvs_causal_violations_total{source="replica"}`:                                          0,
+		`kvs_replication_sends_total{peer="127.0.0.1:2",result="success"}`:                       2,
+		`kvs_replication_sends_total{peer="127.0.0.1:2",result="failure"}`:                       1,
+		`kvs_view_size`:               1,
+		`kvs_store_keys`:              1,
+		`kvs_store_bytes`:             float64(len("x") + len(`"abc"`)),
+		`kvs_vector_clock{index="0"}`: 1,
+	}
+	for name, val := range want {
+		if got, ok := samples[name]; !ok || got != val {
+			t.Errorf("%s = %v (reported %v), want %v", name, got, ok, val)
+		}
+	}
+	for name := range samples {
+		if strings.Contains(name, "/nowhere") {
+			t.Errorf("%s is counted by its path rather than a route", name)
+		}
+	}
+}
+
+// Latencies are reported as cumulative buckets, each counting every request at most as slow as its bound
+func TestLatencyHistogram(t *testing.T) {
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	for _, took := range []time.Duration{500 * time.Microsecond, 3 * time.Millisecond, 3 * time.Millisecond, 20 * time.Second} {
+		s.metrics.observeRequest("/kvs/{key:.+}", "GET", 200, took)
+	}
+
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	s.writeRequestMetrics(out)
+	out.Flush()
+	samples := parseMetrics(t, buf.String())
+
+	tests := []struct {
+		le   string
+		want float64
+	}{
+		{le: "0.001", want: 1},
+		{le: "0.005", want: 3},
+		{le: "1", want: 3},
+		{le: "10", want: 3},
+		{le: "+Inf", want: 4},
+	}
+	for _, tt := range tests {
+		name := `kvs_http_request_duration_seconds_bucket{route="/kvs/{key:.+}",method="GET",le="` + tt.le + `"}`
+		if got := samples[name]; got != tt.want {
+			t.Errorf("bucket le=%s = %v, want %v", tt.le, got, tt.want)
+		}
+	}
+	sum := samples[`kvs_http_request_duration_seconds_sum{route="/kvs/{key:.+}",method="GET"}`]
+	if want := 20.0065; sum < want-1e-9 || sum > want+1e-9 {
+		t.Errorf("sum = %v, want %v", sum, want)
+	}
+}
+
+func TestWriteSample(t *testing.T) {
+	tests := []struct {
+		name   string
+		val    float64
+		labels []string
+		want   string
+	}{
+		{name: "kvs_view_size", val: 3, want: "kvs_view_size 3\n"},
+		{name: "kvs_store_bytes", val: 1.5e9, want: "kvs_store_bytes 1.5e+09\n"},
+		{name: "kvs_replication_queued", val: 2, labels: []string{"peer", "10.0.0.2:8090"},
+			want: `kvs_replication_queued{peer="10.0.0.2:8090"} 2` + "\n"},
+		{name: "m", val: 0, labels: []string{"a", `quote " slash \ line` + "\n", "b", "c"},
+			want: `m{a="quote \" slash \\ line\n",b="c"} 0` + "\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		out := bufio.NewWriter(&buf)
+		writeSample(out, tt.name, tt.val, tt.labels...)
+		out.Flush()
+		if buf.String() != tt.want {
+			t.Errorf("writeSample(%s) = %q, want %q", tt.name, buf.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,632 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+)
+
+// logEntry is one mutation applied to our store, in the order we applied it
+// The same entries are broadcast to the other replicas, streamed to watchers and served from /changes
+type logEntry struct {
+	LSN         int64       `json:"lsn"` // position of the entry in our log, starting at 1
+	Key         string      `json:"key"`
+	Op          string      `json:"op"` // "put" or "delete"
+	Value       interface{} `json:"value,omitempty"`
+	ExpiresAt   *int64      `json:"expires-at,omitempty"`
+	VectorClock vectorClock `json:"vector-clock"`
+	Origin      int         `json:"origin"`               // vector index of the replica that first accepted the write
+	RequestID   string      `json:"request-id,omitempty"` // id of the client request that made the change, if any
+	// set on writes to linearizable keys: where the write is in the raft log, which is what applies it (see linear.go);
+	// their vector clock and origin are just ours when we applied them, since they have no place in the clock
+	RaftIndex int64 `json:"raft-index,omitempty"`
+}
+
+// logSubscriber is anyone following the log as it grows, e.g. a watcher or a /changes stream
+type logSubscriber struct {
+	filter  func(logEntry) bool
+	entries chan logEntry
+}
+
+// how many of the most recent entries we also keep in memory, so new subscribers rarely touch the disk
+var logTailLimit = 1000
+
+// files next to the log: the one compaction writes the new log to before swapping it in, and the clock of every
+// entry compaction has read, which replaying the entries it kept might not add up to
+const (
+	logFileName       = "oplog.jsonl"
+	compactingLogName = "oplog.jsonl.compacting"
+	logClockName      = "oplog.clock.json"
+)
+
+// Used to open our log on startup and replay it, so the store, TTLs and vector clock survive a restart
+func (s *Server) openLog() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	if err := os.MkdirAll(s.dataDir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.dataDir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	// replaying every entry we wrote before, stopping at the first one we can't read
+	// (a crash halfway through a write leaves a partial last line, which we cut off)
+	var good int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var entry logEntry
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+		good += int64(len(line))
+		if entry.RaftIndex != 0 {
+			// the raft log applies these again itself; we only need to know not to log them twice
+			if entry.RaftIndex > s.linearLogged {
+				s.linearLogged = entry.RaftIndex
+			}
+		} else {
+			s.applyEntry(entry)
+		}
+		s.rememberEntry(entry)
+		s.nextLSN = entry.LSN + 1
+		s.logSynced = entry.LSN
+		s.logEntries++
+		s.logLatest[entry.Key] = entry.LSN
+	}
+	if err := file.Truncate(good); err != nil {
+		return err
+	}
+	if _, err := file.Seek(good, io.SeekStart); err != nil {
+		return err
+	}
+
+	// entries dropped by compaction may have seen more than the ones it kept
+	clock, err := loadLogClock(s.dataDir)
+	if err != nil {
+		return err
+	}
+	s.localVector.merge(clock)
+
+	s.logFile = file
+	s.log.info("replayed log", "lsn", s.nextLSN-1, "vector_clock", s.localVector)
+	return nil
+}
+
+// Helper function used to apply a replayed entry to our store, TTLs and vector clock; must be called with s.mu held
+func (s *Server) applyEntry(entry logEntry) {
+	if entry.Op == "put" {
+		s.setValue(entry.Key, entry.Value)
+		if entry.ExpiresAt != nil {
+			s.expiries[entry.Key] = keyExpiry{ExpiresAt: *entry.ExpiresAt, Owner: entry.Origin}
+		} else {
+			delete(s.expiries, entry.Key)
+		}
+	} else {
+		s.deleteValue(entry.Key)
+		delete(s.expiries, entry.Key)
+	}
+	s.localVector.merge(entry.VectorClock)
+}
+
+// Helper function that keeps an entry in the in-memory tail of the log; must be called with s.logMu held
+func (s *Server) rememberEntry(entry logEntry) {
+	s.logTail = append(s.logTail, entry)
+	if len(s.logTail) > logTailLimit {
+		s.logTail = s.logTail[len(s.logTail)-logTailLimit:]
+	}
+}
+
+// Used to record a mutation we are about to apply, or just applied, to our store
+// The entry is written to the log file, but only synced by syncLog, so writers that come in together share one sync
+// and none of them has to hold s.mu while it runs; nobody hears about the entry until it is on disk. If the entry
+// can't be written, the log is left as it was and every later append fails too, since the file may now end in
+// part of a line and a restart only replays up to there
+func (s *Server) appendLog(entry logEntry) (logEntry, error) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	if s.logErr != nil {
+		return entry, s.logErr
+	}
+	entry.LSN = s.nextLSN
+
+	if s.logFile == nil {
+		// nothing to sync, so it can be published straight away
+		s.nextLSN++
+		s.logSynced = entry.LSN
+		s.publish(entry)
+		return entry, nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = s.logFile.Write(append(line, '\n'))
+	}
+	if err != nil {
+		s.logErr = fmt.Errorf("writing log entry %d: %w", entry.LSN, err)
+		s.log.error("problem writing log entry", "lsn", entry.LSN, "error", err)
+		return entry, s.logErr
+	}
+	s.nextLSN++
+	s.logEntries++
+	s.logLatest[entry.Key] = entry.LSN
+	s.logPending = append(s.logPending, entry)
+
+	// once most of the log is entries a later one has superseded, it's worth rewriting without them
+	if !s.logCompacting && s.logEntries >= s.cfg.CompactLogAfter && s.logEntries >= 2*len(s.logLatest) {
+		s.logCompacting = true
+		go s.compactLog()
+	}
+
+	select {
+	case s.logWake <- struct{}{}:
+	default:
+	}
+	return entry, nil
+}
+
+// Used to wait until the log is on disk up to the entry at lsn, syncing it if nobody has yet
+// Only one sync runs at a time, and it covers everything written before it started, so the writers waiting behind
+// it are usually done as soon as it is. Must be called without s.mu held
+func (s *Server) syncLog(lsn int64) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.logMu.Lock()
+	if lsn <= s.logSynced {
+		s.logMu.Unlock()
+		return nil
+	}
+	if s.logErr != nil {
+		err := s.logErr
+		s.logMu.Unlock()
+		return err
+	}
+	file, pending := s.logFile, s.logPending
+	upto := s.nextLSN - 1
+	s.logPending = nil
+	s.logMu.Unlock()
+
+	// a stopped replica synced its log on the way out
+	var err error
+	if file != nil {
+		err = file.Sync()
+	}
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if err != nil {
+		// whether the entries made it is anyone's guess now, so we stop logging rather than build on them
+		s.logErr = fmt.Errorf("syncing log: %w", err)
+		s.log.error("problem syncing log", "lsn", upto, "error", err)
+		return s.logErr
+	}
+	s.logSynced = upto
+	for _, entry := range pending {
+		s.publish(entry)
+	}
+	return nil
+}
+
+// Used to sync the entries nobody waits on (replayed, expired and linearizable writes), so subscribers hear about
+// them without waiting for the next write that is synced
+func (s *Server) syncLogs() {
+	for {
+		select {
+		case <-s.logWake:
+		case <-s.done:
+			return
+		}
+		s.logMu.Lock()
+		latest := s.nextLSN - 1
+		s.logMu.Unlock()
+		s.syncLog(latest)
+	}
+}
+
+// Helper function that returns the error the log failed with, if it has; must be called without s.logMu held
+func (s *Server) logFailed() error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	return s.logErr
+}
+
+// Helper function that keeps an entry that is on disk in the tail, and hands it to every subscriber that wants it
+// Must be called with s.logMu held
+func (s *Server) publish(entry logEntry) {
+	s.rememberEntry(entry)
+
+	for sub := range s.logSubscribers {
+		if !sub.filter(entry) {
+			continue
+		}
+		select {
+		case sub.entries <- entry:
+		default:
+			// this subscriber isn't keeping up, so we hang up on it rather than block writes
+			// it can reconnect and resume from the last entry it saw
+			delete(s.logSubscribers, sub)
+			close(sub.entries)
+		}
+	}
+}
+
+// Used to follow the log starting at the given lsn
+// Returns every entry from that point that passes the filter, plus a subscription for everything after them; the
+// subscription is taken under the same lock as the last of the backlog is read, so no entry slips in between the two
+func (s *Server) subscribeLog(from int64, filter func(logEntry) bool) ([]logEntry, *logSubscriber) {
+	sub := &logSubscriber{filter: filter, entries: make(chan logEntry, 256)}
+	return s.readLog(from, filter, sub), sub
+}
+
+// Used to stop following the log
+func (s *Server) unsubscribeLog(sub *logSubscriber) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	if s.logSubscribers[sub] {
+		delete(s.logSubscribers, sub)
+		close(sub.entries)
+	}
+}
+
+// Helper function that reads every entry from the given lsn onwards that passes the filter, subscribing sub (if
+// given) to the ones after them
+// Whatever is still in the in-memory tail is read under s.logMu, but anything older is read from disk without it, so
+// a consumer far behind never holds up writes; we go round again for whatever was synced while we read. Entries not
+// on disk yet are left for the subscription
+func (s *Server) readLog(from int64, filter func(logEntry) bool, sub *logSubscriber) []logEntry {
+	var entries []logEntry
+	for {
+		s.logMu.Lock()
+		if from > s.logSynced || s.logFile == nil || len(s.logTail) > 0 && from >= s.logTail[0].LSN {
+			for _, entry := range s.logTail {
+				if entry.LSN >= from && filter(entry) {
+					entries = append(entries, entry)
+				}
+			}
+			if sub != nil {
+				s.logSubscribers[sub] = true
+			}
+			s.logMu.Unlock()
+			return entries
+		}
+		upto := s.logSynced + 1
+		path := s.logFile.Name()
+		s.logMu.Unlock()
+
+		entries = append(entries, s.scanLog(path, from, upto, filter)...)
+		from = upto
+	}
+}
+
+// Helper function that reads the entries in [from, upto) that pass the filter from the log file at path
+func (s *Server) scanLog(path string, from, upto int64, filter func(logEntry) bool) []logEntry {
+	var entries []logEntry
+	file, err := os.Open(path)
+	if err != nil {
+		s.log.error("problem opening log", "error", err)
+		return entries
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var entry logEntry
+		if err := decoder.Decode(&entry); err != nil {
+			break
+		}
+		if entry.LSN >= upto {
+			break
+		}
+		if entry.LSN >= from && filter(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Used to rewrite the log without the entries superseded by a later entry for the same key, so it doesn't grow
+// without bound. A consumer that was behind gets only the latest entry for each of those keys, which still leaves
+// it with the state we have
+func (s *Server) compactLog() {
+	err := s.rewriteLog()
+
+	s.logMu.Lock()
+	s.logCompacting = false
+	s.logMu.Unlock()
+	if err != nil {
+		s.log.error("problem compacting log", "error", err)
+	}
+}
+
+// Helper function that does the work of compactLog
+// The entries already in the log are copied without s.logMu; it's only taken again to copy whatever was appended
+// meanwhile and swap the new file in
+func (s *Server) rewriteLog() error {
+	s.logMu.Lock()
+	if s.logFile == nil {
+		s.logMu.Unlock()
+		return nil
+	}
+	keep := make(map[int64]bool, len(s.logLatest))
+	for _, lsn := range s.logLatest {
+		keep[lsn] = true
+	}
+	path := s.logFile.Name()
+	upto := s.nextLSN
+	offset, err := s.logFile.Seek(0, io.SeekCurrent)
+	s.logMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.Create(filepath.Join(dir, compactingLogName))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	old, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	var clock vectorClock
+	var kept int
+	reader := bufio.NewReader(io.LimitReader(old, offset))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var entry logEntry
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+		clock.merge(entry.VectorClock)
+		if !keep[entry.LSN] {
+			continue
+		}
+		if _, err := tmp.Write(line); err != nil {
+			return err
+		}
+		kept++
+	}
+	// the clock has to be on disk before the entries it makes up for are gone
+	if err := saveLogClock(dir, clock); err != nil {
+		return err
+	}
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if s.logFile == nil {
+		// we were shut down meanwhile, and the log we read is still whole
+		return nil
+	}
+	end, err := s.logFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := old.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tmp, old, end-offset); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return err
+	}
+	s.logFile.Close()
+	s.logFile = file
+	dropped := s.logEntries - kept - int(s.nextLSN-upto)
+	s.logEntries = kept + int(s.nextLSN-upto)
+	s.log.info("compacted log", "kept", s.logEntries, "dropped", dropped)
+	return nil
+}
+
+// Helper function that reads the clock compaction saved in dir, if it has saved one
+func loadLogClock(dir string) (vectorClock, error) {
+	data, err := os.ReadFile(filepath.Join(dir, logClockName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var clock vectorClock
+	if err := json.Unmarshal(data, &clock); err != nil {
+		return nil, fmt.Errorf("%s: %w", logClockName, err)
+	}
+	return clock, nil
+}
+
+// Helper function that merges the given clock into the one compaction saved in dir
+func saveLogClock(dir string, clock vectorClock) error {
+	saved, err := loadLogClock(dir)
+	if err != nil {
+		return err
+	}
+	saved.merge(clock)
+	// a clock always marshals
+	data, _ := json.Marshal(saved)
+	return writeFileSynced(filepath.Join(dir, logClockName), append(data, '\n'))
+}
+
+// Helper function that replaces the file at path with data, so that after a crash it holds either the old contents
+// or all of the new ones
+func writeFileSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Helper function that syncs a directory, so the renames in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Helper function used to log the difference between our store and one we just copied from another replica,
+// so anyone following our log ends up with the same state we now have
+// If the log fails partway, we stop there: it takes nothing more once it has failed, and a restart recovers from the
+// other replicas again anyway
+func (s *Server) logRecovery(oldStore map[string]interface{}, oldExpiries map[string]keyExpiry, newStore map[string]interface{}, newExpiries map[string]keyExpiry, vc vectorClock, origin int) {
+	// every entry keeps the clock, so it mustn't be one that changes later
+	vc = vc.clone()
+	for key, val := range newStore {
+		oldVal, existed := oldStore[key]
+		oldExp, hadExpiry := oldExpiries[key]
+		newExp, hasExpiry := newExpiries[key]
+		if existed && reflect.DeepEqual(oldVal, val) && hadExpiry == hasExpiry && oldExp == newExp {
+			continue
+		}
+
+		entry := logEntry{Key: key, Op: "put", Value: val, VectorClock: vc, Origin: origin}
+		if hasExpiry {
+			expiresAt := newExp.ExpiresAt
+			entry.ExpiresAt = &expiresAt
+		}
+		if _, err := s.appendLog(entry); err != nil {
+			return
+		}
+	}
+	for key := range oldStore {
+		if _, ok := newStore[key]; !ok {
+			if _, err := s.appendLog(logEntry{Key: key, Op: "delete", VectorClock: vc, Origin: origin}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Handler function that streams every entry in our log from ?from=<lsn> (default 1) as newline delimited JSON
+// The stream stays open and follows new entries unless ?follow=false is given; consumers resume by asking
+// for the lsn after the last entry they processed
+func (s *Server) handleChanges(w http.ResponseWriter, req *http.Request) {
+	response := make(map[string]interface{})
+
+	query := req.URL.Query()
+	from := int64(1)
+	if raw := query.Get("from"); raw != "" {
+		lsn, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || lsn < 1 {
+			response["error"] = "from must be a positive log position"
+		}
+		from = lsn
+	}
+	follow := query.Get("follow") != "false"
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		response["error"] = "Streaming is not supported"
+	}
+
+	if _, isError := response["error"]; isError || req.Method != "GET" {
+		if !isError {
+			response["error"] = "Changes only supports GET"
+		}
+		writeError(w, req, errInvalidRequest.saying(response["error"].(string)), nil)
+		return
+	}
+
+	// clients are only sent changes to keys they may read
+	p, err := s.authenticate(req)
+	if err != nil {
+		s.deny(w, req, http.StatusUnauthorized, "", "", err.Error())
+		return
+	}
+	filter := p.readable(func(logEntry) bool { return true })
+	var backlog []logEntry
+	var sub *logSubscriber
+	if follow {
+		backlog, sub = s.subscribeLog(from, filter)
+		defer s.unsubscribeLog(sub)
+	} else {
+		backlog = s.readLog(from, filter, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	for _, entry := range backlog {
+		encoder.Encode(entry)
+	}
+	flusher.Flush()
+	if !follow {
+		return
+	}
+
+	for {
+		select {
+		case entry, open := <-sub.entries:
+			if !open {
+				return
+			}
+			encoder.Encode(entry)
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
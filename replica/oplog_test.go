@@ -0,0 +1,126 @@
+package replica
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+// Helper function that makes a replica with its log open, without starting anything else
+func newLoggedServer(t *testing.T) *Server {
+	t.Helper()
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	if err := s.openLog(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Helper function that makes every later write to a replica's log fail, as a full or broken disk would
+func breakLog(t *testing.T, s *Server) {
+	t.Helper()
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	readOnly, err := os.Open(s.logFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.logFile.Close()
+	s.logFile = readOnly
+}
+
+// An entry is only read or sent to subscribers once it is on disk, and one sync covers everything written before it
+func TestSyncLog(t *testing.T) {
+	s := newLoggedServer(t)
+
+	first, err := s.appendLog(logEntry{Key: "a", Op: "put", Value: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.appendLog(logEntry{Key: "b", Op: "put", Value: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := func(logEntry) bool { return true }
+
+	backlog, sub := s.subscribeLog(1, all)
+	defer s.unsubscribeLog(sub)
+	if len(backlog) != 0 || len(sub.entries) != 0 {
+		t.Fatalf("read %v and was sent %d entries before they were synced", backlog, len(sub.entries))
+	}
+
+	if err := s.syncLog(first.LSN); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []logEntry{first, second} {
+		select {
+		case got := <-sub.entries:
+			if got.LSN != want.LSN || got.Key != want.Key {
+				t.Errorf("was sent %d %s, want %d %s", got.LSN, got.Key, want.LSN, want.Key)
+			}
+		default:
+			t.Fatalf("wasn't sent %d %s once it was synced", want.LSN, want.Key)
+		}
+	}
+	if got := s.readLog(1, all, nil); len(got) != 2 {
+		t.Errorf("read %v once synced, want both entries", got)
+	}
+}
+
+// An entry that can't be written leaves the log as it was, and so does every one after it
+func TestAppendLogFailure(t *testing.T) {
+	s := newLoggedServer(t)
+	if _, err := s.appendLog(logEntry{Key: "a", Op: "put", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	breakLog(t, s)
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.appendLog(logEntry{Key: "b", Op: "put", Value: "2"}); err == nil {
+			t.Fatal("appendLog() succeeded on a log that can't be written")
+		}
+	}
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if s.nextLSN != 2 || s.logEntries != 1 || s.logLatest["b"] != 0 {
+		t.Errorf("log moved on to lsn %d with %d entries, want 2 with 1", s.nextLSN, s.logEntries)
+	}
+}
+
+// A write the replica can't log is refused with 500 and undone, so it doesn't show up in reads or the vector clock
+func TestUnloggedWriteRefused(t *testing.T) {
+	s := newLoggedServer(t)
+	if rec := serve(s, "PUT", "/kvs/kept", `{"value": 1}`); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT kept = %d: %s", rec.Code, rec.Body)
+	}
+	clock := clockOf(s)
+	breakLog(t, s)
+
+	tests := []struct {
+		method string
+		key    string
+		body   string
+	}{
+		{method: "PUT", key: "new", body: `{"value": 2}`},
+		{method: "PUT", key: "kept", body: `{"value": 3, "ttl": 60}`},
+		{method: "DELETE", key: "kept"},
+	}
+	for _, tt := range tests {
+		if rec := serve(s, tt.method, "/kvs/"+tt.key, tt.body); rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s %s = %d, want 500: %s", tt.method, tt.key, rec.Code, rec.Body)
+		}
+	}
+
+	if store := storeOf(s); len(store) != 1 || store["kept"] != 1.0 {
+		t.Errorf("store is %v, want only kept = 1", store)
+	}
+	s.mu.Lock()
+	_, expiring := s.expiries["kept"]
+	s.mu.Unlock()
+	if expiring {
+		t.Error("kept has the TTL of a PUT that was refused")
+	}
+	if got := clockOf(s); !got.equal(clock) {
+		t.Errorf("vector clock is %v, want %v", got, clock)
+	}
+}
@@ -0,0 +1,1236 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With CONSENSUS=raft, the view is no longer changed by whichever replica happens to notice another one is down (or
+// is back): every change is proposed to a raft group made of the cluster's members, and applied by every replica in
+// the order the group's log has it, once a majority of the group has it. The group's voters change through joint
+// consensus (a majority of both the old and the new voters is needed while it changes) when replicas join or leave
+// the cluster. The log also carries the writes to linearizable keys (see linear.go). How it is kept on disk, and
+// snapshotted once it grows, is in raftlog.go
+
+// how many entries one append sends at most
+var raftMaxAppend = 64
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (r raftRole) String() string {
+	switch r {
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// raftCommand is what an entry of the log does once it is committed
+type raftCommand struct {
+	Op     string   `json:"op"`               // "view-add", "view-remove", "config", "put", "delete" or "noop"
+	Addr   string   `json:"addr,omitempty"`   // the replica added to or taken out of the view
+	Voters []string `json:"voters,omitempty"` // the voters from this entry on ("config" only)
+	Old    []string `json:"old,omitempty"`    // the voters before, while the change is joint ("config" only)
+
+	// a write to a linearizable key ("put" and "delete" only), see linear.go
+	Key       string      `json:"key,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+	ExpiresAt int64       `json:"expires-at,omitempty"` // unix time in milliseconds, if the key was PUT with a TTL
+}
+
+// raftEntry is one entry of the log
+type raftEntry struct {
+	Index   int64       `json:"index"`
+	Term    uint64      `json:"term"`
+	Command raftCommand `json:"command"`
+}
+
+// raftConfig is who votes. While it is joint, every decision needs a majority of Voters and one of Old
+type raftConfig struct {
+	Voters []string `json:"voters"`
+	Old    []string `json:"old,omitempty"`
+}
+
+// raftNode is this replica's part of the raft group; it has its own lock, and s.mu is never taken while holding it
+type raftNode struct {
+	mu              sync.Mutex
+	electionTimeout time.Duration
+
+	// what is kept on disk, see raftlog.go
+	dir       string   // empty if nothing is kept on disk
+	logFile   *os.File // the entries of log, one per line
+	onDisk    []int64  // where each entry of log that is in logFile starts in it
+	logEnd    int64
+	savedTerm uint64 // the term and vote raft.json has
+	savedVote string
+
+	role        raftRole
+	term        uint64
+	votedFor    string
+	snapshot    *raftSnapshot // what the entries before log left behind, nil if there is no snapshot yet
+	log         []raftEntry   // the entries after the snapshot: log[i].Index is i+1 plus the snapshot's index
+	initial     raftConfig    // the voters until the log says otherwise: the members we started with
+	config      raftConfig    // the latest config in the log, committed or not
+	commitIndex int64
+	lastApplied int64
+	leader      string
+	lastHeard   time.Time // when the leader last reached us (or, on the leader, when it was elected)
+	deadline    time.Time // when we start an election unless we hear from a leader first
+	votes       map[string]bool
+
+	// the leader's view of the others
+	nextIndex   map[string]int64
+	matchIndex  map[string]int64
+	sending     map[string]bool      // whether an append to the replica is in flight
+	lastContact map[string]time.Time // when the replica last answered an append
+
+	changingConfig bool                  // whether changeConfig is running
+	waiters        map[int64]*raftWaiter // proposals waiting to be applied, by index
+	applyWake      chan struct{}
+	applied        chan struct{} // closed (and replaced) whenever lastApplied moves
+}
+
+// raftWaiter is a proposal waiting for its entry to be applied; if another entry ends up at its index, it failed
+type raftWaiter struct {
+	term   uint64
+	result string // what applying the entry came to, set before done is sent on
+	done   chan error
+}
+
+// raftOutcome is what a proposal came to: the index of its entry, and for a write, its result (e.g. "created")
+type raftOutcome struct {
+	Index  int64  `json:"index"`
+	Result string `json:"result,omitempty"`
+}
+
+// the bodies of the raft RPCs, sent to /internal/raft/...
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex int64  `json:"last-log-index"`
+	LastLogTerm  uint64 `json:"last-log-term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term         uint64      `json:"term"`
+	Leader       string      `json:"leader"`
+	PrevLogIndex int64       `json:"prev-log-index"`
+	PrevLogTerm  uint64      `json:"prev-log-term"`
+	Entries      []raftEntry `json:"entries"`
+	LeaderCommit int64       `json:"leader-commit"`
+}
+
+type appendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex int64  `json:"last-index"` // on success, the last index we now match the leader up to; otherwise our last index
+}
+
+type proposeRequest struct {
+	Command raftCommand `json:"command"`
+}
+
+// Helper function that sets up the raft group from what we kept on disk, or with the given voters if nothing was
+func newRaftNode(dataDir string, voters []string, electionTimeout time.Duration) (*raftNode, error) {
+	r := &raftNode{
+		electionTimeout: electionTimeout,
+		initial:         raftConfig{Voters: append([]string(nil), voters...)},
+		nextIndex:       make(map[string]int64),
+		matchIndex:      make(map[string]int64),
+		sending:         make(map[string]bool),
+		lastContact:     make(map[string]time.Time),
+		waiters:         make(map[int64]*raftWaiter),
+		applyWake:       make(chan struct{}, 1),
+		applied:         make(chan struct{}),
+	}
+	if dataDir != "" {
+		if err := r.load(dataDir); err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	if r.snapshot != nil {
+		// the snapshot is committed, so applyRaft can put it in place straight away
+		r.applyWake <- struct{}{}
+	}
+	r.updateConfig()
+	r.resetDeadline()
+	return r, nil
+}
+
+// Helper function that picks the next election deadline, at random so replicas rarely stand at once
+// Must be called with r.mu held
+func (r *raftNode) resetDeadline() {
+	r.deadline = time.Now().Add(r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout))))
+}
+
+// Helper function that returns the index and term of the last entry of the log; must be called with r.mu held
+func (r *raftNode) last() (int64, uint64) {
+	if len(r.log) == 0 {
+		return r.base()
+	}
+	entry := r.log[len(r.log)-1]
+	return entry.Index, entry.Term
+}
+
+// Helper function that returns the term of the entry at the index (0 for index 0, or one the snapshot has before its
+// last); must be called with r.mu held
+func (r *raftNode) termAt(index int64) uint64 {
+	base, baseTerm := r.base()
+	if index == base {
+		return baseTerm
+	}
+	if index < base || index > base+int64(len(r.log)) {
+		return 0
+	}
+	return r.log[index-base-1].Term
+}
+
+// Helper function that sets the config to the latest one in the log, which is the one in effect whether it is
+// committed or not; must be called with r.mu held
+func (r *raftNode) updateConfig() {
+	for i := len(r.log) - 1; i >= 0; i-- {
+		if cmd := r.log[i].Command; cmd.Op == "config" {
+			r.config = raftConfig{Voters: cmd.Voters, Old: cmd.Old}
+			return
+		}
+	}
+	if r.snapshot != nil {
+		r.config = r.snapshot.Config
+		return
+	}
+	r.config = r.initial
+}
+
+// Helper function that returns every replica that votes, in either half of a joint config
+func (c raftConfig) all() []string {
+	all := append([]string(nil), c.Voters...)
+	for _, addr := range c.Old {
+		if containsVal(addr, all) < 0 {
+			all = append(all, addr)
+		}
+	}
+	return all
+}
+
+// Helper function that checks if the replicas for which has is true are a majority of the voters (of both halves of a
+// joint config)
+func (c raftConfig) quorum(has func(addr string) bool) bool {
+	return majority(c.Voters, has) && (len(c.Old) == 0 || majority(c.Old, has))
+}
+
+// Helper function that checks if the replicas for which has is true are a majority of the set
+func majority(set []string, has func(addr string) bool) bool {
+	count := 0
+	for _, addr := range set {
+		if has(addr) {
+			count++
+		}
+	}
+	return count > len(set)/2
+}
+
+// Helper function that makes us a follower of the given term; must be called with r.mu held
+func (r *raftNode) becomeFollower(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.leader = ""
+	}
+	r.role = raftFollower
+	r.resetDeadline()
+}
+
+// Helper function that adds an entry to the end of our log as the leader, returning it; must be called with r.mu held
+func (r *raftNode) appendLocked(cmd raftCommand) raftEntry {
+	index, _ := r.last()
+	entry := raftEntry{Index: index + 1, Term: r.term, Command: cmd}
+	r.log = append(r.log, entry)
+	if cmd.Op == "config" {
+		r.updateConfig()
+	}
+	return entry
+}
+
+// Used to run the raft group: followers and candidates start an election when they haven't heard from a leader in a
+// while, and the leader sends every other voter what it is missing of the log (or a heartbeat) a few times per
+// election timeout. Runs until the server stops
+func (s *Server) runRaft() {
+	r := s.raft
+	ticker := time.NewTicker(r.electionTimeout / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		r.mu.Lock()
+		if r.role == raftLeader {
+			r.mu.Unlock()
+			s.replicateRaft()
+			continue
+		}
+		// only voters stand, and a replica that was just added waits to hear from the leader first
+		if time.Now().Before(r.deadline) || containsVal(s.sAddress, r.config.all()) < 0 {
+			r.mu.Unlock()
+			continue
+		}
+		s.startElection()
+		r.mu.Unlock()
+	}
+}
+
+// Helper function that stands for leader in a new term, asking every other voter for its vote; must be called with
+// r.mu held
+func (s *Server) startElection() {
+	r := s.raft
+	r.term++
+	r.role = raftCandidate
+	r.votedFor = s.sAddress
+	r.leader = ""
+	r.votes = map[string]bool{s.sAddress: true}
+	r.resetDeadline()
+	if err := r.persist(); err != nil {
+		s.log.error("problem saving raft state", "error", err)
+		return
+	}
+	lastIndex, lastTerm := r.last()
+	req := voteRequest{Term: r.term, Candidate: s.sAddress, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+	s.log.info("standing for raft leader", "term", r.term)
+
+	// a group of one elects itself
+	if r.config.quorum(func(addr string) bool { return r.votes[addr] }) {
+		s.becomeLeader()
+		return
+	}
+	for _, addr := range r.config.all() {
+		if addr != s.sAddress {
+			go s.requestVote(addr, req)
+		}
+	}
+}
+
+// Helper function that asks one voter for its vote, and counts it
+func (s *Server) requestVote(replicaIP string, req voteRequest) {
+	r := s.raft
+	var res voteResponse
+	if err := s.raftCall(replicaIP, "/internal/raft/vote", req, &res); err != nil {
+		s.log.debug("raft vote request failed", "peer", replicaIP, "term", req.Term, "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if res.Term > r.term {
+		r.becomeFollower(res.Term)
+		r.persist()
+		return
+	}
+	if r.role != raftCandidate || r.term != req.Term || !res.Granted {
+		return
+	}
+	r.votes[replicaIP] = true
+	if r.config.quorum(func(addr string) bool { return r.votes[addr] }) {
+		s.becomeLeader()
+	}
+}
+
+// Helper function that takes over as leader after winning an election; must be called with r.mu held
+// The leader starts its term with an entry of its own, since entries of earlier terms only count as committed once
+// one of its own is
+func (s *Server) becomeLeader() {
+	r := s.raft
+	r.role = raftLeader
+	r.leader = s.sAddress
+	lastIndex, _ := r.last()
+	for _, addr := range r.config.all() {
+		r.nextIndex[addr] = lastIndex + 1
+		r.matchIndex[addr] = 0
+		// everyone voted or could have, so they count as heard from until they fail to answer
+		r.lastContact[addr] = time.Now()
+	}
+	r.appendLocked(raftCommand{Op: "noop"})
+	if err := r.persist(); err != nil {
+		s.log.error("problem saving raft state", "error", err)
+	}
+	s.log.info("became raft leader", "term", r.term)
+	s.advanceCommit()
+	go s.replicateRaft()
+}
+
+// Helper function that sends every other voter whatever it is missing of the leader's log, or a heartbeat
+func (s *Server) replicateRaft() {
+	r := s.raft
+	r.mu.Lock()
+	peers := r.config.all()
+	r.mu.Unlock()
+	for _, addr := range peers {
+		if addr != s.sAddress {
+			go s.sendAppend(addr)
+		}
+	}
+}
+
+// Helper function that sends one voter an append, one at a time per voter, and keeps going until it has the whole log
+func (s *Server) sendAppend(replicaIP string) {
+	r := s.raft
+	for {
+		r.mu.Lock()
+		if r.role != raftLeader || r.sending[replicaIP] {
+			r.mu.Unlock()
+			return
+		}
+		next, ok := r.nextIndex[replicaIP]
+		if !ok {
+			// a voter added since we became leader
+			next, _ = r.last()
+			next++
+			r.nextIndex[replicaIP] = next
+		}
+		// what it is missing is only in our snapshot now, so it gets that instead
+		if base, _ := r.base(); next <= base {
+			sent := s.sendSnapshot(replicaIP)
+			r.mu.Unlock()
+			if !sent {
+				return
+			}
+			continue
+		}
+		end, _ := r.last()
+		if end-next+1 > int64(raftMaxAppend) {
+			end = next - 1 + int64(raftMaxAppend)
+		}
+		req := appendRequest{
+			Term:         r.term,
+			Leader:       s.sAddress,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  r.termAt(next - 1),
+			Entries:      append([]raftEntry(nil), r.entries(next, end)...),
+			LeaderCommit: r.commitIndex,
+		}
+		r.sending[replicaIP] = true
+		r.mu.Unlock()
+
+		var res appendResponse
+		err := s.raftCall(replicaIP, "/internal/raft/append", req, &res)
+
+		r.mu.Lock()
+		r.sending[replicaIP] = false
+		if err != nil {
+			r.mu.Unlock()
+			return
+		}
+		if res.Term > r.term {
+			s.log.info("stepping down as raft leader", "term", r.term, "peer", replicaIP, "peer_term", res.Term)
+			r.becomeFollower(res.Term)
+			r.persist()
+			r.mu.Unlock()
+			return
+		}
+		if r.role != raftLeader || r.term != req.Term {
+			r.mu.Unlock()
+			return
+		}
+		r.lastContact[replicaIP] = time.Now()
+		if res.Success {
+			match := req.PrevLogIndex + int64(len(req.Entries))
+			if match > r.matchIndex[replicaIP] {
+				r.matchIndex[replicaIP] = match
+			}
+			r.nextIndex[replicaIP] = match + 1
+			s.advanceCommit()
+		} else {
+			// going back to where its log may match ours: no further than its last entry, and one step at least
+			next := req.PrevLogIndex
+			if res.LastIndex+1 < next {
+				next = res.LastIndex + 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			// that it matches the snapshot is a given; a follower that is behind it gets it next
+			if base, _ := r.base(); next <= base && res.LastIndex >= base {
+				next = base + 1
+			}
+			r.nextIndex[replicaIP] = next
+		}
+		lastIndex, _ := r.last()
+		more := r.nextIndex[replicaIP] <= lastIndex
+		r.mu.Unlock()
+		if !more {
+			return
+		}
+	}
+}
+
+// Helper function that commits every entry a quorum of the voters has, once one of them is from our term; a leader
+// that isn't a voter any more once its config is committed steps down. Must be called with r.mu held
+func (s *Server) advanceCommit() {
+	r := s.raft
+	lastIndex, _ := r.last()
+	for n := lastIndex; n > r.commitIndex; n-- {
+		if r.termAt(n) != r.term {
+			break
+		}
+		has := func(addr string) bool { return addr == s.sAddress || r.matchIndex[addr] >= n }
+		if r.config.quorum(has) {
+			r.commitIndex = n
+			select {
+			case r.applyWake <- struct{}{}:
+			default:
+			}
+			break
+		}
+	}
+
+	if r.role != raftLeader || !r.configCommitted() {
+		return
+	}
+	// a joint config whose change was cut short (e.g. by the leader that started it going down) is finished here
+	if len(r.config.Old) > 0 && !r.changingConfig {
+		s.log.info("finishing raft voter change", "voters", r.config.Voters)
+		r.appendLocked(raftCommand{Op: "config", Voters: r.config.Voters})
+		if err := r.persist(); err != nil {
+			s.log.error("problem saving raft state", "error", err)
+		}
+		return
+	}
+	if len(r.config.Old) == 0 && containsVal(s.sAddress, r.config.Voters) < 0 {
+		s.log.info("stepping down as raft leader, no longer a voter", "term", r.term)
+		r.role = raftFollower
+		r.leader = ""
+	}
+}
+
+// Helper function that checks if the latest config in the log is committed; must be called with r.mu held
+func (r *raftNode) configCommitted() bool {
+	for i := len(r.log) - 1; i >= 0; i-- {
+		if r.log[i].Command.Op == "config" {
+			return r.log[i].Index <= r.commitIndex
+		}
+	}
+	return true
+}
+
+// Used to apply every committed entry, in order, until the server stops; a snapshot further along than we have
+// applied (ours on startup, or one from the leader) is put in place first. Once enough entries have been applied, a
+// snapshot is taken of them
+func (s *Server) applyRaft() {
+	r := s.raft
+	for {
+		select {
+		case <-r.applyWake:
+		case <-s.done:
+			return
+		}
+
+		r.mu.Lock()
+		for r.snapshot != nil && r.snapshot.Index > r.lastApplied {
+			snap := r.snapshot
+			r.mu.Unlock()
+			s.mu.Lock()
+			s.restoreRaftSnapshot(snap)
+			s.mu.Unlock()
+
+			r.mu.Lock()
+			r.lastApplied = snap.Index
+			close(r.applied)
+			r.applied = make(chan struct{})
+			for index, waiter := range r.waiters {
+				if index <= snap.Index {
+					delete(r.waiters, index)
+					waiter.done <- errNoQuorum.saying("Proposal was overtaken by a raft snapshot; its outcome is unknown")
+				}
+			}
+		}
+		var entries []raftEntry
+		if r.commitIndex > r.lastApplied {
+			entries = append(entries, r.entries(r.lastApplied+1, r.commitIndex)...)
+		}
+		r.mu.Unlock()
+
+		for _, entry := range entries {
+			s.mu.Lock()
+			result := s.applyRaftCommand(entry)
+			s.mu.Unlock()
+
+			r.mu.Lock()
+			r.lastApplied = entry.Index
+			close(r.applied)
+			r.applied = make(chan struct{})
+			if waiter, ok := r.waiters[entry.Index]; ok {
+				delete(r.waiters, entry.Index)
+				if waiter.term == entry.Term {
+					waiter.result = result
+					waiter.done <- nil
+				} else {
+					waiter.done <- errNoQuorum.saying("Proposal was lost to a new raft leader; try again")
+				}
+			}
+			r.mu.Unlock()
+		}
+		s.snapshotRaft()
+	}
+}
+
+// Helper function that applies a committed entry: a change to our view (whose epoch is then the index of the last
+// entry applied to it, the same on every replica) or a write to a linearizable key, returning the write's result
+// Must be called with s.mu held
+func (s *Server) applyRaftCommand(entry raftEntry) string {
+	cmd := entry.Command
+	if cmd.Op == "put" || cmd.Op == "delete" {
+		return s.applyLinear(entry.Index, cmd)
+	}
+	// a view we were bootstrapped with already reflects every entry up to its epoch
+	if (cmd.Op == "view-add" || cmd.Op == "view-remove") && uint64(entry.Index) <= s.viewEpoch {
+		return ""
+	}
+	changed := false
+	switch cmd.Op {
+	case "view-add":
+		if !s.retired[cmd.Addr] && containsVal(cmd.Addr, s.replicaArray) < 0 {
+			s.replicaArray = append(s.replicaArray, cmd.Addr)
+			changed = true
+		}
+	case "view-remove":
+		if i := containsVal(cmd.Addr, s.replicaArray); i >= 0 {
+			s.replicaArray = removeVal(i, s.replicaArray)
+			changed = true
+		}
+	case "config":
+		s.log.info("raft voters changed", "index", entry.Index, "voters", cmd.Voters, "old", cmd.Old)
+		return ""
+	default:
+		return ""
+	}
+	s.observeViewEpoch(uint64(entry.Index))
+	if changed {
+		s.log.info("view changed by raft", "op", cmd.Op, "peer", cmd.Addr, "index", entry.Index, "view", s.replicaArray)
+	}
+	return ""
+}
+
+// Used to propose a command to the raft group, waiting until it is applied here or ctx is done
+// A replica that isn't the leader passes the proposal on to the leader (once; forwarded proposals aren't forwarded
+// again). A leader that hasn't heard from a quorum lately turns the proposal away at once rather than wait on it
+func (s *Server) propose(ctx context.Context, cmd raftCommand, forwarded bool) (raftOutcome, error) {
+	r := s.raft
+	r.mu.Lock()
+	if r.role != raftLeader {
+		leader := r.leader
+		r.mu.Unlock()
+		if leader == "" || forwarded {
+			return raftOutcome{}, errNoLeader
+		}
+		outcome, err := s.forwardProposal(ctx, leader, cmd)
+		if err == nil {
+			r.waitApplied(ctx, outcome.Index)
+		}
+		return outcome, err
+	}
+	if !r.quorumRecent(s.sAddress) {
+		r.mu.Unlock()
+		return raftOutcome{}, errNoQuorum
+	}
+	entry := r.appendLocked(cmd)
+	waiter := &raftWaiter{term: entry.Term, done: make(chan error, 1)}
+	r.waiters[entry.Index] = waiter
+	if err := r.persist(); err != nil {
+		r.mu.Unlock()
+		return raftOutcome{}, err
+	}
+	s.advanceCommit()
+	r.mu.Unlock()
+	s.replicateRaft()
+
+	select {
+	case err := <-waiter.done:
+		return raftOutcome{Index: entry.Index, Result: waiter.result}, err
+	case <-ctx.Done():
+		r.mu.Lock()
+		delete(r.waiters, entry.Index)
+		r.mu.Unlock()
+		return raftOutcome{}, errNoQuorum.because(ctx.Err())
+	}
+}
+
+// Helper function that checks if a quorum of the voters (us included) answered an append within the last election
+// timeout, without which nothing we append can be committed; must be called with r.mu held
+func (r *raftNode) quorumRecent(self string) bool {
+	return r.config.quorum(func(addr string) bool {
+		return addr == self || time.Since(r.lastContact[addr]) < r.electionTimeout
+	})
+}
+
+// Helper function that waits until we have applied the entry at the index too, or ctx is done; the entry is committed
+// by then, so it reaches us with the leader's next append either way. Returns ctx's error if it is done first
+func (r *raftNode) waitApplied(ctx context.Context, index int64) error {
+	for {
+		r.mu.Lock()
+		applied, wake := r.lastApplied, r.applied
+		r.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Helper function that passes a proposal on to the leader, answering whatever it answered
+func (s *Server) forwardProposal(ctx context.Context, leader string, cmd raftCommand) (raftOutcome, error) {
+	// a command always marshals
+	body, _ := json.Marshal(proposeRequest{Command: cmd})
+	var outcome raftOutcome
+	err := s.callLeader(ctx, leader, "/internal/raft/propose", body, &outcome)
+	return outcome, err
+}
+
+// Helper function that sends a request to the leader, decoding its answer into res; an error it answered with is
+// returned as the same error
+func (s *Server) callLeader(ctx context.Context, leader string, path string, body []byte, res interface{}) error {
+	status, answer, err := s.postPeer(ctx, s.internalAddress(leader), path, body)
+	if err != nil {
+		return errNoLeader.because(err)
+	}
+	if status != http.StatusOK {
+		var failure struct {
+			Code string `json:"code"`
+		}
+		json.Unmarshal(answer, &failure)
+		for _, known := range []*apiError{errNoLeader, errNoQuorum, errConfigChange} {
+			if failure.Code == known.Code {
+				return known
+			}
+		}
+		return errNoQuorum.because(fmt.Errorf("leader %s answered %d", leader, status))
+	}
+	return json.Unmarshal(answer, res)
+}
+
+// Helper function that calls fn until it doesn't fail with errNoLeader, for a few election timeouts at most or until
+// ctx is done; a group that is between leaders usually has a new one within an election timeout, so that is worth
+// waiting for, while one that has none after several likely can't elect one
+func (s *Server) untilLeader(ctx context.Context, fn func() error) error {
+	giveUp := time.Now().Add(4 * s.raft.electionTimeout)
+	for {
+		err := fn()
+		if !errors.Is(err, errNoLeader) || time.Now().After(giveUp) {
+			return err
+		}
+		select {
+		case <-time.After(s.raft.electionTimeout / 2):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Used to change the view through the raft group (op is "view-add" or "view-remove"), giving up after AnnounceTimeout
+func (s *Server) proposeView(ctx context.Context, op string, replicaIP string) error {
+	ctx, sp := s.tracer.start(ctx, "propose view change", spanInternal, "op", op, "peer", replicaIP)
+	defer sp.finish()
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.AnnounceTimeout)
+	defer cancel()
+
+	var outcome raftOutcome
+	err := s.untilLeader(ctx, func() (err error) {
+		outcome, err = s.propose(ctx, raftCommand{Op: op, Addr: replicaIP}, false)
+		return err
+	})
+	if err != nil {
+		sp.fail(err)
+		return err
+	}
+	sp.set("index", outcome.Index)
+	return nil
+}
+
+// Used to change who votes to the given replicas, through a joint config: first the old and new voters together, then
+// the new ones alone once that is committed. Only one change runs at a time. A replica that isn't the leader passes
+// the change on to the leader
+func (s *Server) changeConfig(ctx context.Context, voters []string, forwarded bool) error {
+	ctx, sp := s.tracer.start(ctx, "change raft voters", spanInternal, "voters", voters)
+	defer sp.finish()
+
+	r := s.raft
+	r.mu.Lock()
+	if r.role != raftLeader {
+		leader := r.leader
+		r.mu.Unlock()
+		if leader == "" || forwarded {
+			return errNoLeader
+		}
+		_, err := s.forwardProposal(ctx, leader, raftCommand{Op: "config", Voters: voters})
+		sp.fail(err)
+		return err
+	}
+	if r.changingConfig || len(r.config.Old) > 0 {
+		r.mu.Unlock()
+		return errConfigChange
+	}
+	old := append([]string(nil), r.config.Voters...)
+	if sameSet(old, voters) {
+		r.mu.Unlock()
+		return nil
+	}
+	r.changingConfig = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.changingConfig = false
+		r.mu.Unlock()
+	}()
+
+	s.log.info("changing raft voters", "old", old, "voters", voters)
+	if _, err := s.propose(ctx, raftCommand{Op: "config", Voters: voters, Old: old}, true); err != nil {
+		sp.fail(err)
+		return err
+	}
+	if _, err := s.propose(ctx, raftCommand{Op: "config", Voters: voters}, true); err != nil {
+		sp.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Helper function that checks if two lists hold the same replicas
+func sameSet(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, addr := range a {
+		if containsVal(addr, b) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function that sends a raft RPC to a replica, giving it half an election timeout to answer
+// Appends go out several times a second, so neither they nor votes are traced
+func (s *Server) raftCall(replicaIP string, path string, req interface{}, res interface{}) error {
+	ctx, cancel := context.WithTimeout(untraced(context.Background()), s.raft.electionTimeout/2)
+	defer cancel()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	status, answer, err := s.postPeer(ctx, s.internalAddress(replicaIP), path, body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%s answered %d", path, status)
+	}
+	return json.Unmarshal(answer, res)
+}
+
+// Handler function that answers a candidate's request for our vote
+// We vote for at most one candidate a term, and only for one whose log is at least as up to date as ours. While we
+// are or hear from a leader, we don't vote at all, so a replica that was taken out of the group can't disrupt it
+func (s *Server) handleRaftVote(w http.ResponseWriter, req *http.Request) error {
+	var vote voteRequest
+	if err := json.NewDecoder(req.Body).Decode(&vote); err != nil {
+		return errInvalidJSON.because(err)
+	}
+
+	r := s.raft
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role == raftLeader || (r.role == raftFollower && r.leader != "" && time.Since(r.lastHeard) < r.electionTimeout) {
+		writeJSON(w, http.StatusOK, voteResponse{Term: r.term})
+		return nil
+	}
+	if vote.Term > r.term {
+		r.becomeFollower(vote.Term)
+		r.leader = ""
+	}
+
+	lastIndex, lastTerm := r.last()
+	upToDate := vote.LastLogTerm > lastTerm || (vote.LastLogTerm == lastTerm && vote.LastLogIndex >= lastIndex)
+	granted := vote.Term == r.term && (r.votedFor == "" || r.votedFor == vote.Candidate) && upToDate
+	if granted {
+		r.votedFor = vote.Candidate
+		r.resetDeadline()
+	}
+	if err := r.persist(); err != nil {
+		return err
+	}
+	if granted {
+		loggerFrom(req.Context()).info("voted for raft leader", "candidate", vote.Candidate, "term", vote.Term)
+	}
+	writeJSON(w, http.StatusOK, voteResponse{Term: r.term, Granted: granted})
+	return nil
+}
+
+// Handler function that takes entries (or a heartbeat) from the leader
+// Entries are only taken if our log matches the leader's up to the one before them; an entry that conflicts with one
+// of ours replaces it, along with everything after it
+func (s *Server) handleRaftAppend(w http.ResponseWriter, req *http.Request) error {
+	var app appendRequest
+	if err := json.NewDecoder(req.Body).Decode(&app); err != nil {
+		return errInvalidJSON.because(err)
+	}
+
+	r := s.raft
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lastIndex, _ := r.last()
+	if !s.heardFromLeader(req, app.Term, app.Leader) {
+		writeJSON(w, http.StatusOK, appendResponse{Term: r.term, LastIndex: lastIndex})
+		return nil
+	}
+
+	// the entries our snapshot has are committed, so they match the leader's; only the ones after it are looked at
+	if base, baseTerm := r.base(); app.PrevLogIndex < base {
+		match := app.PrevLogIndex + int64(len(app.Entries))
+		if match <= base {
+			writeJSON(w, http.StatusOK, appendResponse{Term: r.term, Success: true, LastIndex: match})
+			return nil
+		}
+		app.Entries = app.Entries[base-app.PrevLogIndex:]
+		app.PrevLogIndex, app.PrevLogTerm = base, baseTerm
+	}
+
+	if app.PrevLogIndex > lastIndex || r.termAt(app.PrevLogIndex) != app.PrevLogTerm {
+		if app.PrevLogIndex <= lastIndex {
+			lastIndex = app.PrevLogIndex - 1
+		}
+		if err := r.persist(); err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, appendResponse{Term: r.term, LastIndex: lastIndex})
+		return nil
+	}
+
+	for _, entry := range app.Entries {
+		if last, _ := r.last(); entry.Index <= last {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			if err := r.truncateLog(entry.Index); err != nil {
+				return err
+			}
+		}
+		r.log = append(r.log, entry)
+	}
+	r.updateConfig()
+	if err := r.persist(); err != nil {
+		return err
+	}
+
+	match := app.PrevLogIndex + int64(len(app.Entries))
+	if app.LeaderCommit > r.commitIndex {
+		r.commitIndex = app.LeaderCommit
+		if r.commitIndex > match {
+			r.commitIndex = match
+		}
+		select {
+		case r.applyWake <- struct{}{}:
+		default:
+		}
+	}
+	writeJSON(w, http.StatusOK, appendResponse{Term: r.term, Success: true, LastIndex: match})
+	return nil
+}
+
+// Helper function that checks if a request from a leader (an append or a snapshot) is of our term or a later one, and
+// if it is, follows that leader; must be called with r.mu held
+func (s *Server) heardFromLeader(req *http.Request, term uint64, leader string) bool {
+	r := s.raft
+	if term < r.term {
+		return false
+	}
+	if term > r.term || r.role != raftFollower {
+		r.becomeFollower(term)
+	}
+	if r.leader != leader {
+		loggerFrom(req.Context()).info("following raft leader", "leader", leader, "term", term)
+	}
+	r.leader = leader
+	r.lastHeard = time.Now()
+	r.resetDeadline()
+	return true
+}
+
+// Handler function that takes a proposal another replica passed on to us as the leader, answering once it is applied
+func (s *Server) handleRaftPropose(w http.ResponseWriter, req *http.Request) error {
+	var prop proposeRequest
+	if err := json.NewDecoder(req.Body).Decode(&prop); err != nil {
+		return errInvalidJSON.because(err)
+	}
+
+	var outcome raftOutcome
+	var err error
+	switch prop.Command.Op {
+	case "view-add", "view-remove", "put", "delete":
+		outcome, err = s.propose(req.Context(), prop.Command, true)
+	case "config":
+		err = s.changeConfig(req.Context(), prop.Command.Voters, true)
+	default:
+		return errInvalidMessage.saying("Unknown raft command")
+	}
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, outcome)
+	return nil
+}
+
+// Used to find out how far the log has to be applied for a read to see every write committed before the read began
+// (its read index): the leader's commit index, once it has checked with a quorum that it is still the leader. A
+// follower asks the leader for it
+func (s *Server) readIndex(ctx context.Context) (int64, error) {
+	r := s.raft
+	r.mu.Lock()
+	leader, isLeader := r.leader, r.role == raftLeader
+	r.mu.Unlock()
+	if isLeader {
+		return s.leaderReadIndex(ctx)
+	}
+	if leader == "" {
+		return 0, errNoLeader
+	}
+	var outcome raftOutcome
+	err := s.callLeader(ctx, leader, "/internal/raft/read-index", []byte("{}"), &outcome)
+	return outcome.Index, err
+}
+
+// Helper function that works out the read index as the leader: our commit index (or the first entry of our term, if
+// that isn't committed yet, since we may not know of everything committed before it until it is), confirmed by a
+// quorum answering a heartbeat in our term, so no newer leader can have committed anything we don't know of
+func (s *Server) leaderReadIndex(ctx context.Context) (int64, error) {
+	r := s.raft
+	r.mu.Lock()
+	if r.role != raftLeader {
+		r.mu.Unlock()
+		return 0, errNoLeader
+	}
+	if !r.quorumRecent(s.sAddress) {
+		r.mu.Unlock()
+		return 0, errNoQuorum
+	}
+	index := r.commitIndex
+	lastIndex, _ := r.last()
+	for _, entry := range r.entries(index+1, lastIndex) {
+		if entry.Term == r.term {
+			index = entry.Index
+			break
+		}
+	}
+	term := r.term
+	config := raftConfig{Voters: r.config.Voters, Old: r.config.Old}
+	heartbeats := make(map[string]appendRequest)
+	for _, addr := range config.all() {
+		if addr == s.sAddress {
+			continue
+		}
+		prev := r.matchIndex[addr]
+		heartbeats[addr] = appendRequest{Term: term, Leader: s.sAddress, PrevLogIndex: prev, PrevLogTerm: r.termAt(prev), LeaderCommit: r.commitIndex}
+	}
+	r.mu.Unlock()
+
+	type answer struct {
+		addr string
+		res  appendResponse
+		err  error
+	}
+	answers := make(chan answer, len(heartbeats))
+	for addr, heartbeat := range heartbeats {
+		go func(addr string, heartbeat appendRequest) {
+			var res appendResponse
+			err := s.raftCall(addr, "/internal/raft/append", heartbeat, &res)
+			answers <- answer{addr: addr, res: res, err: err}
+		}(addr, heartbeat)
+	}
+
+	acked := map[string]bool{s.sAddress: true}
+	for range heartbeats {
+		if config.quorum(func(addr string) bool { return acked[addr] }) {
+			break
+		}
+		var a answer
+		select {
+		case a = <-answers:
+		case <-ctx.Done():
+			return 0, errNoQuorum.because(ctx.Err())
+		}
+		if a.err != nil {
+			continue
+		}
+		if a.res.Term > term {
+			r.mu.Lock()
+			if a.res.Term > r.term {
+				r.becomeFollower(a.res.Term)
+				r.persist()
+			}
+			r.mu.Unlock()
+			return 0, errNoLeader
+		}
+		if a.res.Term == term {
+			acked[a.addr] = true
+		}
+	}
+	if !config.quorum(func(addr string) bool { return acked[addr] }) {
+		return 0, errNoQuorum
+	}
+	return index, nil
+}
+
+// Handler function that answers a follower's request for a read index, as the leader
+func (s *Server) handleRaftReadIndex(w http.ResponseWriter, req *http.Request) error {
+	index, err := s.leaderReadIndex(req.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, raftOutcome{Index: index})
+	return nil
+}
+
+// Handler function that reports where the raft group stands from here: our role and term, who the leader is, the
+// voters, how far the log is committed and applied, and (on the leader) how far each voter has the log
+func (s *Server) handleLeader(w http.ResponseWriter, req *http.Request) error {
+	if s.raft == nil {
+		return errConsensusOff
+	}
+	writeJSON(w, http.StatusOK, s.raftStatus(true))
+	return nil
+}
+
+// Helper function that returns what handleLeader reports, without how far each voter has the log unless detailed
+func (s *Server) raftStatus(detailed bool) map[string]interface{} {
+	r := s.raft
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lastIndex, _ := r.last()
+	base, _ := r.base()
+	status := map[string]interface{}{
+		"replica":      s.sAddress,
+		"role":         r.role.String(),
+		"term":         r.term,
+		"leader":       r.leader,
+		"commit-index": r.commitIndex,
+		"applied":      r.lastApplied,
+		"last-index":   lastIndex,
+		"snapshot":     base,
+		"voters":       append([]string(nil), r.config.Voters...),
+	}
+	if len(r.config.Old) > 0 {
+		status["old-voters"] = append([]string(nil), r.config.Old...)
+	}
+	if r.leader == "" {
+		status["leader"] = nil
+	}
+	if detailed && r.role == raftLeader {
+		progress := make(map[string]interface{})
+		addrs := r.config.all()
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			if addr != s.sAddress {
+				progress[addr] = map[string]int64{"match-index": r.matchIndex[addr], "next-index": r.nextIndex[addr]}
+			}
+		}
+		status["progress"] = progress
+	}
+	return status
+}
+
+// Helper function that returns the leader we know of, or "" if we don't know of one
+func (s *Server) raftLeader() string {
+	r := s.raft
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader
+}
+
+// Used by recovery to put ourselves back in the view through the group, once it has a leader; keeps trying (less and
+// less often) until it has, or the replica stops
+func (s *Server) rejoinRaft(ctx context.Context) {
+	wait := s.raft.electionTimeout
+	for {
+		err := s.proposeView(ctx, "view-add", s.sAddress)
+		if err == nil {
+			return
+		}
+		s.log.warn("could not put ourselves back in the view", "error", err, "retry_in", wait.String())
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+			return
+		}
+		if wait < 8*s.raft.electionTimeout {
+			wait *= 2
+		}
+	}
+}
+
+// Helper function that returns the voters of the latest config, with addr added (add) or taken out (!add)
+func (s *Server) votersWith(addr string, add bool) []string {
+	r := s.raft
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var voters []string
+	for _, voter := range r.config.Voters {
+		if voter != addr {
+			voters = append(voters, voter)
+		}
+	}
+	if add {
+		voters = append(voters, addr)
+	}
+	return voters
+}
+
+// Used once a replica has been added to the cluster, to make it a voter and put it in the view through the group
+// The membership change has already been applied on every replica (and the replica is in their views, so it gets every
+// write from then on); this gets the group to agree on it
+func (s *Server) joinRaft(ctx context.Context, addr string) error {
+	if err := s.changeConfig(ctx, s.votersWith(addr, true), false); err != nil {
+		return err
+	}
+	return s.proposeView(ctx, "view-add", addr)
+}
+
+// Used by a replica leaving the cluster, once its writes are handed off, to take itself out of the view and then the
+// voters through the group; the view goes first, since a replica that is no longer a voter hears nothing more from the
+// leader. If it is the leader, it stays one until the group without it has agreed on that
+func (s *Server) leaveRaft(ctx context.Context) error {
+	if err := s.proposeView(ctx, "view-remove", s.sAddress); err != nil {
+		return err
+	}
+	return s.changeConfig(ctx, s.votersWith(s.sAddress, false), false)
+}
@@ -0,0 +1,263 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/clevalle/CSE138_Assignment3/client"
+)
+
+func TestRaftConfigQuorum(t *testing.T) {
+	tests := []struct {
+		name   string
+		config raftConfig
+		has    []string
+		want   bool
+	}{
+		{name: "one of one", config: raftConfig{Voters: []string{"a"}}, has: []string{"a"}, want: true},
+		{name: "two of three", config: raftConfig{Voters: []string{"a", "b", "c"}}, has: []string{"a", "c"}, want: true},
+		{name: "one of three", config: raftConfig{Voters: []string{"a", "b", "c"}}, has: []string{"b"}},
+		{name: "half of four", config: raftConfig{Voters: []string{"a", "b", "c", "d"}}, has: []string{"a", "b"}},
+		{name: "others don't count", config: raftConfig{Voters: []string{"a", "b", "c"}}, has: []string{"a", "x", "y"}},
+		{name: "joint, both halves", config: raftConfig{Voters: []string{"a", "b", "c", "d"}, Old: []string{"a", "b", "c"}},
+			has: []string{"a", "b", "d"}, want: true},
+		{name: "joint, new half only", config: raftConfig{Voters: []string{"b", "c", "d"}, Old: []string{"a", "b", "e"}},
+			has: []string{"c", "d"}},
+		{name: "joint, old half only", config: raftConfig{Voters: []string{"b", "c", "d"}, Old: []string{"a", "b", "e"}},
+			has: []string{"a", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			has := func(addr string) bool { return containsVal(addr, tt.has) >= 0 }
+			if got := tt.config.quorum(has); got != tt.want {
+				t.Errorf("quorum(%v) = %v, want %v", tt.has, got, tt.want)
+			}
+		})
+	}
+}
+
+// Helper function that appends n entries of the term to the node's log, as a leader would
+func appendEntries(r *raftNode, term uint64, n int) {
+	r.term = term
+	for i := 0; i < n; i++ {
+		r.appendLocked(raftCommand{Op: "put", Key: fmt.Sprintf("k%d", i), Value: "v"})
+	}
+}
+
+// Whatever a node persisted is what it finds again when it starts over from the same dir
+func TestRaftLogPersistence(t *testing.T) {
+	voters := []string{"a", "b", "c"}
+	tests := []struct {
+		name      string
+		before    func(t *testing.T, dir string) // what is in the dir before the node first opens it
+		change    func(t *testing.T, r *raftNode)
+		wantTerm  uint64
+		wantVote  string
+		wantBase  int64
+		wantTerms []uint64 // of the entries after the snapshot, one per entry
+	}{
+		{
+			name: "appended",
+			change: func(t *testing.T, r *raftNode) {
+				appendEntries(r, 1, 3)
+				r.votedFor = "b"
+			},
+			wantTerm: 1, wantVote: "b", wantTerms: []uint64{1, 1, 1},
+		},
+		{
+			name: "appended in batches",
+			change: func(t *testing.T, r *raftNode) {
+				appendEntries(r, 1, 2)
+				if err := r.persist(); err != nil {
+					t.Fatal(err)
+				}
+				appendEntries(r, 2, 2)
+			},
+			wantTerm: 2, wantTerms: []uint64{1, 1, 2, 2},
+		},
+		{
+			name: "conflicting entries dropped",
+			change: func(t *testing.T, r *raftNode) {
+				appendEntries(r, 1, 5)
+				if err := r.persist(); err != nil {
+					t.Fatal(err)
+				}
+				if err := r.truncateLog(4); err != nil {
+					t.Fatal(err)
+				}
+				appendEntries(r, 3, 1)
+			},
+			wantTerm: 3, wantTerms: []uint64{1, 1, 1, 3},
+		},
+		{
+			name: "compacted",
+			change: func(t *testing.T, r *raftNode) {
+				appendEntries(r, 1, 5)
+				if err := r.persist(); err != nil {
+					t.Fatal(err)
+				}
+				if err := r.compact(&raftSnapshot{Index: 3, Term: 1, Config: raftConfig{Voters: voters}}); err != nil {
+					t.Fatal(err)
+				}
+				appendEntries(r, 2, 1)
+			},
+			wantTerm: 2, wantBase: 3, wantTerms: []uint64{1, 1, 2},
+		},
+		{
+			name: "snapshot past the log",
+			change: func(t *testing.T, r *raftNode) {
+				appendEntries(r, 1, 2)
+				if err := r.persist(); err != nil {
+					t.Fatal(err)
+				}
+				if err := r.compact(&raftSnapshot{Index: 8, Term: 2, Config: raftConfig{Voters: voters}}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantTerm: 1, wantBase: 8,
+		},
+		{
+			name: "partial last line",
+			change: func(t *testing.T, r *raftNode) {
+				appendEntries(r, 1, 2)
+				if err := r.persist(); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := r.logFile.WriteAt([]byte(`{"index":3,"te`), r.logEnd); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantTerm: 1, wantTerms: []uint64{1, 1},
+		},
+		{
+			name: "log in an old raft.json",
+			before: func(t *testing.T, dir string) {
+				data, _ := json.Marshal(raftState{Term: 4, VotedFor: "c", Log: []raftEntry{
+					{Index: 1, Term: 2, Command: raftCommand{Op: "noop"}},
+					{Index: 2, Term: 4, Command: raftCommand{Op: "noop"}},
+				}})
+				if err := os.WriteFile(filepath.Join(dir, raftStateFile), data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantTerm: 4, wantVote: "c", wantTerms: []uint64{2, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.before != nil {
+				tt.before(t, dir)
+			}
+
+			r, err := newRaftNode(dir, voters, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				tt.change(t, r)
+			}
+			if err := r.persist(); err != nil {
+				t.Fatal(err)
+			}
+			r.close()
+
+			r, err = newRaftNode(dir, voters, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.close()
+
+			base, _ := r.base()
+			var terms []uint64
+			for i, entry := range r.log {
+				if entry.Index != base+int64(i)+1 {
+					t.Errorf("entry %d has index %d, want %d", i, entry.Index, base+int64(i)+1)
+				}
+				terms = append(terms, entry.Term)
+			}
+			if r.term != tt.wantTerm || r.votedFor != tt.wantVote {
+				t.Errorf("term %d, vote %q; want term %d, vote %q", r.term, r.votedFor, tt.wantTerm, tt.wantVote)
+			}
+			if base != tt.wantBase || !reflect.DeepEqual(terms, tt.wantTerms) {
+				t.Errorf("snapshot of %d, then terms %v; want snapshot of %d, then terms %v", base, terms, tt.wantBase, tt.wantTerms)
+			}
+
+			// an old raft.json is left with only the term and vote
+			var state raftState
+			if data, err := os.ReadFile(filepath.Join(dir, raftStateFile)); err == nil {
+				json.Unmarshal(data, &state)
+			}
+			if len(state.Log) > 0 {
+				t.Errorf("%s still has a log of %d entries", raftStateFile, len(state.Log))
+			}
+		})
+	}
+}
+
+// Linearizable writes go through the raft group, which snapshots what it applied; a replica that was down while the
+// group moved past its log catches up from the snapshot when it comes back
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	configs := make([]Config, 3)
+	servers := startCluster(t, 3, func(i int, cfg *Config) {
+		cfg.Consensus = "raft"
+		cfg.LinearizablePrefixes = []string{"lin-"}
+		configs[i] = *cfg
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	put := func(s *Server, key string, val string) {
+		t.Helper()
+		if _, err := client.NewSession(s.sAddress).Put(ctx, key, val); err != nil {
+			t.Fatalf("PUT %s on %s: %v", key, s.sAddress, err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		put(servers[i%2], fmt.Sprintf("lin-%d", i), fmt.Sprint(i))
+	}
+
+	// taking the last replica down while the others carry on past a few more snapshots
+	down := servers[2]
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	down.Shutdown(shutdownCtx)
+	shutdownCancel()
+	for i := 8; i < 20; i++ {
+		put(servers[i%2], fmt.Sprintf("lin-%d", i), fmt.Sprint(i))
+	}
+	for _, s := range servers[:2] {
+		s.raft.mu.Lock()
+		base, _ := s.raft.base()
+		s.raft.mu.Unlock()
+		if base == 0 {
+			t.Errorf("%s took no snapshot", s.sAddress)
+		}
+	}
+
+	cfg := configs[2]
+	cfg.Listener = nil
+	cfg.ListenAddress = cfg.SocketAddress
+	back := newServer(t, cfg)
+	if err := back.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, 10*time.Second, "the replica to catch up", func() bool {
+		back.mu.Lock()
+		defer back.mu.Unlock()
+		return back.linear["lin-19"].Value == "19"
+	})
+	session := client.NewSession(back.sAddress)
+	for i := 0; i < 20; i++ {
+		val, err := session.Get(ctx, fmt.Sprintf("lin-%d", i))
+		if err != nil || val != fmt.Sprint(i) {
+			t.Errorf("GET lin-%d = %v, %v; want %d", i, val, err, i)
+		}
+	}
+}
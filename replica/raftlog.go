@@ -0,0 +1,447 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// The raft group's log is kept in three files in the data dir: term and vote, rewritten whole (and synced) whenever
+// they change; the entries, one per line, which are only ever appended to (and synced) except when the leader has
+// us drop a few that conflict with its own; and a snapshot of what every entry up to some index left behind. Once
+// raftSnapshotEvery entries have been applied since the last snapshot, a new one is taken and the entries it covers
+// are dropped, and a follower too far behind to be sent the entries it is missing is sent the snapshot instead
+
+// the files the raft group is kept in, in the data dir
+const (
+	raftStateFile    = "raft.json"
+	raftLogFile      = "raft.log.jsonl"
+	raftSnapshotFile = "raft.snapshot.json"
+)
+
+// how many applied entries we keep before taking a snapshot of them
+var raftSnapshotEvery int64 = 1000
+
+// raftState is the part of what is kept on disk that is rewritten whole, so a replica never votes twice in a term
+// A raft.json from before the log had a file of its own also has the log in it, which is moved out on startup
+type raftState struct {
+	Term     uint64      `json:"term"`
+	VotedFor string      `json:"voted-for"`
+	Log      []raftEntry `json:"log,omitempty"`
+}
+
+// raftSnapshot is what every entry up to Index left behind: the voters, the view and the linearizable keys
+type raftSnapshot struct {
+	Index     int64                  `json:"index"`
+	Term      uint64                 `json:"term"`
+	Config    raftConfig             `json:"config"`
+	View      []string               `json:"view"`
+	ViewEpoch uint64                 `json:"view-epoch"`
+	Linear    map[string]linearValue `json:"linear"`
+}
+
+// the body of the request the leader sends to /internal/raft/snapshot; it is answered with an appendResponse
+type snapshotRequest struct {
+	Term     uint64       `json:"term"`
+	Leader   string       `json:"leader"`
+	Snapshot raftSnapshot `json:"snapshot"`
+}
+
+// Helper function that reads term, vote, snapshot and log from dir, moving the log out of an old raft.json
+func (r *raftNode) load(dir string) error {
+	r.dir = dir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var legacy []raftEntry
+	data, err := os.ReadFile(filepath.Join(dir, raftStateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		var state raftState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("%s: %w", raftStateFile, err)
+		}
+		r.term, r.votedFor, legacy = state.Term, state.VotedFor, state.Log
+		r.savedTerm, r.savedVote = r.term, r.votedFor
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, raftSnapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		var snap raftSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("%s: %w", raftSnapshotFile, err)
+		}
+		r.snapshot = &snap
+		r.commitIndex = snap.Index
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	r.logFile = file
+
+	// reading every entry after the snapshot, stopping at the first one we can't read (a crash halfway through a
+	// write leaves a partial last line, which is cut off), and leaving out the ones the snapshot already has (a
+	// crash between saving a snapshot and rewriting the log leaves them behind)
+	var offset int64
+	base, _ := r.base()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var entry raftEntry
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+		if entry.Index > base {
+			r.log = append(r.log, entry)
+			r.onDisk = append(r.onDisk, offset)
+		}
+		offset += int64(len(line))
+	}
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	r.logEnd = offset
+	if len(r.log) > 0 && r.log[0].Index != base+1 {
+		return fmt.Errorf("%s: starts at entry %d, after a snapshot of %d", raftLogFile, r.log[0].Index, base)
+	}
+
+	if len(legacy) > 0 {
+		if len(r.log) > 0 || r.snapshot != nil {
+			return fmt.Errorf("%s: has a log, and so does %s", raftStateFile, raftLogFile)
+		}
+		r.log = legacy
+		if err := r.persist(); err != nil {
+			return err
+		}
+		// rewriting raft.json without the log, now that it is in a file of its own
+		if err := r.saveState(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function that writes whatever changed of term, vote and log to disk, and syncs it; must be called with
+// r.mu held
+// A replica that can't keep its promises mustn't make any, so nothing is sent or answered if they can't be written
+func (r *raftNode) persist() error {
+	if r.dir == "" {
+		return nil
+	}
+	if r.term != r.savedTerm || r.votedFor != r.savedVote {
+		if err := r.saveState(); err != nil {
+			return err
+		}
+	}
+	if len(r.onDisk) == len(r.log) {
+		return nil
+	}
+	if r.logFile == nil {
+		return errors.New("raft log is closed")
+	}
+
+	var data []byte
+	offset, written := r.logEnd, len(r.onDisk)
+	for _, entry := range r.log[len(r.onDisk):] {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		r.onDisk = append(r.onDisk, offset+int64(len(data)))
+		data = append(append(data, line...), '\n')
+	}
+	if _, err := r.logFile.WriteAt(data, offset); err != nil {
+		r.onDisk = r.onDisk[:written]
+		return err
+	}
+	r.logEnd += int64(len(data))
+	return r.logFile.Sync()
+}
+
+// Helper function that rewrites raft.json with our term and vote; must be called with r.mu held
+func (r *raftNode) saveState() error {
+	// a state always marshals
+	data, _ := json.Marshal(raftState{Term: r.term, VotedFor: r.votedFor})
+	if err := writeFileSynced(filepath.Join(r.dir, raftStateFile), append(data, '\n')); err != nil {
+		return err
+	}
+	r.savedTerm, r.savedVote = r.term, r.votedFor
+	return nil
+}
+
+// Helper function that drops the entries from the index on, from the log and from disk; must be called with r.mu held
+func (r *raftNode) truncateLog(index int64) error {
+	base, _ := r.base()
+	keep := int(index - base - 1)
+	if keep < len(r.onDisk) {
+		if r.logFile == nil {
+			return errors.New("raft log is closed")
+		}
+		if err := r.logFile.Truncate(r.onDisk[keep]); err != nil {
+			return err
+		}
+		r.logEnd = r.onDisk[keep]
+		r.onDisk = r.onDisk[:keep]
+	}
+	r.log = r.log[:keep]
+	return nil
+}
+
+// Helper function that closes the log file; nothing can be persisted after. Must be called with r.mu held
+func (r *raftNode) close() error {
+	if r.logFile == nil {
+		return nil
+	}
+	err := r.logFile.Close()
+	r.logFile = nil
+	return err
+}
+
+// Helper function that returns the index and term of the last entry the snapshot has (0 and 0 without one); must be
+// called with r.mu held
+func (r *raftNode) base() (int64, uint64) {
+	if r.snapshot == nil {
+		return 0, 0
+	}
+	return r.snapshot.Index, r.snapshot.Term
+}
+
+// Helper function that returns the entries from index from to index to, both included; they must be in the log, not
+// the snapshot. Must be called with r.mu held
+func (r *raftNode) entries(from int64, to int64) []raftEntry {
+	base, _ := r.base()
+	return r.log[from-base-1 : to-base]
+}
+
+// Helper function that makes snap our snapshot, dropping every entry it has from the log; the entries after it are
+// kept only if the one it ends with is ours too. The snapshot is on disk before the log is rewritten without them
+// Must be called with r.mu held
+func (r *raftNode) compact(snap *raftSnapshot) error {
+	var rest []raftEntry
+	if lastIndex, _ := r.last(); snap.Index <= lastIndex && r.termAt(snap.Index) == snap.Term {
+		rest = append(rest, r.entries(snap.Index+1, lastIndex)...)
+	}
+
+	if r.dir != "" {
+		if r.logFile == nil {
+			return errors.New("raft log is closed")
+		}
+		// a snapshot always marshals
+		data, _ := json.Marshal(snap)
+		if err := writeFileSynced(filepath.Join(r.dir, raftSnapshotFile), append(data, '\n')); err != nil {
+			return err
+		}
+
+		var lines []byte
+		var offsets []int64
+		for _, entry := range rest {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			offsets = append(offsets, int64(len(lines)))
+			lines = append(append(lines, line...), '\n')
+		}
+		path := filepath.Join(r.dir, raftLogFile)
+		if err := writeFileSynced(path, lines); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		r.logFile.Close()
+		r.logFile, r.onDisk, r.logEnd = file, offsets, int64(len(lines))
+	}
+
+	r.snapshot = snap
+	r.log = rest
+	if r.commitIndex < snap.Index {
+		r.commitIndex = snap.Index
+	}
+	r.updateConfig()
+	return nil
+}
+
+// Helper function that returns the voters as of the entry at the index, which must be in the log or the snapshot
+// Must be called with r.mu held
+func (r *raftNode) configAt(index int64) raftConfig {
+	base, _ := r.base()
+	for i := index - base - 1; i >= 0; i-- {
+		if cmd := r.log[i].Command; cmd.Op == "config" {
+			return raftConfig{Voters: cmd.Voters, Old: cmd.Old}
+		}
+	}
+	if r.snapshot != nil {
+		return r.snapshot.Config
+	}
+	return r.initial
+}
+
+// Used once we have applied raftSnapshotEvery entries since the last snapshot, to take a new one of what they left
+// behind; only applyRaft calls it, so nothing is applied meanwhile
+func (s *Server) snapshotRaft() {
+	r := s.raft
+	r.mu.Lock()
+	base, _ := r.base()
+	due := r.lastApplied-base >= raftSnapshotEvery
+	r.mu.Unlock()
+	if !due {
+		return
+	}
+
+	s.mu.Lock()
+	snap := &raftSnapshot{
+		View:      append([]string(nil), s.replicaArray...),
+		ViewEpoch: s.viewEpoch,
+		Linear:    make(map[string]linearValue, len(s.linear)),
+	}
+	for key, val := range s.linear {
+		snap.Linear[key] = val
+	}
+	s.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if base, _ := r.base(); r.lastApplied <= base {
+		// the leader sent us a snapshot meanwhile
+		return
+	}
+	snap.Index = r.lastApplied
+	snap.Term = r.termAt(snap.Index)
+	snap.Config = r.configAt(snap.Index)
+	if err := r.compact(snap); err != nil {
+		s.log.error("problem saving raft snapshot", "index", snap.Index, "error", err)
+		return
+	}
+	s.log.info("took raft snapshot", "index", snap.Index, "term", snap.Term, "kept", len(r.log))
+}
+
+// Helper function that puts the state a snapshot holds in place of ours, once it is further along than we are; the
+// linearizable keys it changes are put in the operation log, as applying the entries would have (and, like them, are
+// only missing from the streams if the log has failed). Must be called with s.mu held
+func (s *Server) restoreRaftSnapshot(snap *raftSnapshot) {
+	if snap.Index > s.linearLogged {
+		clock := s.localVector.clone()
+		for key, val := range snap.Linear {
+			if old, ok := s.linear[key]; ok && old.ExpiresAt == val.ExpiresAt && reflect.DeepEqual(old.Value, val.Value) {
+				continue
+			}
+			entry := logEntry{Key: key, Op: "put", Value: val.Value, VectorClock: clock, Origin: s.vectorIndex, RaftIndex: snap.Index}
+			if val.ExpiresAt != 0 {
+				expiresAt := val.ExpiresAt
+				entry.ExpiresAt = &expiresAt
+			}
+			s.appendLog(entry)
+		}
+		for key := range s.linear {
+			if _, ok := snap.Linear[key]; !ok {
+				s.appendLog(logEntry{Key: key, Op: "delete", VectorClock: clock, Origin: s.vectorIndex, RaftIndex: snap.Index})
+			}
+		}
+		s.linearLogged = snap.Index
+	}
+	s.linear = make(map[string]linearValue, len(snap.Linear))
+	for key, val := range snap.Linear {
+		s.linear[key] = val
+	}
+
+	if s.observeViewEpoch(snap.ViewEpoch) {
+		var view []string
+		for _, addr := range snap.View {
+			if !s.retired[addr] {
+				view = append(view, addr)
+			}
+		}
+		s.replicaArray = view
+		s.log.info("view changed by raft snapshot", "index", snap.Index, "view", s.replicaArray)
+	}
+}
+
+// Helper function that sends one voter our snapshot, since the entries it is missing are gone from our log
+// Must be called with r.mu held, and returns with it held; it is let go of while the snapshot is sent
+func (s *Server) sendSnapshot(replicaIP string) bool {
+	r := s.raft
+	req := snapshotRequest{Term: r.term, Leader: s.sAddress, Snapshot: *r.snapshot}
+	r.sending[replicaIP] = true
+	r.mu.Unlock()
+
+	var res appendResponse
+	err := s.raftCall(replicaIP, "/internal/raft/snapshot", req, &res)
+
+	r.mu.Lock()
+	r.sending[replicaIP] = false
+	if err != nil {
+		s.log.debug("raft snapshot failed", "peer", replicaIP, "index", req.Snapshot.Index, "error", err)
+		return false
+	}
+	if res.Term > r.term {
+		s.log.info("stepping down as raft leader", "term", r.term, "peer", replicaIP, "peer_term", res.Term)
+		r.becomeFollower(res.Term)
+		r.persist()
+		return false
+	}
+	if r.role != raftLeader || r.term != req.Term || !res.Success {
+		return false
+	}
+	r.lastContact[replicaIP] = time.Now()
+	if req.Snapshot.Index > r.matchIndex[replicaIP] {
+		r.matchIndex[replicaIP] = req.Snapshot.Index
+	}
+	r.nextIndex[replicaIP] = req.Snapshot.Index + 1
+	s.log.info("sent raft snapshot", "peer", replicaIP, "index", req.Snapshot.Index)
+	s.advanceCommit()
+	return true
+}
+
+// Handler function that takes a snapshot from the leader, which sends one when the entries we are missing are gone
+// from its log; applyRaft puts it in place of our state once it is saved
+func (s *Server) handleRaftSnapshot(w http.ResponseWriter, req *http.Request) error {
+	var inst snapshotRequest
+	if err := json.NewDecoder(req.Body).Decode(&inst); err != nil {
+		return errInvalidJSON.because(err)
+	}
+
+	r := s.raft
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !s.heardFromLeader(req, inst.Term, inst.Leader) {
+		lastIndex, _ := r.last()
+		writeJSON(w, http.StatusOK, appendResponse{Term: r.term, LastIndex: lastIndex})
+		return nil
+	}
+	snap := inst.Snapshot
+	if base, _ := r.base(); snap.Index > base && snap.Index > r.commitIndex {
+		if err := r.compact(&snap); err != nil {
+			return err
+		}
+		loggerFrom(req.Context()).info("took raft snapshot from leader", "index", snap.Index, "term", snap.Term)
+		select {
+		case r.applyWake <- struct{}{}:
+		default:
+		}
+	}
+	if err := r.persist(); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, appendResponse{Term: r.term, Success: true, LastIndex: snap.Index})
+	return nil
+}
@@ -0,0 +1,403 @@
+package replica
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long we wait before resending a write that didn't get acknowledged; doubles on every retry up to the max
+var retryBackoff = 50 * time.Millisecond
+var maxRetryBackoff = 5 * time.Second
+
+// AckPolicy decides how many of the other replicas must receive a client's write before we answer the client
+type AckPolicy string
+
+const (
+	// AckNone answers the client as soon as the write is applied locally and queued for the other replicas
+	AckNone AckPolicy = "none"
+	// AckOne waits for one other replica to get the write
+	AckOne AckPolicy = "one"
+	// AckMajority waits until a majority of the view (counting this replica) has the write
+	AckMajority AckPolicy = "majority"
+	// AckAll waits for every other replica in the view to get the write
+	AckAll AckPolicy = "all"
+)
+
+// Helper function that checks if the policy is one we know
+func (p AckPolicy) valid() bool {
+	return p == AckNone || p == AckOne || p == AckMajority || p == AckAll
+}
+
+// Helper function that returns how many of the given number of other replicas must get a write under the policy
+func (p AckPolicy) needed(peers int) int {
+	switch p {
+	case AckNone:
+		return 0
+	case AckOne:
+		if peers > 0 {
+			return 1
+		}
+		return 0
+	case AckMajority:
+		// a majority of peers+1 replicas, minus the one we already count for ourselves
+		return (peers + 1) / 2
+	default:
+		return peers
+	}
+}
+
+// replication tracks one write as it makes its way to the other replicas
+type replication struct {
+	mu       sync.Mutex
+	needed   int // acks needed to satisfy our ack policy
+	acked    int
+	resolved int // replicas that either got the write or were found down
+	total    int
+	done     chan struct{}
+}
+
+// outbound is a write waiting in a replica's queue
+type outbound struct {
+	entry logEntry
+	seq   uint64
+	rep   *replication
+	trace spanContext // the span of the request that made the write, so sending it joins the request's trace
+}
+
+// peerQueue holds the writes waiting to be sent to one other replica
+// A single worker goroutine sends them one at a time, so each replica gets our writes in the order we logged them
+// Every write gets the next sequence number of the queue, which the replica sends back to acknowledge it
+// A queue holds at most limit writes (if limit isn't 0); once it has had to turn one away, it has overflowed, and the
+// replica has missed a write it can no longer be sent
+type peerQueue struct {
+	addr       string
+	mu         sync.Mutex
+	pending    []outbound
+	sending    bool // whether the worker is sending a write it took off the queue
+	nextSeq    uint64
+	limit      int
+	overflowed bool
+	wake       chan struct{}
+}
+
+// ackResponse is the part of a replica's response to a broadcast that acknowledges it, and the epoch of its view
+type ackResponse struct {
+	Ack       uint64 `json:"ack"`
+	ViewEpoch uint64 `json:"view-epoch"`
+	Code      string `json:"code"` // why the write wasn't applied, if it wasn't, e.g. "causal_dependency"
+}
+
+// Helper function that makes a random id for the stream of writes this replica sends, so receivers can tell our
+// sequence numbers apart from the ones we used before a restart
+func newStreamID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Helper function used to record that a replica got the write (or was found down)
+func (r *replication) report(ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ok {
+		r.acked++
+	}
+	r.resolved++
+	if r.acked == r.needed || r.resolved == r.total {
+		r.finish()
+	}
+}
+
+// Helper function that lets whoever is waiting go; must be called with r.mu held
+func (r *replication) finish() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+}
+
+// Used to wait until the write has reached as many replicas as our ack policy asks for, every replica has been dealt
+// with, or ctx is done
+// Returns how many replicas had acknowledged it by then, and whether that was enough; replicas found down don't count
+func (r *replication) wait(ctx context.Context) (acked int, ok bool) {
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.acked, r.acked >= r.needed
+}
+
+// Used to queue a logged write for every other replica in our view; ctx carries the span the write was made in, if any
+// Must be called with s.mu held, right after the entry was logged, so writes are queued in the order we logged them
+func (s *Server) replicate(ctx context.Context, entry logEntry) *replication {
+	var targets []*peerQueue
+	for _, replicaIP := range s.replicaArray {
+		if replicaIP != s.sAddress {
+			targets = append(targets, s.peerQueue(replicaIP))
+		}
+	}
+
+	rep := &replication{
+		needed: s.ackPolicy.needed(len(targets)),
+		total:  len(targets),
+		done:   make(chan struct{}),
+	}
+	if rep.needed == 0 {
+		rep.finish()
+	}
+
+	for _, queue := range targets {
+		if !queue.push(outbound{entry: entry, rep: rep, trace: spanContextFrom(ctx)}) {
+			s.log.warn("peer queue is full, write not queued", "peer", queue.addr, "key", entry.Key, "limit", queue.limit)
+			rep.report(false)
+		}
+	}
+	return rep
+}
+
+// Helper function that returns the queue for a replica, starting its worker the first time; must be called with s.mu held
+func (s *Server) peerQueue(replicaIP string) *peerQueue {
+	queue, ok := s.peers[replicaIP]
+	if !ok {
+		queue = &peerQueue{addr: replicaIP, limit: s.cfg.MaxQueuedWrites, wake: make(chan struct{}, 1)}
+		s.peers[replicaIP] = queue
+		go s.sendQueued(queue)
+	}
+	return queue
+}
+
+// Helper function that adds a write to the end of the queue, numbering it, and wakes its worker
+// Returns false if the queue is full, in which case it has overflowed and the write isn't added
+func (q *peerQueue) push(out outbound) bool {
+	q.mu.Lock()
+	full := q.limit > 0 && len(q.pending) >= q.limit
+	if full {
+		q.overflowed = true
+	} else {
+		q.nextSeq++
+		out.seq = q.nextSeq
+		q.pending = append(q.pending, out)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return !full
+}
+
+// Helper function that checks if the queue has had to turn a write away since it was last dropped
+func (q *peerQueue) hasOverflowed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.overflowed
+}
+
+// Helper function that takes the write at the front of the queue, if any
+func (q *peerQueue) pop() (outbound, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		q.sending = false
+		return outbound{}, false
+	}
+	out := q.pending[0]
+	q.pending = q.pending[1:]
+	q.sending = true
+	return out, true
+}
+
+// Helper function that returns how many writes haven't been sent yet, counting the one being sent
+func (q *peerQueue) unsent() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.sending {
+		return len(q.pending) + 1
+	}
+	return len(q.pending)
+}
+
+// Helper function that empties the queue, returning everything that was in it; it has room again
+func (q *peerQueue) drain() []outbound {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := q.pending
+	q.pending = nil
+	q.overflowed = false
+	return pending
+}
+
+// Used as the worker of a replica's queue: sends every queued write in order until the server stops
+func (s *Server) sendQueued(queue *peerQueue) {
+	for {
+		select {
+		case <-queue.wake:
+		case <-s.done:
+			return
+		}
+
+		for {
+			out, ok := queue.pop()
+			if !ok {
+				break
+			}
+
+			delivered := s.sendEntry(queue, out)
+			out.rep.report(delivered)
+			if queue.hasOverflowed() {
+				s.dropQueue(queue)
+			} else if !delivered && !s.inView(queue.addr) {
+				// the replica is down and out of our view; when it comes back it copies a whole store from one of
+				// us, so the writes still waiting for it can go
+				// (one still in our view expects every write, so they all stay queued for it)
+				for _, dropped := range queue.drain() {
+					dropped.rep.report(false)
+				}
+			}
+		}
+	}
+}
+
+// Helper function used once a replica's queue has overflowed: the replica has missed a write, so it can't take any
+// after it either, and is taken out of our view (again, until that goes through) before its queue is dropped. When it
+// comes back it copies a whole store from one of us
+func (s *Server) dropQueue(queue *peerQueue) {
+	backoff := retryBackoff
+	for s.inView(queue.addr) {
+		s.log.warn("peer fell too far behind, taking it to be down", "peer", queue.addr, "limit", queue.limit)
+		s.markDown(context.Background(), queue.addr)
+		if !s.inView(queue.addr) {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+	for _, dropped := range queue.drain() {
+		dropped.rep.report(false)
+	}
+}
+
+// Helper function that checks if a replica is in our view
+func (s *Server) inView(replicaIP string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return containsVal(replicaIP, s.replicaArray) >= 0
+}
+
+// Helper function used to send an entry of our log to one replica, as the request a replica expects
+// The entry is resent, backing off exponentially, until the replica acknowledges its sequence number: a replica that
+// hasn't seen the writes this one depends on yet answers 503 without an ack, and every write queued behind this one
+// depends on it too. Replicas apply each write at most once, so resending one that did arrive is harmless
+// A replica that has failed to take the write MaxSendAttempts times, by not answering or by refusing it for any other
+// reason than waiting on another replica's write (which only means it is up and behind, until DependencyTimeout has
+// gone by), is taken to be down and out of our view. If it is still in our view after that (with raft, until the
+// group agrees to take it out), it still expects the write, so we keep sending it. Returns false once the replica is
+// out of our view or its queue has overflowed (or we are stopping)
+func (s *Server) sendEntry(queue *peerQueue, out outbound) (delivered bool) {
+	ctx, sp := s.tracer.start(withSpanContext(context.Background(), out.trace), "replicate", spanInternal,
+		"peer", queue.addr, "key", out.entry.Key, "seq", out.seq)
+	attempts := 0
+	defer func() {
+		sp.set("attempts", attempts, "delivered", delivered)
+		if !delivered {
+			sp.fail(errors.New("write was not delivered"))
+		}
+		sp.finish()
+	}()
+
+	// the write has to be on disk here before anyone else has it, or a crash could leave them with one we've forgotten
+	if err := s.syncLog(out.entry.LSN); err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	viewEpoch := s.viewEpoch
+	s.mu.Unlock()
+
+	updatedBody, err := json.Marshal(newReplicationMessage(s.streamID, out.seq, viewEpoch, out.entry))
+	if err != nil {
+		s.log.error("problem marshalling replication message", "key", out.entry.Key, "error", err)
+		return false
+	}
+
+	req, err := http.NewRequest("POST", "/internal/replicate", nil)
+	if err != nil {
+		s.log.error("problem creating broadcast request", "key", out.entry.Key, "error", err)
+		return false
+	}
+	req.Header.Set(requestIDHeader, out.entry.RequestID)
+
+	backoff := retryBackoff
+	failures := 0
+	started := time.Now()
+	for {
+		attempts++
+		status, body, err := s.broadcastMessage(ctx, queue.addr, req, updatedBody)
+		if err != nil {
+			s.metrics.send(queue.addr, false)
+			failures++
+			s.log.debug("could not reach peer", "peer", queue.addr, "seq", out.seq, "error", err, "request_id", out.entry.RequestID)
+		} else {
+			var ack ackResponse
+			json.Unmarshal(body, &ack)
+			if ack.ViewEpoch > viewEpoch {
+				// the replica is on a newer view than ours
+				go s.syncView(queue.addr)
+			}
+			if ack.Ack == out.seq {
+				s.metrics.send(queue.addr, true)
+				return true
+			}
+			s.metrics.send(queue.addr, false)
+			if ack.Code != errCausalDependency.Code || time.Since(started) > s.cfg.DependencyTimeout {
+				failures++
+			}
+			s.log.debug("write not acknowledged yet", "peer", queue.addr, "seq", out.seq, "status", status, "request_id", out.entry.RequestID)
+		}
+
+		if failures >= s.cfg.MaxSendAttempts {
+			s.log.warn("peer keeps failing to take writes, taking it to be down", "peer", queue.addr, "seq", out.seq, "status", status, "error", err, "attempts", attempts, "request_id", out.entry.RequestID)
+			s.markDown(ctx, queue.addr)
+			failures = 0
+		}
+		// a replica out of our view (taken out just now, or by someone else meanwhile) copies a whole store when it
+		// comes back, so it doesn't need the write any more
+		if !s.inView(queue.addr) || queue.hasOverflowed() {
+			return false
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return false
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAckPolicyNeeded(t *testing.T) {
+	tests := []struct {
+		policy AckPolicy
+		peers  int
+		want   int
+	}{
+		{AckNone, 0, 0},
+		{AckNone, 4, 0},
+		{AckOne, 0, 0},
+		{AckOne, 1, 1},
+		{AckOne, 4, 1},
+		{AckMajority, 0, 0},
+		{AckMajority, 1, 1},
+		{AckMajority, 2, 1},
+		{AckMajority, 3, 2},
+		{AckMajority, 4, 2},
+		{AckAll, 0, 0},
+		{AckAll, 4, 4},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.needed(tt.peers); got != tt.want {
+			t.Errorf("%s.needed(%d) = %d, want %d", tt.policy, tt.peers, got, tt.want)
+		}
+	}
+}
+
+// A write waits for as many acks as it needs, or for every replica to be dealt with, but never past its context; only
+// acks make it enough, so replicas found down don't
+func TestReplicationWait(t *testing.T) {
+	tests := []struct {
+		name      string
+		needed    int
+		total     int
+		reports   []bool
+		wantAcked int
+		wantOK    bool
+	}{
+		{name: "nothing needed", needed: 0, total: 2, wantOK: true},
+		{name: "enough acks", needed: 2, total: 3, reports: []bool{true, false, true}, wantAcked: 2, wantOK: true},
+		{name: "every replica found down", needed: 2, total: 2, reports: []bool{false, false}},
+		{name: "enough acks with one found down", needed: 1, total: 2, reports: []bool{false, true}, wantAcked: 1, wantOK: true},
+		{name: "too few acks in time", needed: 2, total: 3, reports: []bool{true}, wantAcked: 1},
+		{name: "no answers in time", needed: 1, total: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep := &replication{needed: tt.needed, total: tt.total, done: make(chan struct{})}
+			if rep.needed == 0 {
+				rep.finish()
+			}
+			for _, ok := range tt.reports {
+				rep.report(ok)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			acked, ok := rep.wait(ctx)
+			if acked != tt.wantAcked || ok != tt.wantOK {
+				t.Errorf("wait() = (%d, %v), want (%d, %v)", acked, ok, tt.wantAcked, tt.wantOK)
+			}
+		})
+	}
+}
+
+// A replica that keeps failing to take a write, by refusing it or not answering at all, is taken to be down after
+// MaxSendAttempts tries, but one that is only waiting on another replica's write is sent it until it takes it (or
+// DependencyTimeout runs out), and so is one still in our view after being taken to be down
+func TestSendEntryAttempts(t *testing.T) {
+	tests := []struct {
+		name          string
+		drops         int // sends hung up on without an answer, before any refusals
+		refusals      int
+		refusal       *apiError
+		raft          bool // so the replica can't be taken out of the view, with no raft leader to agree to it
+		dependency    time.Duration
+		wantDelivered bool
+		wantSends     int
+	}{
+		{name: "acknowledged", wantDelivered: true, wantSends: 1},
+		{name: "refused a few times", refusals: 2, refusal: errPeerUnauthenticated, wantDelivered: true, wantSends: 3},
+		{name: "refused too often", refusals: 10, refusal: errPeerUnauthenticated, wantSends: 3},
+		{name: "waiting on a dependency", refusals: 5, refusal: errCausalDependency, wantDelivered: true, wantSends: 6},
+		{name: "waiting on a dependency too long", refusals: 10, refusal: errCausalDependency, dependency: time.Nanosecond, wantSends: 3},
+		{name: "unreachable a few times", drops: 2, wantDelivered: true, wantSends: 3},
+		{name: "unreachable too often", drops: 10, wantSends: 3},
+		{name: "unreachable then refusing", drops: 1, refusals: 10, refusal: errPeerUnauthenticated, wantSends: 3},
+		{name: "down but still in the view", drops: 7, raft: true, wantDelivered: true, wantSends: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			sends := 0
+			peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/internal/replicate" {
+					http.NotFound(w, req)
+					return
+				}
+				var msg replicationMessage
+				json.NewDecoder(req.Body).Decode(&msg)
+
+				mu.Lock()
+				sends++
+				drop := sends <= tt.drops
+				refuse := sends <= tt.drops+tt.refusals
+				mu.Unlock()
+				if drop {
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err == nil {
+						conn.Close()
+					}
+					return
+				}
+				if refuse {
+					writeError(w, req, tt.refusal, nil)
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]interface{}{"ack": msg.Seq, "result": "applied"})
+			}))
+			defer peer.Close()
+			peerAddr := strings.TrimPrefix(peer.URL, "http://")
+
+			cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1", peerAddr})
+			cfg.MaxSendAttempts = 3
+			cfg.AnnounceTimeout = 50 * time.Millisecond
+			cfg.DependencyTimeout = tt.dependency
+			if tt.raft {
+				cfg.Consensus = "raft"
+			}
+			s := newServer(t, cfg)
+
+			queue := &peerQueue{addr: peerAddr, wake: make(chan struct{}, 1)}
+			entry := logEntry{Key: "x", Op: "put", Value: "1", VectorClock: vectorClock{1, 0}}
+			delivered := s.sendEntry(queue, outbound{entry: entry, seq: 1})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if delivered != tt.wantDelivered || sends != tt.wantSends {
+				t.Errorf("sendEntry() = %v after %d sends, want %v after %d", delivered, sends, tt.wantDelivered, tt.wantSends)
+			}
+			if inView := s.inView(peerAddr); inView != tt.wantDelivered {
+				t.Errorf("peer in view = %v, want %v", inView, tt.wantDelivered)
+			}
+		})
+	}
+}
+
+// A replica's queue is only given up on once the replica is out of our view; one still in it keeps every write
+func TestSendQueuedKeepsQueue(t *testing.T) {
+	var mu sync.Mutex
+	sends := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		sends++
+		mu.Unlock()
+		writeError(w, req, errPeerUnauthenticated, nil)
+	}))
+	defer peer.Close()
+	peerAddr := strings.TrimPrefix(peer.URL, "http://")
+
+	tests := []struct {
+		name      string
+		raft      bool
+		wantSends int // by when the first write has been given up on, or sent on after the peer was taken to be down
+		wantKept  int
+	}{
+		{name: "taken out of the view", wantSends: 2, wantKept: 0},
+		{name: "still in the view", raft: true, wantSends: 5, wantKept: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1", peerAddr})
+			cfg.MaxSendAttempts = 2
+			cfg.AnnounceTimeout = 50 * time.Millisecond
+			if tt.raft {
+				cfg.Consensus = "raft"
+			}
+			s := newServer(t, cfg)
+			mu.Lock()
+			sends = 0
+			mu.Unlock()
+
+			s.mu.Lock()
+			queue := s.peerQueue(peerAddr)
+			for i := 0; i < 3; i++ {
+				s.replicate(context.Background(), logEntry{Key: "x", Op: "put", Value: i, VectorClock: vectorClock{i + 1, 0}})
+			}
+			s.mu.Unlock()
+
+			// the first write is being sent (or is gone) and the other two are behind it, unless they were dropped
+			eventually(t, 5*time.Second, fmt.Sprintf("%d writes left queued", tt.wantKept), func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				queue.mu.Lock()
+				defer queue.mu.Unlock()
+				return sends >= tt.wantSends && len(queue.pending) == tt.wantKept
+			})
+
+			// shutting down waits for the writes still queued, which is as long as it is given
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			s.Shutdown(ctx)
+		})
+	}
+}
+
+// A full queue turns writes away, and has overflowed until it is drained
+func TestPeerQueueLimit(t *testing.T) {
+	queue := &peerQueue{addr: "127.0.0.1:2", limit: 2, wake: make(chan struct{}, 1)}
+	for i, want := range []bool{true, true, false, false} {
+		if got := queue.push(outbound{entry: logEntry{Key: fmt.Sprint(i)}}); got != want {
+			t.Errorf("push %d = %v, want %v", i, got, want)
+		}
+	}
+	if !queue.hasOverflowed() {
+		t.Error("queue hasn't overflowed after turning writes away")
+	}
+	if out, _ := queue.pop(); out.seq != 1 {
+		t.Errorf("first write has seq %d, want 1", out.seq)
+	}
+
+	if dropped := queue.drain(); len(dropped) != 1 {
+		t.Errorf("drained %d writes, want 1", len(dropped))
+	}
+	if queue.hasOverflowed() {
+		t.Error("queue still overflowed after being drained")
+	}
+	if !queue.push(outbound{}) {
+		t.Error("drained queue turned a write away")
+	}
+}
+
+// A replica whose queue overflows is taken out of our view, and a write it didn't get doesn't count as acknowledged
+func TestQueueOverflow(t *testing.T) {
+	// a replica that never gets the write the others depend on
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, req, errCausalDependency, nil)
+	}))
+	defer peer.Close()
+	peerAddr := strings.TrimPrefix(peer.URL, "http://")
+
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1", peerAddr})
+	cfg.MaxQueuedWrites = 2
+	s := newServer(t, cfg)
+
+	s.mu.Lock()
+	var reps []*replication
+	for i := 0; i < 4; i++ {
+		reps = append(reps, s.replicate(context.Background(), logEntry{Key: "x", Op: "put", Value: i, VectorClock: vectorClock{i + 1, 0}}))
+	}
+	s.mu.Unlock()
+
+	// at most one write is being sent and two are queued behind it, so the last is turned away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if acked, ok := reps[3].wait(ctx); acked != 0 || ok {
+		t.Errorf("wait() on the write turned away = (%d, %v), want (0, false)", acked, ok)
+	}
+	eventually(t, 5*time.Second, "the peer to be taken out of the view", func() bool {
+		return !s.inView(peerAddr)
+	})
+	for i, rep := range reps[:3] {
+		if acked, ok := rep.wait(ctx); acked != 0 || ok {
+			t.Errorf("wait() on write %d = (%d, %v), want (0, false)", i, acked, ok)
+		}
+	}
+}
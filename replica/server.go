@@ -0,0 +1,1654 @@
+package replica
+
+// standard imports
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// message struct is used to unpack request vals into a struct that can handle null causal metadata
+type message struct {
+	Value          interface{}  `json:"value"`
+	CausalMetadata *ReqMetaData `json:"causal-metadata"`
+	TTL            *float64     `json:"ttl,omitempty"`
+}
+
+// reqMetaData is used to unpack request vals when they actually exist and are not null so they can be easily assigned a type
+type ReqMetaData struct {
+	ReqVector       []int `json:"ReqVector"`
+	ReqIpIndex      int   `json:"ReqIpIndex"`
+	IsReqFromClient bool  `json:"IsReqFromClient"`
+}
+
+// declaring our Vector Clock, which we'll use for causal consistency
+type VectorClock struct {
+	VC []int `json:"VC"`
+}
+
+// Server holds all the state of one replica
+// Every HTTP handler runs on its own goroutine (as do recovery, TTL expiry and broadcasts), so all of the
+// replica's state below is guarded by mu, and nothing may touch it without holding the lock
+type Server struct {
+	cfg            Config
+	client         *http.Client          // used for every request to another replica
+	auth           *peerAuth             // nil unless the cluster has a shared secret
+	certs          *certReloader         // nil unless the client API is served over TLS
+	tokens         map[string]*principal // client tokens; nil unless access control is on
+	metrics        *metrics
+	log            *logger
+	tracer         *tracer       // nil unless spans are exported somewhere
+	limiter        *rateLimiter  // nil unless clients are rate limited
+	inFlight       chan struct{} // holds a token for each /kvs request being handled; nil if there's no limit
+	handler        http.Handler
+	internal       http.Handler  // the API only replicas use, if it is served apart from handler
+	httpServer     *http.Server  // only set if Start is serving the API itself
+	internalServer *http.Server  // only set if Start is serving the internal API on its own listener
+	done           chan struct{} // closed by Stop, to end the background goroutines
+	stopOnce       sync.Once
+	shutdownOnce   sync.Once
+	shutdownErr    error         // what the first call of Shutdown returned
+	decommissioned chan struct{} // closed once we left the cluster and shut down, see handleLeave
+	raft           *raftNode     // nil unless the view is agreed on through raft, see raft.go
+
+	// held while a join is handled from start to finish, so joins through this replica are made one at a time
+	joinMu sync.Mutex
+
+	mu sync.Mutex
+
+	startedAt time.Time // when Start had the store loaded from the log; zero until then
+	recovered bool      // whether didIDie is done catching up with the other replicas
+	draining  bool      // whether Shutdown (or leaving the cluster) has started
+	joining   bool      // whether we are waiting to be bootstrapped by the replica adding us, see membership.go
+
+	// every replica the cluster has ever had, in the order they joined it; a replica's position in it is its index in
+	// the vector clock. Replicas that left keep their place, and are in retired too
+	members []string
+	retired map[string]bool
+
+	sAddress     string   // socket address
+	vectorIndex  int      // represents which index in replicaArray this replica is
+	replicaArray []string // holds IP's of all replicas
+	viewArray    []string // array of IP's currently in view i.e. online
+	replicaCount int      // local Counter for number of replicas online
+	viewEpoch    uint64   // goes up with every change to replicaArray, so older changes can be told apart, see view.go
+	viewSyncing  bool     // whether syncView is running
+
+	// first 3 integers represent the vector clock of the local replica
+	localVector vectorClock
+
+	// our local KVS store
+	store map[string]interface{}
+
+	// size of the store as kvs_store_bytes reports it, kept up to date by setValue, deleteValue and replaceStore
+	storeBytes int
+
+	// holds the expiry of every key in our store that was PUT with a TTL
+	expiries map[string]keyExpiry
+
+	// the linearizable keys, which only the raft group's log changes, see linear.go
+	linear       map[string]linearValue
+	linearLogged int64 // raft index of the last linearizable write in the operation log
+
+	// outbound queue of broadcasts for each of the other replicas, see replication.go
+	// Network calls are never made while holding mu
+	peers     map[string]*peerQueue
+	ackPolicy AckPolicy
+	streamID  string            // identifies the writes we send, see replication.go
+	received  map[string]uint64 // highest sequence number we applied from each stream we've been sent
+
+	// the log is shared between request handlers and every open stream, so it has its own lock
+	// when both locks are needed, mu is always taken before logMu
+	logMu          sync.Mutex
+	dataDir        string
+	logFile        *os.File
+	logTail        []logEntry
+	nextLSN        int64
+	logSynced      int64      // lsn of the last entry we know is on disk
+	logPending     []logEntry // entries written since, which subscribers only hear about once they are on disk too
+	logErr         error      // set once the log fails to write or sync, after which nothing more is logged
+	logWake        chan struct{}
+	logSubscribers map[*logSubscriber]bool
+	logEntries     int              // how many entries the log file holds
+	logLatest      map[string]int64 // lsn of the latest entry for each key, the ones compaction keeps
+	logCompacting  bool
+
+	// held while the log file is synced, so compaction and Stop can't swap or close it meanwhile
+	// it is taken before logMu, and never with mu held
+	syncMu sync.Mutex
+}
+
+// Config is everything needed to run one replica
+type Config struct {
+	// SocketAddress is the address the other replicas reach this replica at, e.g. "10.10.0.2:8090"
+	SocketAddress string
+	// View holds the socket addresses of every replica, this one included. Every replica must be given the view in
+	// the same order, since a replica's position in it is its index in the vector clock
+	View []string
+	// DataDir is where the operation log is kept; if empty, nothing is written to disk
+	DataDir string
+	// CompactLogAfter is how many entries the operation log may hold before the ones superseded by a later entry for
+	// the same key are dropped from it; defaults to 10000
+	CompactLogAfter int
+	// Listener, if set, is what Start serves the API on. Otherwise Start listens on ListenAddress, and if that is
+	// empty too, Start serves nothing and the embedding program is expected to serve Handler itself
+	Listener      net.Listener
+	ListenAddress string
+	// Transport carries every request this replica makes to the other replicas; defaults to http.DefaultTransport
+	Transport http.RoundTripper
+	// AckPolicy decides how many replicas must receive a client's write before we answer the client; defaults to AckAll
+	AckPolicy AckPolicy
+	// InternalListener or InternalListenAddress, if set, is where Start serves the API only replicas use (e.g.
+	// /internal/replicate), and that API is then left out of Handler. Otherwise it is served alongside the client API
+	InternalListener      net.Listener
+	InternalListenAddress string
+	// InternalAddresses maps a replica's socket address to where it serves its internal API, for replicas that don't
+	// serve it on the same port as this one does
+	InternalAddresses map[string]string
+	// ClusterSecret, if set, is shared by every replica: requests between replicas are signed with it (HMAC-SHA256),
+	// and requests only replicas may make (the internal API, changing the view, /down, /getKVS) are rejected with 401
+	// unless they carry a valid signature
+	ClusterSecret []byte
+	// TLSCertFile and TLSKeyFile, if both set, are a PEM certificate and key the client API is served with over TLS.
+	// The files are checked for changes every few seconds and loaded again, so a renewed certificate needs no restart.
+	// Every replica is expected to serve TLS then, and other replicas are reached over https (other than the internal
+	// API, if it has its own listener)
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSCAFile is the PEM file of CAs other replicas' certificates are checked against; the system's CAs if unset.
+	// Ignored if Transport is set
+	TLSCAFile string
+	// ACLFile, if set, is a JSON file of client tokens and the roles they have, each role giving read and/or write
+	// access to key prefixes (see acl.go). Clients must then send "Authorization: Bearer <token>" and only get at the
+	// keys their roles allow. Needs ClusterSecret, or clients could write through the internal API instead
+	ACLFile string
+	// RateLimit, if positive, is how many requests a second each client may make to /kvs, with bursts of up to
+	// RateBurst (RateLimit rounded up, if RateBurst isn't set). Clients are told apart by their token if they send
+	// one, and by their IP address otherwise
+	RateLimit float64
+	RateBurst int
+	// MaxConcurrent, if positive, is how many /kvs requests are handled at once; any more are turned away
+	MaxConcurrent int
+	// StartupDelay is how long Start waits before checking whether this replica missed writes while it was down,
+	// giving the other replicas time to start up; defaults to 2 seconds
+	StartupDelay time.Duration
+	// ReachTimeout is how long a replica has to answer /readyz's check before it is counted as down; defaults to 1
+	// second
+	ReachTimeout time.Duration
+	// AnnounceTimeout is how long a replica has to answer before we tell it about a replica that went down;
+	// defaults to 2 seconds
+	AnnounceTimeout time.Duration
+	// Joining starts the replica outside the cluster, waiting for a member to add it through POST /admin/join; View
+	// isn't needed then. Until it is added, it turns every request for a key away. Once added, the membership is kept
+	// in DataDir, and is what the replica starts with from then on (rather than View), JOIN or not
+	Joining bool
+	// RequestTimeout is how long any request to another replica may take altogether; defaults to 10 seconds
+	RequestTimeout time.Duration
+	// WriteTimeout is how long a client's write waits for the replicas AckPolicy needs before it is answered 503
+	// ack_timeout, with the acks it got; the write stays applied here and keeps going out. Defaults to 5 seconds
+	WriteTimeout time.Duration
+	// MaxSendAttempts is how many times a write is sent to a replica that doesn't answer, or answers without
+	// acknowledging it (e.g. 401 or 500), before the replica is taken to be down; a replica waiting on another one's
+	// write first (503 causal_dependency) is up, so those answers don't count. Defaults to 10
+	MaxSendAttempts int
+	// DependencyTimeout is how long a write is sent to a replica that keeps answering it is waiting on another one's
+	// write first before those answers count towards MaxSendAttempts too (the write it waits on may have been dropped,
+	// and it would never take ours); defaults to 30 seconds
+	DependencyTimeout time.Duration
+	// MaxQueuedWrites is how many writes may wait to be sent to one replica; a replica that falls further behind is
+	// taken to be down, since it has missed writes it can no longer be sent. Defaults to 10000
+	MaxQueuedWrites int
+	// ShutdownTimeout is how long Shutdown waits for the requests being handled and the writes queued for other
+	// replicas, unless its context has a deadline of its own; defaults to 10 seconds
+	ShutdownTimeout time.Duration
+	// LogLevel is the lowest level that is logged: "debug", "info" (the default), "warn" or "error". It can be changed
+	// while the replica runs through PUT /log-level
+	LogLevel string
+	// LogOutput is where the replica writes its logs, one JSON object per line; defaults to stderr
+	LogOutput io.Writer
+	// TraceFile and TraceEndpoint, if set, turn on tracing: every request, and the broadcasts, view changes and
+	// recovery it leads to, is recorded as spans of a trace that follows it from replica to replica (W3C traceparent
+	// headers). Spans are exported as OTLP JSON, appended to TraceFile a batch per line and/or POSTed to the OTLP/HTTP
+	// collector at TraceEndpoint (e.g. "http://localhost:4318")
+	TraceFile     string
+	TraceEndpoint string
+	// Consensus, if "raft", has the view decided by a raft group of the cluster's members rather than changed by
+	// whichever replica notices another is down or back (see raft.go): every replica goes through the same views in
+	// the same order, and a change only happens if a majority of the group can be reached. Every replica must be
+	// started with the same setting
+	Consensus string
+	// ElectionTimeout is how long a raft follower goes without hearing from the leader before standing itself (plus a
+	// random part of as much again); the leader is heard from five times as often. Defaults to 500 milliseconds
+	ElectionTimeout time.Duration
+	// LinearizablePrefixes, if set, are the key prefixes whose keys are linearizable rather than causally consistent:
+	// their writes go through the raft log and their reads are checked with the leader (see linear.go). Needs
+	// Consensus "raft", and every replica must be given the same prefixes
+	LinearizablePrefixes []string
+}
+
+// defaults for the timings in Config
+const (
+	defaultStartupDelay      = 2 * time.Second
+	defaultReachTimeout      = 1 * time.Second
+	defaultAnnounceTimeout   = 2 * time.Second
+	defaultRequestTimeout    = 10 * time.Second
+	defaultShutdownTimeout   = 10 * time.Second
+	defaultWriteTimeout      = 5 * time.Second
+	defaultMaxSendAttempts   = 10
+	defaultDependencyTimeout = 30 * time.Second
+	defaultMaxQueuedWrites   = 10000
+	defaultCompactLogAfter   = 10000
+	defaultElectionTimeout   = 500 * time.Millisecond
+)
+
+// New creates a replica from the given config; it doesn't do anything until Start is called
+func New(cfg Config) (*Server, error) {
+	if cfg.SocketAddress == "" {
+		return nil, errors.New("replica: socket address is required")
+	}
+	members := make([]string, 0, len(cfg.View))
+	for _, addr := range cfg.View {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			members = append(members, addr)
+		}
+	}
+	retired := make(map[string]bool)
+	joining := false
+
+	// a membership we saved is newer than the view we were given, since the cluster has changed since it started
+	var saved *membership
+	if cfg.DataDir != "" {
+		var err error
+		saved, err = loadMembership(cfg.DataDir)
+		if err != nil {
+			return nil, fmt.Errorf("replica: loading membership: %w", err)
+		}
+	}
+	if saved != nil {
+		members = saved.Members
+		for _, addr := range saved.Retired {
+			retired[addr] = true
+		}
+		if retired[cfg.SocketAddress] {
+			return nil, fmt.Errorf("replica: %s has left the cluster; start it with an empty data dir to join again", cfg.SocketAddress)
+		}
+	}
+	if containsVal(cfg.SocketAddress, members) < 0 {
+		if !cfg.Joining || saved != nil {
+			return nil, fmt.Errorf("replica: view %v does not contain socket address %s", members, cfg.SocketAddress)
+		}
+		// our place in the cluster (and the vector clock) is only known once a member adds us
+		members = nil
+		joining = true
+	}
+	var view []string
+	for _, addr := range members {
+		if !retired[addr] {
+			view = append(view, addr)
+		}
+	}
+
+	ackPolicy := cfg.AckPolicy
+	if ackPolicy == "" {
+		ackPolicy = AckAll
+	}
+	if !ackPolicy.valid() {
+		return nil, fmt.Errorf("replica: unknown ack policy %q", ackPolicy)
+	}
+
+	level := levelInfo
+	if cfg.LogLevel != "" {
+		var err error
+		level, err = parseLevel(cfg.LogLevel)
+		if err != nil {
+			return nil, fmt.Errorf("replica: %w", err)
+		}
+	}
+	logOutput := cfg.LogOutput
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+
+	log := newLogger(logOutput, level).with("replica", cfg.SocketAddress)
+	tracer, err := newTracer(cfg.SocketAddress, cfg.TraceFile, cfg.TraceEndpoint, log)
+	if err != nil {
+		return nil, fmt.Errorf("replica: setting up tracing: %w", err)
+	}
+
+	var tokens map[string]*principal
+	if cfg.ACLFile != "" {
+		if len(cfg.ClusterSecret) == 0 {
+			return nil, errors.New("replica: access control needs a cluster secret")
+		}
+		var err error
+		tokens, err = loadACL(cfg.ACLFile)
+		if err != nil {
+			return nil, fmt.Errorf("replica: loading access control: %w", err)
+		}
+	}
+
+	if cfg.RateLimit < 0 || cfg.RateBurst < 0 || cfg.MaxConcurrent < 0 {
+		return nil, errors.New("replica: rate and concurrency limits must not be negative")
+	}
+	if cfg.StartupDelay < 0 || cfg.ReachTimeout < 0 || cfg.AnnounceTimeout < 0 || cfg.RequestTimeout < 0 || cfg.ShutdownTimeout < 0 || cfg.ElectionTimeout < 0 || cfg.WriteTimeout < 0 || cfg.DependencyTimeout < 0 {
+		return nil, errors.New("replica: timeouts must not be negative")
+	}
+	if cfg.StartupDelay == 0 {
+		cfg.StartupDelay = defaultStartupDelay
+	}
+	if cfg.ReachTimeout == 0 {
+		cfg.ReachTimeout = defaultReachTimeout
+	}
+	if cfg.AnnounceTimeout == 0 {
+		cfg.AnnounceTimeout = defaultAnnounceTimeout
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = defaultRequestTimeout
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = defaultWriteTimeout
+	}
+	if cfg.MaxSendAttempts < 0 {
+		return nil, errors.New("replica: max send attempts must not be negative")
+	}
+	if cfg.MaxSendAttempts == 0 {
+		cfg.MaxSendAttempts = defaultMaxSendAttempts
+	}
+	if cfg.DependencyTimeout == 0 {
+		cfg.DependencyTimeout = defaultDependencyTimeout
+	}
+	if cfg.MaxQueuedWrites < 0 {
+		return nil, errors.New("replica: max queued writes must not be negative")
+	}
+	if cfg.MaxQueuedWrites == 0 {
+		cfg.MaxQueuedWrites = defaultMaxQueuedWrites
+	}
+	if cfg.CompactLogAfter < 0 {
+		return nil, errors.New("replica: compact log after must not be negative")
+	}
+	if cfg.CompactLogAfter == 0 {
+		cfg.CompactLogAfter = defaultCompactLogAfter
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = defaultElectionTimeout
+	}
+
+	var raft *raftNode
+	switch cfg.Consensus {
+	case "":
+	case "raft":
+		// the group starts out as the view we were given; a replica that is joining isn't in it, and learns it from
+		// the leader once it is added
+		var err error
+		raft, err = newRaftNode(cfg.DataDir, view, cfg.ElectionTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("replica: loading raft state: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("replica: unknown consensus %q", cfg.Consensus)
+	}
+	if len(cfg.LinearizablePrefixes) > 0 && raft == nil {
+		return nil, errors.New("replica: linearizable keys need raft consensus")
+	}
+
+	var certs *certReloader
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, errors.New("replica: TLS needs both a certificate and a key file")
+		}
+		var err error
+		certs, err = newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("replica: loading TLS certificate: %w", err)
+		}
+	}
+
+	transport := cfg.Transport
+	if transport == nil && certs != nil {
+		var err error
+		transport, err = peerTransport(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("replica: loading TLS CAs: %w", err)
+		}
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	var auth *peerAuth
+	if len(cfg.ClusterSecret) > 0 {
+		transport = &signingTransport{base: transport, secret: cfg.ClusterSecret}
+		auth = newPeerAuth(cfg.ClusterSecret)
+	}
+	if tracer != nil {
+		transport = &tracingTransport{base: transport, tracer: tracer}
+	}
+
+	s := &Server{
+		cfg:            cfg,
+		client:         &http.Client{Transport: transport, Timeout: cfg.RequestTimeout},
+		auth:           auth,
+		certs:          certs,
+		tokens:         tokens,
+		metrics:        newMetrics(),
+		log:            log,
+		tracer:         tracer,
+		done:           make(chan struct{}),
+		decommissioned: make(chan struct{}),
+		raft:           raft,
+		joining:        joining,
+		members:        members,
+		retired:        retired,
+		sAddress:       cfg.SocketAddress,
+		replicaArray:   append([]string(nil), view...),
+		viewArray:      append([]string(nil), view...),
+		localVector:    make(vectorClock, len(members)),
+		store:          make(map[string]interface{}),
+		expiries:       make(map[string]keyExpiry),
+		linear:         make(map[string]linearValue),
+		dataDir:        cfg.DataDir,
+		nextLSN:        1,
+		logSubscribers: make(map[*logSubscriber]bool),
+		logWake:        make(chan struct{}, 1),
+		logLatest:      make(map[string]int64),
+		peers:          make(map[string]*peerQueue),
+		ackPolicy:      ackPolicy,
+		streamID:       newStreamID(),
+		received:       make(map[string]uint64),
+	}
+
+	if cfg.RateLimit > 0 {
+		s.limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+	if cfg.MaxConcurrent > 0 {
+		s.inFlight = make(chan struct{}, cfg.MaxConcurrent)
+	}
+
+	//sets index for each unique socket address so that vector clock can be incremented correctly
+	//i.e. replica index 0 always increments the first value in the vector (array) and so on
+	s.vectorIndex = s.indexOf(cfg.SocketAddress)
+
+	// every request gets an id to log with, and no panic in a handler may take the replica down
+	s.handler = s.withRequestID(recoverPanics(s.router()))
+	if s.separateInternal() {
+		internal := mux.NewRouter()
+		s.internalRouter(internal)
+		internal.Use(s.instrument, s.traceRequests)
+		s.internal = s.withRequestID(recoverPanics(internal))
+	}
+	return s, nil
+}
+
+// Handler returns the HTTP API of the replica, for embedding programs that serve it themselves
+// Unless the internal API is served on its own listener, this includes it too
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// InternalHandler returns the API only replicas use, or nil if it is part of Handler
+func (s *Server) InternalHandler() http.Handler {
+	return s.internal
+}
+
+// Helper function that checks if the internal API is served on its own listener
+func (s *Server) separateInternal() bool {
+	return s.cfg.InternalListener != nil || s.cfg.InternalListenAddress != ""
+}
+
+// Start replays the operation log, starts recovery and TTL expiry in the background, and starts serving the API
+// if the config gave it somewhere to listen. It returns once the replica is up
+func (s *Server) Start() error {
+	//replays our log from disk, so anything we applied before a restart is still here
+	if s.dataDir != "" {
+		if err := s.openLog(); err != nil {
+			return fmt.Errorf("replica: opening log: %w", err)
+		}
+	}
+	s.mu.Lock()
+	s.startedAt = time.Now()
+	s.mu.Unlock()
+
+	listener := s.cfg.Listener
+	if listener == nil && s.cfg.ListenAddress != "" {
+		var err error
+		listener, err = net.Listen("tcp", s.cfg.ListenAddress)
+		if err != nil {
+			return fmt.Errorf("replica: %w", err)
+		}
+	}
+	internalListener := s.cfg.InternalListener
+	if internalListener == nil && s.cfg.InternalListenAddress != "" {
+		var err error
+		internalListener, err = net.Listen("tcp", s.cfg.InternalListenAddress)
+		if err != nil {
+			if listener != nil && s.cfg.Listener == nil {
+				listener.Close()
+			}
+			return fmt.Errorf("replica: %w", err)
+		}
+	}
+
+	if listener != nil {
+		if s.certs != nil {
+			listener = tls.NewListener(listener, s.serverTLSConfig())
+		}
+		s.httpServer = s.serve(listener, s.handler)
+	}
+	if internalListener != nil {
+		s.internalServer = s.serve(internalListener, s.internal)
+	}
+
+	// function that checks if this replica has just died
+	// (a replica joining the cluster gets everything it needs when it is added instead)
+	if !s.isJoining() {
+		go s.didIDie()
+	}
+
+	// function that syncs what we log to disk, for the entries nobody is waiting on
+	if s.dataDir != "" {
+		go s.syncLogs()
+	}
+
+	// function that deletes keys once their TTL runs out
+	go s.expireKeys()
+
+	// functions that take part in the raft group and apply the view changes it agrees on
+	if s.raft != nil {
+		go s.runRaft()
+		go s.applyRaft()
+	}
+
+	// function that exports finished spans
+	if s.tracer != nil {
+		go s.tracer.run()
+	}
+
+	// function that picks up a renewed TLS certificate
+	if s.certs != nil {
+		go s.watchCertificate()
+	}
+	return nil
+}
+
+// Helper function that serves a handler on a listener in the background
+func (s *Server) serve(listener net.Listener, handler http.Handler) *http.Server {
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.log.error("stopped serving", "address", listener.Addr().String(), "error", err)
+		}
+	}()
+	return server
+}
+
+// Stop stops serving the API (if Start was serving it), stops the background work and closes the log
+func (s *Server) Stop(ctx context.Context) error {
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.done)
+		if s.httpServer != nil {
+			err = s.httpServer.Shutdown(ctx)
+		}
+		if s.internalServer != nil {
+			if shutdownErr := s.internalServer.Shutdown(ctx); err == nil {
+				err = shutdownErr
+			}
+		}
+
+		s.syncMu.Lock()
+		s.logMu.Lock()
+		if s.logFile != nil {
+			// everything we logged has to be on disk before we go, or a restart would replay less than we applied
+			if syncErr := s.logFile.Sync(); err == nil {
+				err = syncErr
+			}
+			if closeErr := s.logFile.Close(); err == nil {
+				err = closeErr
+			}
+			s.logFile = nil
+		}
+		s.logMu.Unlock()
+		s.syncMu.Unlock()
+
+		if s.raft != nil {
+			s.raft.mu.Lock()
+			if closeErr := s.raft.close(); err == nil {
+				err = closeErr
+			}
+			s.raft.mu.Unlock()
+		}
+
+		if traceErr := s.tracer.shutdown(ctx); err == nil {
+			err = traceErr
+		}
+	})
+	return err
+}
+
+// Helper function that returns the index a replica has in the vector clock, or -1 if it isn't one of our replicas
+// Must be called with s.mu held
+func (s *Server) indexOf(addr string) int {
+	return containsVal(addr, s.members)
+}
+
+// Used to build the router that sends each URL to its handler
+func (s *Server) router() *mux.Router {
+	r := mux.NewRouter()
+
+	// Handlers for each scenario of input for URL
+	// (anyone may look at the view, but only replicas may change it)
+	r.HandleFunc("/view", s.requirePeer(handle(s.handleView), "PUT", "DELETE"))
+	r.HandleFunc("/kvs", s.admit(handle(s.handleListKeys)))
+	// keys may hold slashes, e.g. under a linearizable prefix like "locks/"
+	r.HandleFunc("/kvs/{key:.+}", s.admit(handle(s.handleKey)))
+	r.HandleFunc("/down/{flag}", s.requirePeer(handle(s.handleDown)))
+	r.HandleFunc("/getVC", handle(s.handleGetVC))
+	r.HandleFunc("/getKVS", s.requirePeer(handle(s.handleGetKVS)))
+	r.HandleFunc("/watch", s.handleWatch)
+	r.HandleFunc("/changes", s.handleChanges)
+	r.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
+	r.HandleFunc("/log-level", s.requirePeer(handle(s.handleLogLevel), "PUT"))
+	r.HandleFunc("/healthz", s.handleHealthz).Methods("GET")
+	r.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+	r.HandleFunc("/status", s.handleStatus).Methods("GET")
+	r.HandleFunc("/admin/join", s.requirePeer(handle(s.handleJoin)))
+	r.HandleFunc("/admin/leave", s.requirePeer(handle(s.handleLeave)))
+	r.HandleFunc("/leader", handle(s.handleLeader)).Methods("GET")
+	r.Use(s.instrument, s.traceRequests)
+	if !s.separateInternal() {
+		s.internalRouter(r)
+	}
+	return r
+}
+
+// Used to check if current replica has just died
+func (s *Server) didIDie() {
+	// sleep for a bit, so that we can confirm other replicas have time to start up
+	select {
+	case <-time.After(s.cfg.StartupDelay):
+	case <-s.done:
+		return
+	}
+
+	s.mu.Lock()
+	view := append([]string(nil), s.viewArray...)
+	s.mu.Unlock()
+
+	ctx, sp := s.tracer.start(context.Background(), "recovery", spanInternal, "view", view)
+	defer sp.finish()
+
+	// first catching up with any replicas that joined or left while we were down
+	for _, replicaIP := range view {
+		if replicaIP != s.sAddress {
+			s.catchUpMembership(ctx, replicaIP)
+		}
+	}
+	s.mu.Lock()
+	view = append([]string(nil), s.viewArray...)
+	s.mu.Unlock()
+
+	// checking all elements of current view
+	rejoined := false
+	for _, replicaIP := range view {
+		// if any in the view is not our address
+		if replicaIP != s.sAddress && s.recoverFrom(ctx, replicaIP) {
+			rejoined = true
+		}
+	}
+
+	// a replica we left when we shut down (see Shutdown) took us out of its view even if we missed nothing since
+	if !rejoined {
+		s.pushIpToReplicas(ctx)
+	}
+
+	// we are ready to be sent requests now, see /readyz
+	s.mu.Lock()
+	s.recovered = true
+	s.mu.Unlock()
+	s.log.info("recovery done")
+}
+
+// Helper function used by didIDie to catch up with one other replica, if it has seen writes we haven't
+// Returns whether we did, and put ourselves back in every replica's view
+func (s *Server) recoverFrom(ctx context.Context, replicaIP string) bool {
+	ctx, sp := s.tracer.start(ctx, "recover from peer", spanInternal, "peer", replicaIP)
+	defer sp.finish()
+
+	// gets vector clock of that other replica
+	repVC, err := s.getReplicaVectorClock(ctx, replicaIP)
+	if err != nil {
+		s.log.warn("could not get vector clock", "peer", replicaIP, "error", err)
+		sp.fail(err)
+		return false
+	}
+	s.log.debug("checking whether we missed writes", "peer", replicaIP, "peer_vector_clock", repVC)
+
+	s.mu.Lock()
+	// if other replica's VC is not equal to our own
+	if repVC.equal(s.localVector) {
+		s.mu.Unlock()
+		sp.set("missed_writes", false)
+		return false
+	}
+	s.mu.Unlock()
+	sp.set("missed_writes", true, "peer_vector_clock", repVC)
+
+	//we know we died and need to grab the new KVS (and the TTLs that go with it)
+	newStore, newExpiries, err := s.getReplicaKVS(ctx, replicaIP)
+	if err != nil {
+		s.log.warn("could not get kvs", "peer", replicaIP, "error", err)
+		sp.fail(err)
+		return false
+	}
+
+	s.mu.Lock()
+	//set local VC to grabbed VC
+	s.localVector = repVC.copyOf(len(s.localVector))
+	oldStore, oldExpiries := s.store, s.expiries
+	s.replaceStore(newStore)
+	s.expiries = newExpiries
+	//and log whatever changed, so anyone following our log catches up too
+	s.logRecovery(oldStore, oldExpiries, newStore, newExpiries, repVC, s.indexOf(replicaIP))
+	s.mu.Unlock()
+	s.log.info("recovered store from peer", "peer", replicaIP, "vector_clock", repVC, "keys", len(newStore))
+
+	//and push our Ip to the replica Array
+	s.pushIpToReplicas(ctx)
+	return true
+}
+
+// Function used to send our IP to a replica's view array
+func (s *Server) pushIpToReplicas(ctx context.Context) {
+	ctx, sp := s.tracer.start(ctx, "announce rejoin", spanInternal)
+	defer sp.finish()
+
+	// with raft, the group puts us back in everyone's view
+	if s.raft != nil {
+		s.rejoinRaft(ctx)
+		return
+	}
+
+	s.mu.Lock()
+	replicas := append([]string(nil), s.replicaArray...)
+	// making a change to their views, and map our socket address
+	change := viewChange{SocketAddress: s.sAddress, Epoch: s.nextViewEpoch()}
+	s.mu.Unlock()
+
+	// checking each replica IP of all replicas
+	for _, replicaIP := range replicas {
+		// if the replica IP is not our own
+		if replicaIP != s.sAddress {
+			// PUTting our IP in the replica's view array
+			_, err := s.sendViewChange(ctx, "PUT", replicaIP, change)
+			var stale *errStaleView
+			if errors.As(err, &stale) {
+				// we were down for a while, so the view moved on without us; we have its epoch now, so we go again
+				// in a newer one
+				s.mu.Lock()
+				change.Epoch = s.nextViewEpoch()
+				s.mu.Unlock()
+				_, err = s.sendViewChange(ctx, "PUT", replicaIP, change)
+			}
+			if err != nil {
+				s.log.warn("could not add ourselves to peer's view", "peer", replicaIP, "error", err)
+				sp.fail(err)
+				return
+			}
+		}
+	}
+
+}
+
+// Function used to get the kvs store of another replica, along with the expiry of any keys that have a TTL
+func (s *Server) getReplicaKVS(ctx context.Context, replicaIP string) (map[string]interface{}, map[string]keyExpiry, error) {
+	var response struct {
+		KVS map[string]interface{} `json:"KVS"`
+		TTL map[string]keyExpiry   `json:"TTL"`
+	}
+
+	// Creating new request, and decoding its response
+	if err := s.getPeerJSON(ctx, replicaIP, "/getKVS", &response); err != nil {
+		return nil, nil, err
+	}
+
+	// replicas that predate TTLs don't send any, so make sure we never hand back a nil map
+	if response.KVS == nil {
+		response.KVS = make(map[string]interface{})
+	}
+	if response.TTL == nil {
+		response.TTL = make(map[string]keyExpiry)
+	}
+
+	// returning the KVS
+	return response.KVS, response.TTL, nil
+}
+
+// Function used  to get the vector clock of another replica
+func (s *Server) getReplicaVectorClock(ctx context.Context, replicaIP string) (vectorClock, error) {
+	var response VectorClock
+
+	// Creating new request, and decoding its response
+	if err := s.getPeerJSON(ctx, replicaIP, "/getVC", &response); err != nil {
+		return nil, err
+	}
+
+	// returning the VC from other replica
+	return response.VC, nil
+}
+
+// Helper function that GETs a path from another replica and decodes its JSON answer into v
+func (s *Server) getPeerJSON(ctx context.Context, replicaIP string, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.peerURL(replicaIP, path), nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", path, res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("bad answer to %s: %w", path, err)
+	}
+	return nil
+}
+
+//initial approach at fault testing our replicas
+//each replica wouldd have a go routine that would, every few seconds, ping each replica in view and make sure its alive
+//if not, it would remove the replica from view
+//this function creation was cut short when we realized that an easier solution would be to just let the replica itself do the heavy lifting
+//and work on its own to request updated data and put itself back in the replica view
+/*
+func aliveCheck() {
+	//give other replicas time to start up
+	time.Sleep(1 * time.Second)
+
+	for aliveCheckConst {
+		for _, replicaIP := range viewArray {
+			if !isAlive(replicaIP) {
+				//if down, but still in our view, this is the first time we are seeing this replica go down, so we need to let the other replicas know and let them update accordingly
+				index := containsVal(replicaIP, replicaArray)
+				if index >= 0 {
+					//remove value from our own replica array
+					replicaArray = removeVal(index, replicaArray)
+
+					//send remove to other replica
+					for _, IP := range replicaArray {
+						if IP != sAddress {
+
+						}
+					}
+
+				}
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+}
+
+func isAlive(replicaIP string) bool {
+	reachedURL, err := net.DialTimeout("tcp", replicaIP, (2 * time.Second))
+	if err != nil {
+		fmt.Println(replicaIP, " is down! didnt reply within 2 seconds")
+		return false
+	}
+	reachedURL.Close()
+	return true
+}
+*/
+
+// Helper function that returns what a key adds to kvs_store_bytes: the key plus its value encoded as JSON
+func storedSize(key string, val interface{}) int {
+	encoded, _ := json.Marshal(val)
+	return len(key) + len(encoded)
+}
+
+// Helper function that sets a key in our store; must be called with s.mu held
+func (s *Server) setValue(key string, val interface{}) {
+	if old, ok := s.store[key]; ok {
+		s.storeBytes -= storedSize(key, old)
+	}
+	s.store[key] = val
+	s.storeBytes += storedSize(key, val)
+}
+
+// Helper function that deletes a key from our store; must be called with s.mu held
+func (s *Server) deleteValue(key string) {
+	if old, ok := s.store[key]; ok {
+		s.storeBytes -= storedSize(key, old)
+		delete(s.store, key)
+	}
+}
+
+// keyState is what our store and TTLs held for a key at some point, so a change we couldn't log can be undone
+type keyState struct {
+	val      interface{}
+	stored   bool
+	exp      keyExpiry
+	expiring bool
+}
+
+// Helper function that returns what we hold for a key right now; must be called with s.mu held
+func (s *Server) keyState(key string) keyState {
+	var st keyState
+	st.val, st.stored = s.store[key]
+	st.exp, st.expiring = s.expiries[key]
+	return st
+}
+
+// Helper function that puts a key back the way keyState found it; must be called with s.mu held
+func (s *Server) restoreKey(key string, st keyState) {
+	if st.stored {
+		s.setValue(key, st.val)
+	} else {
+		s.deleteValue(key)
+	}
+	if st.expiring {
+		s.expiries[key] = st.exp
+	} else {
+		delete(s.expiries, key)
+	}
+}
+
+// Helper function that replaces our whole store, e.g. with one we recovered from another replica; must be called with
+// s.mu held
+func (s *Server) replaceStore(store map[string]interface{}) {
+	s.store = store
+	s.storeBytes = 0
+	for key, val := range store {
+		s.storeBytes += storedSize(key, val)
+	}
+}
+
+// Helper function used to check if the database has been changed
+func isDatabaseChanged(response map[string]interface{}) bool {
+
+	//check if a value actually got added to db, and if so we need to alert the other replicas
+	if _, ok := response["result"]; ok {
+		val := response["result"]
+		if val == "created" || val == "updated" || val == "deleted" {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function used to broadcast a message to a replica
+// Returns the status and body the replica answered with, or the error if it couldn't be reached (the message may or
+// may not have arrived then); the caller decides whether that makes the replica down
+func (s *Server) broadcastMessage(ctx context.Context, replicaIP string, req *http.Request, updatedBody []byte) (status int, body []byte, err error) {
+	ctx, sp := s.tracer.start(ctx, "broadcast", spanInternal, "peer", replicaIP, "path", req.URL.Path)
+	defer func() {
+		sp.set("status", status)
+		sp.fail(err)
+		sp.finish()
+	}()
+
+	// Creating new request, sent to wherever the replica serves its internal API if that's what it is for
+	target := replicaIP
+	if strings.HasPrefix(req.URL.Path, "/internal/") {
+		target = s.internalAddress(replicaIP)
+	}
+	// the id of the client request that caused this goes along, so the replica logs the write under the same id
+	requestID := req.Header.Get(requestIDHeader)
+	log := s.log.with("peer", replicaIP, "request_id", requestID)
+	log.debug("broadcasting", "method", req.Method, "url", s.peerURL(target, req.URL.Path))
+	req, err = http.NewRequestWithContext(ctx, req.Method, s.peerURL(target, req.URL.Path), bytes.NewBuffer(updatedBody))
+	if err != nil {
+		log.error("problem creating broadcast request", "error", err)
+		return 0, nil, err
+	}
+	if requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+
+	// Forwarding the new request
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.warn("broadcast failed", "error", err)
+		return 0, nil, err
+	}
+	// Closing body of resp, typical after using Client.do()
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// Helper function used to remove a replica we found to be down from our view, and tell the rest of the view about it
+func (s *Server) markDown(ctx context.Context, replicaIP string) {
+	ctx, sp := s.tracer.start(ctx, "announce peer down", spanInternal, "peer", replicaIP)
+	defer sp.finish()
+
+	// with raft, the replica is only out of the view once the group agrees it is, on every replica at once
+	if s.raft != nil {
+		if err := s.proposeView(ctx, "view-remove", replicaIP); err != nil {
+			s.log.warn("could not take peer out of the view", "peer", replicaIP, "error", err)
+			sp.fail(err)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	// finding the index of the replica in array of online replicas
+	i := containsVal(replicaIP, s.replicaArray)
+	if i >= 0 {
+		// removing that index from the array of online replicas
+		s.replicaArray = removeVal(i, s.replicaArray)
+	}
+	// making a variable to hold replicaIP, and the epoch of the view without it
+	change := viewChange{SocketAddress: replicaIP, Epoch: s.nextViewEpoch()}
+	s.log.info("removed peer from view", "peer", replicaIP, "view", s.replicaArray, "epoch", change.Epoch)
+	replicas := append([]string(nil), s.replicaArray...)
+	s.mu.Unlock()
+
+	// Looping thru all replica IPs in replicaArray
+	for _, repIP := range replicas {
+		// if that replica IP is not the one we are broadcasting to, and is not our current replica
+		if repIP != replicaIP && repIP != s.sAddress {
+			s.log.debug("announcing peer is down", "to", repIP, "peer", replicaIP)
+
+			// checking if repIP is reachable
+			if !s.isReachable(ctx, repIP, s.cfg.AnnounceTimeout) {
+				s.log.warn("could not announce peer is down", "to", repIP, "peer", replicaIP)
+				sp.fail(fmt.Errorf("%s is unreachable", repIP))
+				return
+			}
+
+			// Sending delete request to delete the down replica IP from a replica's view
+			_, err := s.sendViewChange(ctx, "DELETE", repIP, change)
+			var stale *errStaleView
+			if errors.As(err, &stale) {
+				// it has seen a newer view than ours (maybe one the replica is back in), which is the one that counts
+				s.log.debug("peer has a newer view", "to", repIP, "peer", replicaIP, "epoch", stale.epoch)
+				continue
+			}
+			if err != nil {
+				s.log.warn("could not announce peer is down", "to", repIP, "peer", replicaIP, "error", err)
+				sp.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// Helper function used to check if a replica answers within the timeout
+// This goes through our transport rather than dialing the replica directly, so it works with any transport
+func (s *Server) isReachable(ctx context.Context, replicaIP string, timeout time.Duration) (reachable bool) {
+	ctx, sp := s.tracer.start(ctx, "reach peer", spanInternal, "peer", replicaIP, "timeout", timeout.String())
+	defer func() {
+		sp.set("reachable", reachable)
+		sp.finish()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.peerURL(replicaIP, "/getVC"), nil)
+	if err != nil {
+		return false
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return true
+}
+
+// func inReplicaArray(addr string) bool {
+// 	for _, viewIP := range replicaArray {
+// 		if viewIP == addr {
+// 			return true
+// 		}
+// 	}
+// 	return false
+// }
+
+// Helper function to check if an array contains a certain value, and at what index
+func containsVal(val string, repArray []string) int {
+	for index, a := range repArray {
+		if a == val {
+			return index
+		}
+	}
+	return -1
+}
+
+// Helper function to remove a Value from a certain string array
+func removeVal(index int, repArray []string) []string {
+	repArray[index] = repArray[len(repArray)-1]
+	return repArray[:len(repArray)-1]
+}
+
+// Handler Function that handles when we are given a request to return
+// our local VC, which we send out as a JSON object
+func (s *Server) handleGetVC(w http.ResponseWriter, req *http.Request) error {
+	response := make(map[string]interface{})
+
+	s.mu.Lock()
+	if req.Method == "GET" {
+		response["VC"] = s.localVector.clone()
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, response)
+	return nil
+}
+
+// Handler functuon that handles when we are guven a request to return
+// our local KVS, which we send out as json object
+func (s *Server) handleGetKVS(w http.ResponseWriter, req *http.Request) error {
+	response := make(map[string]interface{})
+
+	// marshalling while we still hold the lock, since the maps keep changing once we let go
+	s.mu.Lock()
+	if req.Method == "GET" {
+		response["KVS"] = s.store
+		response["TTL"] = s.expiries
+	}
+	jsonResponse, err := json.Marshal(response)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+	return nil
+}
+
+// Handler function that lists the keys in our KVS (only those starting with ?prefix=, if given)
+// With access control on, only the keys the client may read are listed
+func (s *Server) handleListKeys(w http.ResponseWriter, req *http.Request) error {
+	response := make(map[string]interface{})
+
+	p, err := s.authenticate(req)
+	if err != nil {
+		s.deny(w, req, http.StatusUnauthorized, "", "", err.Error())
+		return nil
+	}
+	if req.Method != "GET" {
+		return errMethodNotAllowed
+	}
+
+	prefix := req.URL.Query().Get("prefix")
+	keys := []string{}
+	s.mu.Lock()
+	for key := range s.store {
+		// a key from before its prefix was made linearizable is hidden by it
+		if strings.HasPrefix(key, prefix) && (p == nil || p.can(key, false)) && !s.isLinearizable(key) && s.hasKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	// linearizable keys are listed as this replica has them, which may be a little behind
+	for key, val := range s.linear {
+		if strings.HasPrefix(key, prefix) && (p == nil || p.can(key, false)) && !val.expired() {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+
+	response["keys"] = keys
+	writeJSON(w, http.StatusOK, response)
+	return nil
+}
+
+// Handler function that handles all operations wheb we are  given
+// requests regarding our KVS
+// Only clients use this; other replicas send us their writes through /internal/replicate (see internal.go)
+func (s *Server) handleKey(w http.ResponseWriter, req *http.Request) error {
+
+	// grabbing params to be used
+	param := mux.Vars(req)
+	key := param["key"]
+
+	// checking the client may do this to the key at all (anything but GET changes it)
+	if _, ok := s.authorize(w, req, key, req.Method != "GET"); !ok {
+		return nil
+	}
+
+	// initilizations of necessary variables
+	response := make(map[string]interface{})
+	status := http.StatusOK
+	var apiErr *apiError
+	var responseMetadata ReqMetaData
+	responseMetadata.IsReqFromClient = true
+
+	// create dict variable to hold inputted value
+	var reqVals message
+
+	// handles pulling out and storing value into newVal; a GET or DELETE with no body at all just has no causal metadata
+	err := json.NewDecoder(req.Body).Decode(&reqVals)
+	if err != nil && err != io.EOF {
+		return errInvalidJSON.because(err)
+	}
+
+	// keys that have to be linearizable go through the raft group instead, see linear.go
+	if s.isLinearizable(key) {
+		return s.handleLinearKey(w, req, key, reqVals)
+	}
+
+	// assigning metadata from our request
+	metadata := reqVals.CausalMetadata
+
+	// everything from the causal check to logging the change happens under the lock, so no other request
+	// can slip in between checking our vector clock and updating it
+	s.mu.Lock()
+
+	log := loggerFrom(req.Context()).with("key", key, "method", req.Method)
+	log.debug("client request", "vector_clock", s.localVector)
+
+	_, causal := s.tracer.start(req.Context(), "causal check", spanInternal, "vector_clock", s.localVector.clone())
+
+	// If metadata is not empty, we  know that this is not first interaction with client
+	if metadata != nil {
+		causal.set("request_vector_clock", metadata.ReqVector)
+		reqVector := metadata.ReqVector
+		log.debug("client causal metadata", "request_vector_clock", reqVector)
+
+		if !metadata.IsReqFromClient {
+			// only replicas send writes that skip the client's causal check, and they don't send them here
+			apiErr = errReplicationMetadata
+		} else {
+			//check for consistency violations
+			if !s.localVector.covers(reqVector) {
+				//consistency violation
+				apiErr = errCausalDependency
+			}
+		}
+	}
+
+	if apiErr != nil {
+		causal.fail(apiErr)
+	}
+	causal.finish()
+
+	// a request that got in just before we started shutting down (or leaving the cluster) may still read, but a write
+	// now could miss the writes we hand off
+	if apiErr == nil && s.draining && req.Method != "GET" {
+		apiErr = errShuttingDown
+	}
+
+	// the broadcast we may need to wait on once we let go of the lock, and the log entry that has to be on disk first
+	var rep *replication
+	var lsn int64
+
+	if apiErr == nil {
+		_, apply := s.tracer.start(req.Context(), "apply", spanInternal, "key", key, "method", req.Method)
+
+		// what the key and our clock were, to put back if the change can't be logged
+		before := s.keyState(key)
+		clock := s.localVector.clone()
+
+		// PUT case
+		if req.Method == "PUT" {
+
+			val := reqVals.Value
+			// handling cases where user input is:
+			// 1. invalid (key too long)
+			// 2. invalid (no value specified)
+			// 3. being replaced (key already exists)
+			// 4. being created (key does not exist)
+			if len(key) > 50 {
+				apiErr = errKeyTooLong
+			} else if val == nil {
+				apiErr = errValueMissing
+			} else if !validTTL(reqVals.TTL) {
+				apiErr = errInvalidTTL
+			} else if s.hasKey(key) {
+				status = http.StatusOK
+				response["result"] = "updated"
+				s.setValue(key, val)
+			} else {
+				status = http.StatusCreated
+				response["result"] = "created"
+				s.setValue(key, val)
+			}
+
+			// every successful PUT replaces whatever TTL the key had before
+			if _, ok := response["result"]; ok {
+				s.setExpiry(key, reqVals.TTL)
+			}
+
+			// GET case
+		} else if req.Method == "GET" {
+
+			// handling cases where user input is:
+			// 1. valid (key exists)
+			// 2. invalid (key does not exist, or its TTL ran out and the delete hasn't reached us yet)
+			if s.hasKey(key) {
+				status = http.StatusOK
+				response["result"] = "found"
+				response["value"] = s.store[key]
+				if exp, ok := s.expiries[key]; ok {
+					response["ttl"] = exp.remaining().Seconds()
+				}
+			} else {
+				apiErr = errKeyNotFound
+			}
+
+			// DELETE case
+		} else if req.Method == "DELETE" {
+
+			// handling cases where user input is;
+			// 1. valid (key exists)
+			// 2. invalid (key does not exist, or has expired)
+			if s.hasKey(key) {
+				status = http.StatusOK
+				response["result"] = "deleted"
+				s.deleteValue(key)
+				delete(s.expiries, key)
+			} else {
+				apiErr = errKeyNotFound
+			}
+		}
+
+		// reassigning necessary values in our response metadata
+		responseMetadata.ReqVector = s.localVector.clone()
+		responseMetadata.ReqIpIndex = s.vectorIndex
+
+		// checking if we changed our database, and if so, to increment VC
+		if isDatabaseChanged(response) {
+			s.localVector[s.vectorIndex]++
+
+			//update response to updated clock index
+			responseMetadata.ReqVector = s.localVector.clone()
+
+			// recording the change in our log, which is what watchers, /changes and the other replicas all see
+			entry := logEntry{Key: key, Op: "delete", VectorClock: s.localVector.clone(), Origin: s.vectorIndex, RequestID: requestIDFrom(req.Context())}
+			if req.Method == "PUT" {
+				entry.Op = "put"
+				entry.Value = reqVals.Value
+				// replicas all need to agree on when the key expires, so we log the deadline rather than the TTL
+				if exp, ok := s.expiries[key]; ok {
+					expiresAt := exp.ExpiresAt
+					entry.ExpiresAt = &expiresAt
+				}
+			}
+			if logged, err := s.appendLog(entry); err != nil {
+				// a write we can't log would be lost on a restart, so it isn't made at all
+				s.restoreKey(key, before)
+				s.localVector = clock
+				responseMetadata.ReqVector = clock.clone()
+				delete(response, "result")
+				apiErr = errLogWrite.because(err)
+			} else {
+				// and queueing it for the other replicas
+				lsn = logged.LSN
+				rep = s.replicate(req.Context(), logged)
+			}
+		}
+		apply.set("result", response["result"], "vector_clock", s.localVector.clone())
+		if apiErr != nil {
+			apply.fail(apiErr)
+		}
+		apply.finish()
+
+		//set responses metadata to updated metadata
+		response["causal-metadata"] = responseMetadata
+	}
+	if rep != nil {
+		log.info("write accepted", "result", response["result"], "vector_clock", s.localVector)
+	} else if apiErr != nil {
+		log.debug("client request refused", "error", apiErr.Code, "vector_clock", s.localVector)
+	}
+	s.mu.Unlock()
+
+	// the write only counts once it is on disk here, which is done without the lock so other writes can share the sync
+	if rep != nil {
+		if err := s.syncLog(lsn); err != nil {
+			apiErr = errLogWrite.because(err)
+			rep = nil
+		}
+	}
+
+	// waiting for as many replicas as our ack policy asks for to get the write, for up to WriteTimeout
+	if rep != nil {
+		ctx, waiting := s.tracer.start(req.Context(), "wait for replicas", spanInternal, "ack_policy", string(s.ackPolicy), "needed", rep.needed)
+		ctx, cancel := context.WithTimeout(ctx, s.cfg.WriteTimeout)
+		acked, ok := rep.wait(ctx)
+		cancel()
+		waiting.set("acks", acked)
+		if !ok {
+			// the write is applied and logged here either way, and keeps going out to the replicas that don't have it
+			apiErr = errAckTimeout
+			response["acks"] = acked
+			response["needed"] = rep.needed
+			waiting.fail(apiErr)
+		}
+		waiting.finish()
+	}
+
+	if apiErr == errCausalDependency {
+		s.metrics.causalViolation("client")
+	}
+
+	// sending correct response / status code back to client (errors still carry our causal metadata, if we got that far)
+	if apiErr != nil {
+		writeError(w, req, apiErr, response)
+	} else {
+		writeJSON(w, status, response)
+	}
+	return nil
+}
+
+// Handler function that handles all program behavior regarding view operations
+// A PUT or DELETE made in an older epoch of the view than ours is turned away with 409 and our epoch, so a change that
+// was delayed can't undo a newer one (e.g. take out a replica that has come back since). One without an epoch is
+// only taken before our view has one
+func (s *Server) handleView(w http.ResponseWriter, req *http.Request) error {
+
+	response := make(map[string]interface{})
+	status := http.StatusOK
+
+	// create variable to hold inputted value
+	var newVal viewChange
+
+	// decoding before taking the lock, since reading the body can block
+	if req.Method == "PUT" || req.Method == "DELETE" {
+		err := json.NewDecoder(req.Body).Decode(&newVal)
+		if err != nil {
+			return errInvalidJSON.because(err)
+		}
+		if newVal.SocketAddress == "" {
+			return errSocketAddressMissing
+		}
+	}
+
+	// with raft, the change is proposed to the group rather than made here, and applied everywhere once it is agreed on
+	if s.raft != nil && (req.Method == "PUT" || req.Method == "DELETE") {
+		return s.proposeViewChange(w, req, newVal.SocketAddress)
+	}
+
+	s.mu.Lock()
+	if req.Method == "PUT" || req.Method == "DELETE" {
+		if newVal.Epoch < s.viewEpoch {
+			response["epoch"] = s.viewEpoch
+			s.mu.Unlock()
+			loggerFrom(req.Context()).info("stale view change refused", "method", req.Method, "peer", newVal.SocketAddress, "epoch", newVal.Epoch)
+			writeError(w, req, errStaleViewEpoch, response)
+			return nil
+		}
+		// the change is from the newest view anyone has seen, whether it changes ours or not
+		s.observeViewEpoch(newVal.Epoch)
+	}
+
+	if req.Method == "PUT" {
+		val := newVal.SocketAddress
+
+		// a replica that left the cluster can't come back into anyone's view
+		if s.retired[val] {
+			s.mu.Unlock()
+			return errReplicaRetired
+		}
+
+		// checking to make sure entry is already  present
+		// (every replica announces itself when it starts, so this is the case for the first one too)
+		if containsVal(val, s.replicaArray) >= 0 {
+			status = http.StatusOK
+			response["result"] = "already present"
+		} else {
+			s.replicaArray = append(s.replicaArray, val)
+			status = http.StatusCreated
+			response["result"] = "added"
+			s.replicaCount++
+			if newVal.Epoch == 0 {
+				s.nextViewEpoch()
+			}
+		}
+	} else if req.Method == "GET" {
+		// simply returning replica array for view
+		status = http.StatusOK
+		response["view"] = append([]string(nil), s.replicaArray...)
+
+	} else if req.Method == "DELETE" {
+		val := newVal.SocketAddress
+
+		// finding index of the value in replica array
+		index := containsVal(val, s.replicaArray)
+		// if it is found
+		if index >= 0 {
+			// delete the replica from view
+			s.replicaArray = removeVal(index, s.replicaArray)
+			status = http.StatusCreated
+			response["result"] = "deleted"
+			s.replicaCount--
+			if newVal.Epoch == 0 {
+				s.nextViewEpoch()
+			}
+		} else {
+			// returning when replica is not found
+			s.mu.Unlock()
+			return errReplicaNotInView
+		}
+	}
+
+	response["epoch"] = s.viewEpoch
+	if req.Method != "GET" {
+		loggerFrom(req.Context()).info("view updated", "method", req.Method, "peer", newVal.SocketAddress, "view", s.replicaArray, "epoch", s.viewEpoch)
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, status, response)
+	return nil
+}
+
+// Handler  function to handle program behavior when we need to restore
+// a replica after it has been down
+func (s *Server) handleDown(w http.ResponseWriter, req *http.Request) error {
+	// This function is passed in a "flag" parameter
+	// If the flag is set to 0 -- We must send the kvs store as a response
+	// If the flag is set to 1 -- We must get the store from response and copy into local kvs store
+	param := mux.Vars(req)
+	key := param["flag"]
+	intKey, err := strconv.Atoi(key)
+	if err != nil || (intKey != 0 && intKey != 1) {
+		return errInvalidFlag
+	}
+
+	response := make(map[string]interface{})
+
+	// checking for what the flag is set to
+	if intKey == 0 {
+		// sending out response as our kvs store
+		s.mu.Lock()
+		response["store"] = s.store
+		jsonResponse, err := json.Marshal(response)
+		s.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonResponse)
+		return nil
+	}
+
+	s.mu.Lock()
+	replicas := append([]string(nil), s.replicaArray...)
+	s.mu.Unlock()
+
+	// looping thru each replicaIP, until we find an IP that is not the current one and answers
+	for _, replicaIP := range replicas {
+		if replicaIP == s.sAddress {
+			continue
+		}
+
+		// once we find another replicaIP, we send to them a request for the kvs store
+		// note that we send the request to the handledown function, with the 0 flag
+		store, err := s.fetchDownStore(req.Context(), req.Method, replicaIP)
+		if err != nil {
+			loggerFrom(req.Context()).warn("could not get store from peer", "peer", replicaIP, "error", err)
+			continue
+		}
+
+		// reassigning our local kvs store to the one we got
+		s.mu.Lock()
+		oldStore := s.store
+		s.replaceStore(store)
+		s.logRecovery(oldStore, s.expiries, s.store, s.expiries, s.localVector, s.indexOf(replicaIP))
+		s.mu.Unlock()
+
+		// returning, because we only need to make the request once
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": "restored"})
+		return nil
+	}
+	return errPeerUnavailable
+}
+
+// Helper function that asks another replica for its store through /down/0
+func (s *Server) fetchDownStore(ctx context.Context, method string, replicaIP string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.peerURL(replicaIP, "/down/0"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forwarding the new request
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Closing body of resp, typical after using Client.do()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("answered %d", resp.StatusCode)
+	}
+
+	// grabbing the store from the request we made
+	var result struct {
+		Store map[string]interface{} `json:"store"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Store == nil {
+		result.Store = make(map[string]interface{})
+	}
+	return result.Store, nil
+}
@@ -0,0 +1,190 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clevalle/CSE138_Assignment3/client"
+)
+
+// Every replica's state is behind Server.mu, so clients hammering every replica at once must not race (run with
+// -race), and every write must reach every replica. Concurrent writes to one key are applied in the order each replica
+// gets them, so the stores are only compared when no two clients share a key
+func TestConcurrentClients(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas int
+		clients  int
+		keys     int
+		ops      int
+		shared   bool
+		deletes  bool
+	}{
+		{name: "one replica", replicas: 1, clients: 8, keys: 4, ops: 30, shared: true},
+		{name: "own keys", replicas: 3, clients: 6, keys: 2, ops: 20},
+		{name: "shared keys", replicas: 3, clients: 6, keys: 3, ops: 20, shared: true},
+		{name: "puts and deletes", replicas: 3, clients: 6, keys: 5, ops: 20, shared: true, deletes: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := startCluster(t, tt.replicas, nil)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.clients)
+			for c := 0; c < tt.clients; c++ {
+				wg.Add(1)
+				go func(c int) {
+					defer wg.Done()
+					session := client.NewSession(servers[c%len(servers)].sAddress)
+					ctx := context.Background()
+					for op := 0; op < tt.ops; op++ {
+						key := fmt.Sprintf("c%d-k%d", c, (op/2)%tt.keys)
+						if tt.shared {
+							key = fmt.Sprintf("k%d", (c+op)%tt.keys)
+						}
+						var err error
+						switch {
+						case tt.deletes && op%4 == 3:
+							err = session.Delete(ctx, key)
+						case op%2 == 1:
+							_, err = session.Get(ctx, key)
+						default:
+							_, err = session.Put(ctx, key, fmt.Sprintf("c%d-%d", c, op))
+						}
+						if err != nil && !errors.Is(err, client.ErrNotFound) {
+							errs <- fmt.Errorf("client %d, op %d on %s: %w", c, op, key, err)
+							return
+						}
+					}
+				}(c)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			delivered(t, servers)
+			if tt.shared && len(servers) > 1 {
+				return
+			}
+			want := tt.clients * tt.keys
+			if tt.shared {
+				want = tt.keys
+			}
+			if store := sameStore(t, servers); len(store) != want {
+				t.Errorf("store has %d keys, want %d: %v", len(store), want, store)
+			}
+		})
+	}
+}
+
+// A client's session carries its causal metadata from one replica to another, so it reads its own writes wherever it
+// goes
+func TestReadYourWritesAcrossReplicas(t *testing.T) {
+	servers := startCluster(t, 3, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	writer := client.NewSession(servers[0].sAddress)
+	if _, err := writer.Put(ctx, "x", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Put(ctx, "x", "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range servers {
+		reader := client.NewSession(s.sAddress)
+		reader.SetMetadata(writer.Metadata())
+		val, err := reader.Get(ctx, "x")
+		if err != nil {
+			t.Fatalf("%s: %v", s.sAddress, err)
+		}
+		if val != "second" {
+			t.Errorf("%s: got %v, want second", s.sAddress, val)
+		}
+	}
+}
+
+// New refuses a config it can't run with, saying why
+func TestNewConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cfg *Config)
+		wantErr string
+	}{
+		{name: "no socket address", change: func(cfg *Config) { cfg.SocketAddress = "" }, wantErr: "socket address is required"},
+		{name: "not in the view", change: func(cfg *Config) { cfg.View = []string{"127.0.0.1:2"} },
+			wantErr: "does not contain socket address 127.0.0.1:1"},
+		{name: "unknown ack policy", change: func(cfg *Config) { cfg.AckPolicy = "some" }, wantErr: `unknown ack policy "some"`},
+		{name: "negative timeout", change: func(cfg *Config) { cfg.RequestTimeout = -time.Second },
+			wantErr: "timeouts must not be negative"},
+		{name: "negative rate limit", change: func(cfg *Config) { cfg.RateLimit = -1 },
+			wantErr: "rate and concurrency limits must not be negative"},
+		{name: "unknown consensus", change: func(cfg *Config) { cfg.Consensus = "paxos" }, wantErr: `unknown consensus "paxos"`},
+		{name: "linearizable keys without raft", change: func(cfg *Config) { cfg.LinearizablePrefixes = []string{"lin-"} },
+			wantErr: "linearizable keys need raft consensus"},
+		{name: "access control without a secret", change: func(cfg *Config) { cfg.ACLFile = "acl.json" },
+			wantErr: "access control needs a cluster secret"},
+		{name: "certificate without a key", change: func(cfg *Config) { cfg.TLSCertFile = "cert.pem" },
+			wantErr: "TLS needs both a certificate and a key file"},
+		{name: "unknown log level", change: func(cfg *Config) { cfg.LogLevel = "loud" }, wantErr: "loud"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"})
+			tt.change(&cfg)
+			s, err := New(cfg)
+			if err == nil {
+				t.Fatalf("New() = %v, want an error", s)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("New() error = %q, want it to say %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Replicas keep all their state on their Server, so clusters started in the same process know nothing of each other
+func TestSeparateClusters(t *testing.T) {
+	first := startCluster(t, 2, nil)
+	second := startCluster(t, 2, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.NewSession(first[0].sAddress).Put(ctx, "x", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewSession(second[1].sAddress).Put(ctx, "x", "second"); err != nil {
+		t.Fatal(err)
+	}
+	delivered(t, first)
+	delivered(t, second)
+
+	for _, cluster := range []struct {
+		servers []*Server
+		want    string
+	}{{first, "first"}, {second, "second"}} {
+		if store := sameStore(t, cluster.servers); len(store) != 1 || store["x"] != cluster.want {
+			t.Errorf("store is %v, want only x = %s", store, cluster.want)
+		}
+		for _, s := range cluster.servers {
+			if view := viewOf(s); len(view) != 2 {
+				t.Errorf("%s has the view %v, want only its own cluster", s.sAddress, view)
+			}
+		}
+	}
+}
+
+// Helper function that returns a copy of a replica's view
+func viewOf(s *Server) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.replicaArray...)
+}
@@ -0,0 +1,174 @@
+package replica
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// how often Shutdown checks whether the replication queues are empty yet
+var drainPollInterval = 20 * time.Millisecond
+
+// Shutdown stops the replica gracefully, e.g. when it gets SIGTERM: it stops taking client requests, lets the ones being
+// handled finish, waits for every write still queued for another replica to reach it, tells the other replicas we are
+// leaving the view, and then stops like Stop does, with the operation log synced to disk
+// ctx (or ShutdownTimeout, if it has no deadline) bounds the waiting for requests and queues; writes that haven't
+// reached a replica by then are given up on (it copies a whole store from one of us when it next recovers), and
+// Shutdown reports how many were. Only the first call does any of this; any other waits for it and returns its error
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+// Helper function that does the work of Shutdown
+func (s *Server) shutdown(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.ShutdownTimeout)
+		defer cancel()
+	}
+
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	s.log.info("shutting down")
+
+	// streams to clients never end on their own, so they are ended here rather than waited on
+	s.closeSubscribers()
+
+	// waiting for the client requests being handled, which wait for their writes to reach as many replicas as our ack
+	// policy asks for
+	var err error
+	if s.httpServer != nil {
+		err = s.httpServer.Shutdown(ctx)
+		s.httpServer = nil
+	}
+
+	// then for the rest of our writes to reach every other replica
+	if drainErr := s.drainQueues(ctx); err == nil {
+		err = drainErr
+	}
+
+	s.announceDeparture()
+
+	// the deadline may well be up by now, but the internal API and the trace exporter still get a moment to finish
+	stopCtx, cancel := context.WithTimeout(context.Background(), s.cfg.AnnounceTimeout)
+	defer cancel()
+	if stopErr := s.Stop(stopCtx); err == nil {
+		err = stopErr
+	}
+	s.log.info("shut down")
+	return err
+}
+
+// Helper function that checks if Shutdown has started, in which case no new client requests are taken
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Helper function that ends every stream following our log (/watch and /changes)
+func (s *Server) closeSubscribers() {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	for sub := range s.logSubscribers {
+		delete(s.logSubscribers, sub)
+		close(sub.entries)
+	}
+}
+
+// Helper function that waits until nothing is queued for, or being sent to, any other replica (but the ones given), or
+// until ctx is done
+func (s *Server) drainQueues(ctx context.Context, except ...string) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		queues := make([]*peerQueue, 0, len(s.peers))
+		for addr, queue := range s.peers {
+			if containsVal(addr, except) < 0 {
+				queues = append(queues, queue)
+			}
+		}
+		s.mu.Unlock()
+
+		left := 0
+		for _, queue := range queues {
+			left += queue.unsent()
+		}
+		if left == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.log.warn("gave up on replicating writes", "writes", left, "error", ctx.Err())
+			return fmt.Errorf("replica: %d writes were not replicated before shutting down: %w", left, ctx.Err())
+		}
+	}
+}
+
+// Helper function that tells every other replica in our view to take us out of it, so they stop sending us writes
+// When we start again, recovery (didIDie) puts us back in their views
+func (s *Server) announceDeparture() {
+	if s.raft != nil {
+		// a replica that left the cluster is out of the view already
+		s.mu.Lock()
+		inView := containsVal(s.sAddress, s.replicaArray) >= 0
+		s.mu.Unlock()
+		if !inView {
+			return
+		}
+		ctx, sp := s.tracer.start(context.Background(), "announce departure", spanInternal)
+		defer sp.finish()
+		if err := s.proposeView(ctx, "view-remove", s.sAddress); err != nil {
+			s.log.warn("could not take ourselves out of the view", "error", err)
+			sp.fail(err)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	replicas := append([]string(nil), s.replicaArray...)
+	change := viewChange{SocketAddress: s.sAddress, Epoch: s.nextViewEpoch()}
+	s.mu.Unlock()
+
+	ctx, sp := s.tracer.start(context.Background(), "announce departure", spanInternal, "epoch", change.Epoch)
+	defer sp.finish()
+
+	for _, replicaIP := range replicas {
+		if replicaIP == s.sAddress {
+			continue
+		}
+		if err := s.leaveView(ctx, replicaIP, change); err != nil {
+			s.log.warn("could not tell peer we are leaving", "peer", replicaIP, "error", err)
+			sp.fail(err)
+			continue
+		}
+		s.log.info("left peer's view", "peer", replicaIP)
+	}
+}
+
+// Helper function that asks one replica to take us out of its view, giving it AnnounceTimeout to answer
+func (s *Server) leaveView(ctx context.Context, replicaIP string, change viewChange) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.AnnounceTimeout)
+	defer cancel()
+
+	status, err := s.sendViewChange(ctx, "DELETE", replicaIP, change)
+	if err != nil {
+		return err
+	}
+
+	// already being out of its view is just as good
+	if status/100 != 2 && status != http.StatusNotFound {
+		return fmt.Errorf("answered %d", status)
+	}
+	return nil
+}
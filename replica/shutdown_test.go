@@ -0,0 +1,159 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// holdingPeer stands in for another replica that refuses our writes until it is released, and records the writes it
+// took and the view changes it was sent, in order
+type holdingPeer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	released bool
+	events   []string
+}
+
+func newHoldingPeer(t *testing.T) *holdingPeer {
+	p := &holdingPeer{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/internal/replicate":
+			var msg replicationMessage
+			json.NewDecoder(req.Body).Decode(&msg)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if !p.released {
+				writeError(w, req, errCausalDependency, nil)
+				return
+			}
+			p.events = append(p.events, "write "+msg.Key)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"ack": msg.Seq, "result": "applied"})
+		case req.URL.Path == "/view" && req.Method == "DELETE":
+			var change viewChange
+			json.NewDecoder(req.Body).Decode(&change)
+			p.mu.Lock()
+			p.events = append(p.events, "leave "+change.SocketAddress)
+			p.mu.Unlock()
+			writeJSON(w, http.StatusOK, map[string]interface{}{"result": "deleted"})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *holdingPeer) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.released = true
+}
+
+func (p *holdingPeer) seen() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.events...)
+}
+
+// Helper function that makes a replica whose only other replica is the peer, with a write queued for it
+func newDrainingServer(t *testing.T, peer *holdingPeer) *Server {
+	t.Helper()
+	peerAddr := strings.TrimPrefix(peer.URL, "http://")
+	cfg := testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1", peerAddr})
+	cfg.AnnounceTimeout = time.Second
+	cfg.DependencyTimeout = 10 * time.Second
+	s := newServer(t, cfg)
+
+	s.mu.Lock()
+	s.replicate(context.Background(), logEntry{Key: "x", Op: "put", Value: 1.0, VectorClock: vectorClock{1, 0}})
+	s.mu.Unlock()
+	return s
+}
+
+// Shutting down turns away new requests at once, but waits for the writes still queued to reach the other replicas
+// before telling them we are leaving
+func TestShutdownDrains(t *testing.T) {
+	peer := newHoldingPeer(t)
+	s := newDrainingServer(t, peer)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	eventually(t, 5*time.Second, "the replica to start draining", s.isDraining)
+
+	for _, method := range []string{"PUT", "GET"} {
+		rec := serve(s, method, "/kvs/y", `{"value": 2}`)
+		if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), errShuttingDown.Code) {
+			t.Errorf("%s while draining = %d %s, want 503 %s", method, rec.Code, rec.Body, errShuttingDown.Code)
+		}
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown() = %v before the queued write reached the peer", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if events := peer.seen(); len(events) != 0 {
+		t.Errorf("peer saw %v while it refused the write, want nothing", events)
+	}
+
+	peer.release()
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown() = %v, want the write drained", err)
+	}
+	if events := peer.seen(); strings.Join(events, ", ") != "write x, leave 127.0.0.1:1" {
+		t.Errorf("peer saw %v, want the write and then us leaving", events)
+	}
+}
+
+// Writes that can't be replicated in time are given up on and reported, and we still leave the view; queues for the
+// replicas draining skips aren't waited on at all
+func TestShutdownGivesUp(t *testing.T) {
+	peer := newHoldingPeer(t)
+	s := newDrainingServer(t, peer)
+	peerAddr := strings.TrimPrefix(peer.URL, "http://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.drainQueues(ctx, peerAddr); err != nil {
+		t.Errorf("drainQueues() skipping the peer = %v, want nil", err)
+	}
+
+	err := s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "1 writes were not replicated") {
+		t.Errorf("Shutdown() = %v, want the write it gave up on reported", err)
+	}
+	if events := peer.seen(); strings.Join(events, ", ") != "leave 127.0.0.1:1" {
+		t.Errorf("peer saw %v, want us leaving without the write", events)
+	}
+}
+
+// The replicas left running take one that shut down out of their views, and keep taking writes
+func TestShutdownLeavesView(t *testing.T) {
+	servers := startCluster(t, 3, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := servers[2].Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range servers[:2] {
+		if view := viewOf(s); len(view) != 2 || containsVal(servers[2].sAddress, view) >= 0 {
+			t.Errorf("%s has view %v, want it without %s", s.sAddress, view, servers[2].sAddress)
+		}
+	}
+	if status, body := call(t, servers[0], "PUT", "/kvs/x", map[string]interface{}{"value": 1}); status != http.StatusCreated {
+		t.Errorf("PUT after a replica left = %d %v, want 201", status, body)
+	}
+}
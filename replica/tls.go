@@ -0,0 +1,134 @@
+package replica
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the certificate and key files are checked for changes
+var certReloadInterval = 5 * time.Second
+
+// certReloader holds the certificate the client API is served with, and loads it again whenever its files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time // modification times of the files the current certificate was loaded from
+	keyTime  time.Time
+}
+
+// Helper function that loads the certificate and key for the first time
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Helper function that loads the certificate and key again if either file changed since they were last loaded
+// Returns whether a new certificate was loaded; if loading fails the old certificate is kept
+func (c *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certTime) && keyInfo.ModTime().Equal(c.keyTime)
+	c.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.certTime = certInfo.ModTime()
+	c.keyTime = keyInfo.ModTime()
+	c.mu.Unlock()
+	return true, nil
+}
+
+// GetCertificate hands the current certificate to each TLS handshake
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// Function that checks for a new certificate every certReloadInterval until the replica is stopped
+func (s *Server) watchCertificate() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := s.certs.reload()
+		if err != nil {
+			// the files may be halfway through being replaced, so keep serving the old certificate and try again
+			s.log.warn("problem reloading TLS certificate", "file", s.certs.certFile, "error", err)
+		} else if reloaded {
+			s.log.info("reloaded TLS certificate", "file", s.certs.certFile)
+		}
+	}
+}
+
+// Helper function that returns the TLS config the client API is served with
+func (s *Server) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.certs.GetCertificate,
+	}
+}
+
+// Helper function that builds the transport we reach other replicas with when they serve TLS, trusting the CAs in
+// caFile (or the system's CAs if there is no file)
+func peerTransport(caFile string) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile == "" {
+		return transport, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	return transport, nil
+}
+
+// Helper function that returns the URL of a path on another replica
+// Everything goes over https when we serve TLS, except the internal API when it has its own listener
+func (s *Server) peerURL(addr string, path string) string {
+	scheme := "http"
+	if s.certs != nil && !(s.separateInternal() && strings.HasPrefix(path, "/internal/")) {
+		scheme = "https"
+	}
+	return scheme + "://" + addr + path
+}
@@ -0,0 +1,245 @@
+package replica
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Helper function that writes a self-signed certificate for 127.0.0.1 made out to the name, and its key, to the dir,
+// returning their paths; the certificate is its own CA
+func writeCert(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// Helper function that returns the name the certificate the reloader hands out is made out to
+func servedName(t *testing.T, c *certReloader) string {
+	t.Helper()
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+// The certificate is loaded again once its files change, and kept if the new files can't be loaded
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "first")
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// file systems only keep modification times so precisely, so each change is made to look a second later
+	touched := time.Now()
+	touch := func() {
+		touched = touched.Add(time.Second)
+		for _, file := range []string{certFile, keyFile} {
+			if err := os.Chtimes(file, touched, touched); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	steps := []struct {
+		name     string
+		change   func()
+		want     bool
+		wantErr  bool
+		wantName string
+	}{
+		{name: "unchanged", change: func() {}, wantName: "first"},
+		{name: "replaced", change: func() { writeCert(t, dir, "second"); touch() }, want: true, wantName: "second"},
+		{name: "broken", change: func() {
+			if err := os.WriteFile(certFile, []byte("not a certificate"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			touch()
+		}, wantErr: true, wantName: "second"},
+		{name: "missing", change: func() {
+			if err := os.Remove(keyFile); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: true, wantName: "second"},
+		{name: "fixed", change: func() { writeCert(t, dir, "third"); touch() }, want: true, wantName: "third"},
+	}
+	for _, step := range steps {
+		step.change()
+		reloaded, err := c.reload()
+		if reloaded != step.want || (err != nil) != step.wantErr {
+			t.Errorf("%s: reload() = %v, %v, want %v with error %v", step.name, reloaded, err, step.want, step.wantErr)
+		}
+		if name := servedName(t, c); name != step.wantName {
+			t.Errorf("%s: serving the certificate for %s, want %s", step.name, name, step.wantName)
+		}
+	}
+}
+
+// A replica with a certificate serves its client API over TLS only
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), "replica")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	cfg := testConfig(t, addr, []string{addr})
+	cfg.Listener = listener
+	cfg.TLSCertFile = certFile
+	cfg.TLSKeyFile = keyFile
+	cfg.TLSCAFile = certFile
+	s := newServer(t, cfg)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := peerTransport(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{name: "https", url: "https://" + addr + "/healthz", want: http.StatusOK},
+		{name: "plain http", url: "http://" + addr + "/healthz", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, err := http.NewRequestWithContext(ctx, "GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{Transport: transport}).Do(req)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: GET /healthz = %d, want %d", tt.name, res.StatusCode, tt.want)
+		}
+	}
+
+	// a client that doesn't trust the certificate can't reach the replica at all
+	_, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}}}).Get("https://" + addr + "/healthz")
+	if err == nil {
+		t.Error("GET /healthz succeeded without trusting the certificate")
+	}
+}
+
+func TestPeerTransport(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _ := writeCert(t, dir, "ca")
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("nothing here"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		caFile    string
+		wantErr   bool
+		wantRoots bool
+	}{
+		{name: "system CAs"},
+		{name: "CA file", caFile: certFile, wantRoots: true},
+		{name: "no certificates in the file", caFile: notPEM, wantErr: true},
+		{name: "no file", caFile: filepath.Join(dir, "missing.pem"), wantErr: true},
+	}
+	for _, tt := range tests {
+		transport, err := peerTransport(tt.caFile)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: peerTransport() error = %v, want one %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		config := transport.(*http.Transport).TLSClientConfig
+		if hasRoots := config != nil && config.RootCAs != nil; hasRoots != tt.wantRoots {
+			t.Errorf("%s: transport has its own CAs %v, want %v", tt.name, hasRoots, tt.wantRoots)
+		}
+	}
+}
+
+// Everything goes to other replicas over https once we serve TLS, but an internal API on its own listener stays plain
+func TestPeerURL(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), "replica")
+	tests := []struct {
+		name     string
+		tls      bool
+		internal string
+		path     string
+		want     string
+	}{
+		{name: "plain", path: "/internal/replicate", want: "http://10.0.0.2:8090/internal/replicate"},
+		{name: "TLS", tls: true, path: "/internal/replicate", want: "https://10.0.0.2:8090/internal/replicate"},
+		{name: "TLS with an internal listener", tls: true, internal: ":8091", path: "/internal/replicate",
+			want: "http://10.0.0.2:8090/internal/replicate"},
+		{name: "TLS with an internal listener, public path", tls: true, internal: ":8091", path: "/view",
+			want: "https://10.0.0.2:8090/view"},
+	}
+	for _, tt := range tests {
+		cfg := testConfig(t, "10.0.0.1:8090", []string{"10.0.0.1:8090", "10.0.0.2:8090"})
+		if tt.tls {
+			cfg.TLSCertFile, cfg.TLSKeyFile = certFile, keyFile
+		}
+		cfg.InternalListenAddress = tt.internal
+		s := newServer(t, cfg)
+		if got := s.peerURL("10.0.0.2:8090", tt.path); got != tt.want {
+			t.Errorf("%s: peerURL() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceparentHeader carries the trace a request belongs to between replicas (and from clients), as W3C trace context:
+// 00-<trace id>-<id of the span that sent it>-<flags>
+const traceparentHeader = "traceparent"
+
+// how often finished spans are exported, and how many are exported at once at most
+var traceExportInterval = 1 * time.Second
+
+const traceBatchSize = 256
+
+// spans that are finished while this many are already waiting to be exported are dropped, so a collector that can't
+// keep up never slows requests down
+const traceQueueSize = 4096
+
+// kinds of span, as OTLP numbers them
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// spanContext is what identifies a span to its children, including ones on other replicas
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool // whether the trace is being recorded; unsampled spans are passed on but never exported
+}
+
+// Helper function that checks if the context actually identifies a span (all-zero ids are invalid)
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// Helper function that writes the context as a traceparent header value
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.traceID[:]), hex.EncodeToString(sc.spanID[:]), flags)
+}
+
+// Helper function that reads a traceparent header value; ok is false if it isn't a valid one
+// Versions after 00 may add fields after the flags, which are ignored
+func parseTraceparent(header string) (sc spanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, sc.valid()
+}
+
+type spanContextKey struct{}
+
+// Helper function that returns a context carrying the given span context, which spans started from it are children of
+func withSpanContext(ctx context.Context, sc spanContext) context.Context {
+	if !sc.valid() {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// Helper function that returns the span context a context carries, if any
+func spanContextFrom(ctx context.Context) spanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(spanContext)
+	return sc
+}
+
+// span is one timed operation of a trace
+// A nil span ignores everything done to it, which is what the tracer hands out when tracing is off
+type span struct {
+	tracer  *tracer
+	name    string
+	kind    int
+	context spanContext
+	parent  [8]byte // zero for the first span of a trace
+	start   time.Time
+	end     time.Time
+	attrs   []interface{} // name, value pairs
+	failed  bool
+	message string // why the span failed
+	ended   bool
+}
+
+// Helper function that adds name, value pairs to the attributes of the span
+func (sp *span) set(attrs ...interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.attrs = append(sp.attrs, attrs...)
+}
+
+// Helper function that marks the span as failed because of the given error
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.failed = true
+	sp.message = err.Error()
+}
+
+// Helper function that ends the span and hands it over to be exported; anything done to it afterwards is ignored
+func (sp *span) finish() {
+	if sp == nil || sp.ended {
+		return
+	}
+	sp.ended = true
+	sp.end = time.Now()
+	if sp.context.sampled {
+		sp.tracer.queue(sp)
+	}
+}
+
+// tracer starts spans and exports the finished ones in batches, in the background, as OTLP JSON
+type tracer struct {
+	resource []otlpAttribute // describes this replica on every exported span
+	exporter spanExporter
+	log      *logger
+
+	spans    chan *span
+	mu       sync.Mutex
+	dropped  int
+	stop     chan struct{} // closed by shutdown
+	exported chan struct{} // closed once run stopped, with everything it was handed exported
+}
+
+// spanExporter sends a batch of spans, encoded as an OTLP JSON ExportTraceServiceRequest, wherever they go
+type spanExporter interface {
+	export(batch []byte) error
+	close() error
+}
+
+// Helper function that sets up the tracer of a replica, exporting to a file if traceFile is set and to an OTLP
+// collector if endpoint is set; returns nil (which starts nil spans) if neither is
+func newTracer(replicaAddr string, traceFile string, endpoint string, log *logger) (*tracer, error) {
+	var exporters multiExporter
+	if traceFile != "" {
+		f, err := os.OpenFile(traceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, &fileExporter{file: f})
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("trace endpoint %q is not an http(s) URL", endpoint)
+		}
+		// a bare collector address gets the path OTLP/HTTP collectors take traces at
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/traces"
+		}
+		exporters = append(exporters, &otlpExporter{url: u.String(), client: &http.Client{Timeout: 5 * time.Second}})
+	}
+	if len(exporters) == 0 {
+		return nil, nil
+	}
+
+	var exporter spanExporter = exporters
+	if len(exporters) == 1 {
+		exporter = exporters[0]
+	}
+	return &tracer{
+		resource: []otlpAttribute{
+			newOTLPAttribute("service.name", "kvs-replica"),
+			newOTLPAttribute("service.instance.id", replicaAddr),
+		},
+		exporter: exporter,
+		log:      log,
+		spans:    make(chan *span, traceQueueSize),
+		stop:     make(chan struct{}),
+		exported: make(chan struct{}),
+	}, nil
+}
+
+// Helper function that returns a context whose spans (and the spans of the requests it is used for, on the replicas
+// they go to) aren't exported, for requests so frequent their spans would bury the rest, e.g. raft heartbeats
+func untraced(ctx context.Context) context.Context {
+	var sc spanContext
+	rand.Read(sc.traceID[:])
+	rand.Read(sc.spanID[:])
+	return withSpanContext(ctx, sc)
+}
+
+// Helper function that starts a span as a child of the span ctx carries (or as the first span of a new trace), and
+// returns a context carrying the new span for its own children
+func (t *tracer) start(ctx context.Context, name string, kind int, attrs ...interface{}) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	sp := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	parent := spanContextFrom(ctx)
+	if parent.valid() {
+		sp.context.traceID = parent.traceID
+		sp.context.sampled = parent.sampled
+		sp.parent = parent.spanID
+	} else {
+		rand.Read(sp.context.traceID[:])
+		sp.context.sampled = true
+	}
+	rand.Read(sp.context.spanID[:])
+	return withSpanContext(ctx, sp.context), sp
+}
+
+// Helper function that hands a finished span to the exporter, or drops it if the exporter is too far behind
+func (t *tracer) queue(sp *span) {
+	select {
+	case t.spans <- sp:
+	default:
+		t.mu.Lock()
+		t.dropped++
+		t.mu.Unlock()
+	}
+}
+
+// Used to export finished spans until the tracer is shut down, then export whatever is left
+func (t *tracer) run() {
+	defer close(t.exported)
+
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	flush := func() {
+		if len(batch) > 0 {
+			if err := t.exporter.export(t.encode(batch)); err != nil {
+				t.log.warn("could not export spans", "spans", len(batch), "error", err)
+			}
+			batch = nil
+		}
+
+		t.mu.Lock()
+		dropped := t.dropped
+		t.dropped = 0
+		t.mu.Unlock()
+		if dropped > 0 {
+			t.log.warn("dropped spans, the exporter can't keep up", "spans", dropped)
+		}
+	}
+
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			flush()
+			if err := t.exporter.close(); err != nil {
+				t.log.warn("could not close span exporter", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// Used to stop exporting once every span finished so far is exported, waiting for that until ctx is done
+func (t *tracer) shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	select {
+	case <-t.exported:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// otlpAttribute and otlpValue are how OTLP JSON writes attributes
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // 64 bit integers are written as strings in OTLP JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+// Helper function that makes an attribute out of any value: numbers and booleans keep their type, errors are their
+// message, and anything else is written as JSON (e.g. a vector clock as "[1,0,0]")
+func newOTLPAttribute(key string, val interface{}) otlpAttribute {
+	attr := otlpAttribute{Key: key}
+	switch v := val.(type) {
+	case string:
+		attr.Value.StringValue = &v
+	case bool:
+		attr.Value.BoolValue = &v
+	case int, int32, int64, uint, uint32, uint64:
+		text := fmt.Sprint(v)
+		attr.Value.IntValue = &text
+	case float64:
+		attr.Value.DoubleValue = &v
+	case error:
+		text := v.Error()
+		attr.Value.StringValue = &text
+	default:
+		encoded, err := json.Marshal(v)
+		text := string(encoded)
+		if err != nil {
+			text = fmt.Sprint(v)
+		}
+		attr.Value.StringValue = &text
+	}
+	return attr
+}
+
+// otlpSpan is how OTLP JSON writes a span
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 is ok, 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+// Helper function that encodes a batch of spans as an OTLP JSON ExportTraceServiceRequest
+func (t *tracer) encode(batch []*span) []byte {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		encoded := otlpSpan{
+			TraceID:           hex.EncodeToString(sp.context.traceID[:]),
+			SpanID:            hex.EncodeToString(sp.context.spanID[:]),
+			Name:              sp.name,
+			Kind:              sp.kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		if sp.parent != [8]byte{} {
+			encoded.ParentSpanID = hex.EncodeToString(sp.parent[:])
+		}
+		for i := 0; i+1 < len(sp.attrs); i += 2 {
+			encoded.Attributes = append(encoded.Attributes, newOTLPAttribute(fmt.Sprint(sp.attrs[i]), sp.attrs[i+1]))
+		}
+		if sp.failed {
+			encoded.Status = otlpStatus{Code: 2, Message: sp.message}
+		}
+		spans = append(spans, encoded)
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": t.resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/clevalle/CSE138_Assignment3/replica"},
+				"spans": spans,
+			}},
+		}},
+	}
+	// everything in it always marshals
+	encoded, _ := json.Marshal(request)
+	return encoded
+}
+
+// fileExporter appends every batch to a file, one ExportTraceServiceRequest per line (like a collector's file exporter)
+type fileExporter struct {
+	file *os.File
+}
+
+func (e *fileExporter) export(batch []byte) error {
+	_, err := e.file.Write(append(batch, '\n'))
+	return err
+}
+
+func (e *fileExporter) close() error {
+	return e.file.Close()
+}
+
+// otlpExporter POSTs every batch to an OTLP/HTTP collector, as JSON
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (e *otlpExporter) export(batch []byte) error {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() error {
+	return nil
+}
+
+// multiExporter exports every batch to each of its exporters
+type multiExporter []spanExporter
+
+func (m multiExporter) export(batch []byte) error {
+	var first error
+	for _, e := range m {
+		if err := e.export(batch); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m multiExporter) close() error {
+	var first error
+	for _, e := range m {
+		if err := e.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// tracingTransport is a RoundTripper that records every request to another replica as a client span, and sends the
+// span along in a traceparent header so the replica's spans join the same trace
+type tracingTransport struct {
+	base   http.RoundTripper
+	tracer *tracer
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, sp := t.tracer.start(req.Context(), req.Method+" "+req.URL.Path, spanClient,
+		"http.method", req.Method, "http.url", req.URL.String(), "net.peer.name", req.URL.Host)
+	defer sp.finish()
+
+	// a RoundTripper mustn't change the request it is given
+	req = req.Clone(ctx)
+	req.Header.Set(traceparentHeader, spanContextFrom(ctx).traceparent())
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		sp.fail(err)
+		return nil, err
+	}
+	sp.set("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		sp.fail(fmt.Errorf("answered %d", resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// Used as router middleware to record every request as a server span, joining the trace of the replica or client
+// that sent it if it came with a traceparent header
+func (s *Server) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := routeOf(req)
+		// scrapes and liveness probes would only bury the traces worth looking at
+		if s.tracer == nil || route == "/metrics" || route == "/healthz" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		if parent, ok := parseTraceparent(req.Header.Get(traceparentHeader)); ok {
+			ctx = withSpanContext(ctx, parent)
+		}
+		ctx, sp := s.tracer.start(ctx, req.Method+" "+route, spanServer,
+			"http.method", req.Method, "http.route", route, "http.target", req.URL.Path, "request.id", requestIDFrom(ctx))
+
+		// every line logged while handling the request can then be found from the trace
+		if rc, ok := ctx.Value(requestContextKey{}).(*requestContext); ok {
+			rc.log = rc.log.with("trace_id", hex.EncodeToString(sp.context.traceID[:]))
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			// a panicking handler hasn't answered yet; recoverPanics answers it with a 500 further up
+			if p := recover(); p != nil {
+				sp.fail(fmt.Errorf("panic: %v", p))
+				sp.finish()
+				panic(p)
+			}
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			sp.set("http.status_code", status)
+			if status >= 500 {
+				sp.fail(fmt.Errorf("answered %d", status))
+			}
+			sp.finish()
+		}()
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+	})
+}
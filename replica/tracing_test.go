@@ -0,0 +1,300 @@
+package replica
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingExporter keeps every batch it is handed, for tests to look at
+type recordingExporter struct {
+	mu      sync.Mutex
+	batches [][]byte
+	closed  bool
+}
+
+func (e *recordingExporter) export(batch []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.batches = append(e.batches, batch)
+	return nil
+}
+
+func (e *recordingExporter) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	return nil
+}
+
+// Helper function that decodes the spans in exported OTLP JSON batches
+func decodeSpans(t *testing.T, batches [][]byte) []otlpSpan {
+	t.Helper()
+	var spans []otlpSpan
+	for _, batch := range batches {
+		var request struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(batch, &request); err != nil {
+			t.Fatalf("exported batch %s isn't OTLP JSON: %v", batch, err)
+		}
+		for _, resource := range request.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+// Helper function that returns the value of a span's attribute as written, or "" if it has none
+func attributeOf(sp otlpSpan, key string) string {
+	for _, attr := range sp.Attributes {
+		if attr.Key != key {
+			continue
+		}
+		switch {
+		case attr.Value.StringValue != nil:
+			return *attr.Value.StringValue
+		case attr.Value.IntValue != nil:
+			return *attr.Value.IntValue
+		}
+	}
+	return ""
+}
+
+// Helper function that starts a tracer exporting to a recordingExporter, and the function that stops it and returns
+// the spans it exported
+func startTestTracer(t *testing.T) (*tracer, func() []otlpSpan) {
+	t.Helper()
+	tr, err := newTracer("127.0.0.1:1", filepath.Join(t.TempDir(), "spans.json"), "", newLogger(os.Stderr, levelInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.exporter.close()
+	exporter := &recordingExporter{}
+	tr.exporter = exporter
+	go tr.run()
+
+	return tr, func() []otlpSpan {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tr.shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		exporter.mu.Lock()
+		defer exporter.mu.Unlock()
+		if !exporter.closed {
+			t.Error("the exporter wasn't closed on shutdown")
+		}
+		return decodeSpans(t, exporter.batches)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header      string
+		ok          bool
+		wantSampled bool
+	}{
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true, wantSampled: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ok: true},
+		{header: " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03 ", ok: true, wantSampled: true},
+		{header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-later-fields", ok: true, wantSampled: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-later-fields"},
+		{header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01"},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz"},
+		{header: ""},
+	}
+	for _, tt := range tests {
+		sc, ok := parseTraceparent(tt.header)
+		if ok != tt.ok || ok && sc.sampled != tt.wantSampled {
+			t.Errorf("parseTraceparent(%q) = sampled %v, %v, want sampled %v, %v", tt.header, sc.sampled, ok, tt.wantSampled, tt.ok)
+		}
+		if !ok {
+			continue
+		}
+		if again, _ := parseTraceparent(sc.traceparent()); again != sc {
+			t.Errorf("parseTraceparent(%q) doesn't read back as the same span context from %s", tt.header, sc.traceparent())
+		}
+	}
+}
+
+// Spans join the trace of the span their context carries, or start one; spans of traces that aren't sampled, and spans
+// of a tracer that isn't there, aren't exported
+func TestTracerStart(t *testing.T) {
+	var off *tracer
+	if ctx, sp := off.start(context.Background(), "nothing", spanInternal); sp != nil || spanContextFrom(ctx).valid() {
+		t.Error("a nil tracer started a span")
+	}
+
+	tr, stop := startTestTracer(t)
+	ctx, root := tr.start(context.Background(), "root", spanServer, "key", "x")
+	_, child := tr.start(ctx, "child", spanInternal)
+	child.fail(errKeyNotFound)
+	child.finish()
+	child.finish()
+	root.finish()
+	_, hidden := tr.start(untraced(context.Background()), "heartbeat", spanClient)
+	hidden.finish()
+
+	spans := stop()
+	if len(spans) != 2 {
+		t.Fatalf("exported %v, want the root and its child", spans)
+	}
+	exported := make(map[string]otlpSpan)
+	for _, sp := range spans {
+		exported[sp.Name] = sp
+	}
+	rootID := hex.EncodeToString(root.context.spanID[:])
+	if sp := exported["root"]; sp.ParentSpanID != "" || sp.SpanID != rootID || sp.Kind != spanServer ||
+		attributeOf(sp, "key") != "x" || sp.Status.Code != 1 {
+		t.Errorf("root span is %+v, want a first span of kind server with key x", sp)
+	}
+	if sp := exported["child"]; sp.TraceID != exported["root"].TraceID || sp.ParentSpanID != rootID ||
+		sp.Status.Code != 2 || sp.Status.Message != errKeyNotFound.Error() {
+		t.Errorf("child span is %+v, want a failed child of the root", sp)
+	}
+}
+
+// Requests to other replicas are recorded as client spans and carry them in their traceparent header
+func TestTracingTransport(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		received = append(received, req.Header.Get(traceparentHeader))
+		mu.Unlock()
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer peer.Close()
+
+	tr, stop := startTestTracer(t)
+	client := &http.Client{Transport: &tracingTransport{base: http.DefaultTransport, tracer: tr}}
+	parent, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	for _, path := range []string{"/view", "/fail"} {
+		req, err := http.NewRequestWithContext(withSpanContext(context.Background(), parent), "GET", peer.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	spans := stop()
+
+	if len(spans) != 2 || len(received) != 2 {
+		t.Fatalf("exported %v and sent %v, want a span and a header for each request", spans, received)
+	}
+	for i, sp := range spans {
+		sent, ok := parseTraceparent(received[i])
+		if !ok || hex.EncodeToString(sent.spanID[:]) != sp.SpanID || sent.traceID != parent.traceID {
+			t.Errorf("%s sent traceparent %q, want span %s of trace %x", sp.Name, received[i], sp.SpanID, parent.traceID)
+		}
+		if sp.Kind != spanClient || sp.ParentSpanID != "00f067aa0ba902b7" {
+			t.Errorf("%s is %+v, want a client span under the one its context carried", sp.Name, sp)
+		}
+	}
+	if spans[0].Status.Code != 1 || spans[1].Status.Code != 2 || attributeOf(spans[1], "http.status_code") != "503" {
+		t.Errorf("spans are %+v, want only the 503 to have failed", spans)
+	}
+}
+
+// Every request but scrapes and liveness probes is recorded under the trace it came with, and the spans of handling it
+// under its span; everything is in the trace file once the replica has stopped
+func TestTraceRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	cfg := testConfig(t, addr, []string{addr})
+	cfg.Listener = listener
+	cfg.TraceFile = filepath.Join(t.TempDir(), "spans.json")
+	s := newServer(t, cfg)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct {
+		method      string
+		path        string
+		body        string
+		traceparent string
+	}{
+		{method: "PUT", path: "/kvs/x", body: `{"value": 1}`, traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{method: "GET", path: "/kvs/x", traceparent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"},
+		{method: "GET", path: "/healthz"},
+		{method: "GET", path: "/metrics"},
+	}
+	for _, r := range requests {
+		req := httptest.NewRequest(r.method, r.path, strings.NewReader(r.body))
+		if r.traceparent != "" {
+			req.Header.Set(traceparentHeader, r.traceparent)
+		}
+		s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(cfg.TraceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var batches [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		batches = append(batches, append([]byte(nil), scanner.Bytes()...))
+	}
+	spans := decodeSpans(t, batches)
+
+	var server otlpSpan
+	for _, sp := range spans {
+		if sp.Kind == spanServer {
+			if server.Name != "" {
+				t.Errorf("recorded %s as well as %s, want only the sampled PUT", sp.Name, server.Name)
+			}
+			server = sp
+		}
+	}
+	if server.Name != "PUT /kvs/{key:.+}" || server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		server.ParentSpanID != "00f067aa0ba902b7" || attributeOf(server, "http.status_code") != "201" {
+		t.Fatalf("server span is %+v, want the PUT under the span it came with", server)
+	}
+	handled := make(map[string]bool)
+	for _, sp := range spans {
+		if sp.TraceID == server.TraceID && sp.ParentSpanID == server.SpanID {
+			handled[sp.Name] = true
+		}
+	}
+	if !handled["causal check"] || !handled["apply"] {
+		t.Errorf("spans under the PUT are %v, want the causal check and applying it", handled)
+	}
+}
@@ -0,0 +1,148 @@
+package replica
+
+import (
+	"context"
+	"time"
+)
+
+// keyExpiry records when a key with a TTL should be removed, and which replica is responsible for removing it
+type keyExpiry struct {
+	ExpiresAt int64 `json:"expires-at"` // unix time in milliseconds
+	Owner     int   `json:"owner"`      // vector index of the replica that accepted the PUT
+}
+
+// how often we look for keys whose TTL has run out
+var expiryInterval = 250 * time.Millisecond
+
+// the longest TTL a key can be given; a longer one wouldn't fit in a time.Duration
+const maxTTL = 100 * 365 * 24 * time.Hour
+
+// Helper function that checks a TTL a client gave us, in seconds, is positive and no longer than maxTTL (no TTL is fine)
+func validTTL(ttlSeconds *float64) bool {
+	return ttlSeconds == nil || (*ttlSeconds > 0 && *ttlSeconds <= maxTTL.Seconds())
+}
+
+// Helper function that returns how long the key has left before it expires
+func (exp keyExpiry) remaining() time.Duration {
+	left := time.Until(time.UnixMilli(exp.ExpiresAt))
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// Helper function that checks if the key has outlived its TTL; every replica reads it as gone from then on, even before
+// the delete from the replica that expires it gets here
+func (exp keyExpiry) expired() bool {
+	return time.Now().UnixMilli() >= exp.ExpiresAt
+}
+
+// Helper function that checks if we have the key, and its TTL (if it has one) hasn't run out; must be called with s.mu
+// held
+func (s *Server) hasKey(key string) bool {
+	if _, ok := s.store[key]; !ok {
+		return false
+	}
+	exp, ok := s.expiries[key]
+	return !ok || !exp.expired()
+}
+
+// Helper function used to record (or clear) the expiry of a key after a client's successful PUT
+// Clients give us a TTL in seconds, which we turn into an absolute deadline that we log and broadcast, so that every
+// replica agrees on when the key expires. Must be called with s.mu held
+func (s *Server) setExpiry(key string, ttlSeconds *float64) {
+	if ttlSeconds == nil {
+		delete(s.expiries, key)
+		return
+	}
+	ttl := time.Duration(*ttlSeconds * float64(time.Second))
+	s.expiries[key] = keyExpiry{
+		ExpiresAt: time.Now().Add(ttl).UnixMilli(),
+		Owner:     s.vectorIndex,
+	}
+}
+
+// Used to delete keys once their TTL has run out
+// Only the replica that accepted the PUT expires the key, and it does so the same way a client DELETE would:
+// by incrementing its own spot in the vector clock and broadcasting the delete, so every replica drops the key
+// at the same point in the causal order. If the owner is no longer in our view, the lowest indexed replica
+// left in the view takes over
+func (s *Server) expireKeys() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		// nobody is waiting on an expiry, so the deletes are just queued for the other replicas
+		// a replica on its way out (or not in yet) leaves its keys to the others
+		s.mu.Lock()
+		if s.draining || s.joining {
+			s.mu.Unlock()
+			continue
+		}
+		for key, exp := range s.expiries {
+			if exp.remaining() > 0 || !s.isExpiryOwner(exp.Owner) {
+				continue
+			}
+			if entry, ok := s.expireKey(key); ok {
+				ctx, sp := s.tracer.start(context.Background(), "expire key", spanInternal, "key", key, "vector_clock", entry.VectorClock)
+				s.replicate(ctx, entry)
+				sp.finish()
+			}
+		}
+		s.pruneLinear()
+		s.mu.Unlock()
+	}
+}
+
+// Helper function used to check if this replica is the one that should expire a key owned by the given replica
+// Must be called with s.mu held
+func (s *Server) isExpiryOwner(owner int) bool {
+	if owner == s.vectorIndex {
+		return true
+	}
+
+	// looking for the owner (and the lowest index) among the replicas still in our view
+	lowest := s.vectorIndex
+	for _, replicaIP := range s.replicaArray {
+		index := s.indexOf(replicaIP)
+		if index < 0 {
+			continue
+		}
+		if index == owner {
+			return false
+		}
+		if index < lowest {
+			lowest = index
+		}
+	}
+	return lowest == s.vectorIndex
+}
+
+// Helper function that deletes an expired key locally and logs the delete, returning the entry to broadcast
+// Must be called with s.mu held
+func (s *Server) expireKey(key string) (logEntry, bool) {
+	if _, ok := s.store[key]; !ok {
+		delete(s.expiries, key)
+		return logEntry{}, false
+	}
+
+	// the delete is logged and broadcast just like one a client sent us
+	// if it can't be logged, the key stays until it can, and reads as gone meanwhile
+	clock := s.localVector.clone()
+	clock[s.vectorIndex]++
+	entry, err := s.appendLog(logEntry{Key: key, Op: "delete", VectorClock: clock, Origin: s.vectorIndex})
+	if err != nil {
+		return logEntry{}, false
+	}
+	s.deleteValue(key)
+	delete(s.expiries, key)
+	s.localVector = clock
+	s.log.info("key expired", "key", key, "vector_clock", s.localVector)
+	return entry, true
+}
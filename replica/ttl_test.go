@@ -0,0 +1,179 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/clevalle/CSE138_Assignment3/client"
+)
+
+func TestValidTTL(t *testing.T) {
+	tests := []struct {
+		ttl  interface{} // nil for no TTL
+		want bool
+	}{
+		{ttl: nil, want: true},
+		{ttl: 0.5, want: true},
+		{ttl: 3600.0, want: true},
+		{ttl: maxTTL.Seconds(), want: true},
+		{ttl: 0.0},
+		{ttl: -1.0},
+		{ttl: maxTTL.Seconds() + 1},
+		{ttl: 1e12},
+	}
+	for _, tt := range tests {
+		var ttl *float64
+		if tt.ttl != nil {
+			seconds := tt.ttl.(float64)
+			ttl = &seconds
+		}
+		if got := validTTL(ttl); got != tt.want {
+			t.Errorf("validTTL(%v) = %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+// A TTL too long to be a time.Duration is refused rather than turned into a deadline that has already passed
+func TestPutTTLBounds(t *testing.T) {
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	tests := []struct {
+		body string
+		want int
+	}{
+		{body: `{"value": 1, "ttl": 60}`, want: http.StatusCreated},
+		{body: `{"value": 1, "ttl": 0}`, want: http.StatusBadRequest},
+		{body: `{"value": 1, "ttl": -5}`, want: http.StatusBadRequest},
+		{body: `{"value": 1, "ttl": 1e12}`, want: http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		if rec := serve(s, "PUT", fmt.Sprintf("/kvs/k%d", i), tt.body); rec.Code != tt.want {
+			t.Errorf("PUT %s = %d, want %d: %s", tt.body, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+// A key whose TTL has run out reads as gone on every replica, not only on the one that will send the delete
+func TestExpiredKeyReads(t *testing.T) {
+	const self, owner = "127.0.0.1:1", "127.0.0.1:2"
+	s := newServer(t, testConfig(t, self, []string{owner, self}))
+	s.mu.Lock()
+	s.setValue("gone", "v")
+	s.expiries["gone"] = keyExpiry{ExpiresAt: time.Now().Add(-time.Second).UnixMilli(), Owner: 0}
+	s.setValue("later", "v")
+	s.expiries["later"] = keyExpiry{ExpiresAt: time.Now().Add(time.Hour).UnixMilli(), Owner: 0}
+	s.setValue("forever", "v")
+	mine := s.isExpiryOwner(0)
+	s.mu.Unlock()
+	if mine {
+		t.Fatal("we shouldn't be the one to expire the key")
+	}
+
+	tests := []struct {
+		method string
+		key    string
+		want   int
+	}{
+		{method: "GET", key: "gone", want: http.StatusNotFound},
+		{method: "DELETE", key: "gone", want: http.StatusNotFound},
+		{method: "GET", key: "later", want: http.StatusOK},
+		{method: "GET", key: "forever", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := serve(s, tt.method, "/kvs/"+tt.key, ""); rec.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.key, rec.Code, tt.want, rec.Body)
+		}
+	}
+
+	var listing struct {
+		Keys []string `json:"keys"`
+	}
+	json.NewDecoder(serve(s, "GET", "/kvs", "").Body).Decode(&listing)
+	if len(listing.Keys) != 2 || listing.Keys[0] != "forever" || listing.Keys[1] != "later" {
+		t.Errorf("listed %v, want [forever later]", listing.Keys)
+	}
+}
+
+// The replica that accepted a PUT expires the key; once it is out of the view, the lowest indexed one left takes over
+func TestIsExpiryOwner(t *testing.T) {
+	members := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	tests := []struct {
+		name  string
+		self  int
+		view  []int // indexes of the members in our view
+		owner int
+		want  bool
+	}{
+		{name: "ours", self: 1, view: []int{0, 1, 2}, owner: 1, want: true},
+		{name: "owner in the view", self: 0, view: []int{0, 1, 2}, owner: 2},
+		{name: "owner gone, we are lowest", self: 1, view: []int{1, 2}, owner: 0, want: true},
+		{name: "owner gone, lower one left", self: 2, view: []int{0, 2}, owner: 1},
+		{name: "owner gone, only us left", self: 2, view: []int{2}, owner: 0, want: true},
+		{name: "owner never a member", self: 1, view: []int{1, 2}, owner: 5, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, testConfig(t, members[tt.self], members))
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.replicaArray = nil
+			for _, i := range tt.view {
+				s.replicaArray = append(s.replicaArray, members[i])
+			}
+			if got := s.isExpiryOwner(tt.owner); got != tt.want {
+				t.Errorf("isExpiryOwner(%d) = %v, want %v", tt.owner, got, tt.want)
+			}
+		})
+	}
+}
+
+// A key PUT with a TTL is gone from every replica once it runs out, unless a later PUT without one replaced it
+func TestKeyExpiry(t *testing.T) {
+	servers := startCluster(t, 3, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		key      string
+		replaced bool
+	}{
+		{key: "short"},
+		{key: "replaced", replaced: true},
+	}
+	session := client.NewSession(servers[1].sAddress)
+	for _, tt := range tests {
+		if _, err := session.PutWithTTL(ctx, tt.key, "v", 300*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if tt.replaced {
+			if _, err := session.Put(ctx, tt.key, "kept"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	delivered(t, servers)
+	for _, s := range servers {
+		if store := storeOf(s); len(store) != len(tests) {
+			t.Errorf("%s has %v before the TTL ran out", s.sAddress, store)
+		}
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	eventually(t, 5*time.Second, "the key to expire everywhere", func() bool {
+		for _, s := range servers {
+			if _, ok := storeOf(s)["short"]; ok {
+				return false
+			}
+		}
+		return true
+	})
+	delivered(t, servers)
+	for _, s := range servers {
+		if val := storeOf(s)["replaced"]; val != "kept" {
+			t.Errorf("%s has replaced = %v, want kept", s.sAddress, val)
+		}
+	}
+}
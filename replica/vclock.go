@@ -0,0 +1,57 @@
+package replica
+
+// vectorClock has one entry for every member the cluster has ever had, in the order they joined it (see
+// membership.go), so it grows when a replica joins. Clocks of different lengths are compared as if the shorter one
+// had zeros for the members it doesn't know about yet
+// It is a slice, so a clock handed to anyone outside the lock it is guarded by must be a copy
+type vectorClock []int
+
+// Helper function that returns the entry of the given member, which is 0 if the clock doesn't have one yet
+func (vc vectorClock) at(i int) int {
+	if i < 0 || i >= len(vc) {
+		return 0
+	}
+	return vc[i]
+}
+
+// Helper function that returns a copy of the clock, with at least size entries
+func (vc vectorClock) copyOf(size int) vectorClock {
+	if size < len(vc) {
+		size = len(vc)
+	}
+	copied := make(vectorClock, size)
+	copy(copied, vc)
+	return copied
+}
+
+// Helper function that returns a copy of the clock
+func (vc vectorClock) clone() vectorClock {
+	return vc.copyOf(len(vc))
+}
+
+// Helper function that checks if every entry of other is at most ours, i.e. we have seen everything other has
+func (vc vectorClock) covers(other vectorClock) bool {
+	for i, val := range other {
+		if val > vc.at(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function that checks if two clocks are the same
+func (vc vectorClock) equal(other vectorClock) bool {
+	return vc.covers(other) && other.covers(vc)
+}
+
+// Helper function that sets every entry of the clock to the max of it and other's, growing it if other is longer
+func (vc *vectorClock) merge(other vectorClock) {
+	if len(other) > len(*vc) {
+		*vc = vc.copyOf(len(other))
+	}
+	for i, val := range other {
+		if val > (*vc)[i] {
+			(*vc)[i] = val
+		}
+	}
+}
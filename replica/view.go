@@ -0,0 +1,179 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// viewChange is the body of PUT and DELETE /view: the replica to add to or take out of the view, and the epoch of the
+// view the change makes. Changes without an epoch (e.g. from an operator) are only applied while our view is still at
+// epoch 0, and start a new epoch; after that they could undo any change, so they are refused like stale ones
+type viewChange struct {
+	SocketAddress string `json:"socket-address"`
+	Epoch         uint64 `json:"epoch,omitempty"`
+}
+
+// errStaleView is what sendViewChange returns when the replica has seen a newer view than the change was made in
+type errStaleView struct {
+	epoch uint64
+}
+
+func (e *errStaleView) Error() string {
+	return fmt.Sprintf("view is already at epoch %d", e.epoch)
+}
+
+// Helper function that starts a new epoch of our view, for a change we make and tell the other replicas about
+// Must be called with s.mu held
+func (s *Server) nextViewEpoch() uint64 {
+	s.viewEpoch++
+	return s.viewEpoch
+}
+
+// Helper function that moves our view's epoch up to another replica's, if theirs is newer; returns whether it was
+// Must be called with s.mu held
+func (s *Server) observeViewEpoch(epoch uint64) bool {
+	if epoch <= s.viewEpoch {
+		return false
+	}
+	s.viewEpoch = epoch
+	return true
+}
+
+// Helper function that asks one replica to add a replica to (PUT) or take one out of (DELETE) its view
+// A replica that has seen a newer view than the change's answers 409 with its epoch, which we take as ours, and
+// *errStaleView is returned. Returns the status it answered with otherwise
+func (s *Server) sendViewChange(ctx context.Context, method string, replicaIP string, change viewChange) (int, error) {
+	// a viewChange always marshals
+	body, _ := json.Marshal(change)
+	req, err := http.NewRequestWithContext(ctx, method, s.peerURL(replicaIP, "/view"), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	var answer struct {
+		Code  string `json:"code"`
+		Epoch uint64 `json:"epoch"`
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	json.Unmarshal(data, &answer)
+	if res.StatusCode == errStaleViewEpoch.Status && answer.Code == errStaleViewEpoch.Code {
+		s.mu.Lock()
+		s.observeViewEpoch(answer.Epoch)
+		s.mu.Unlock()
+		return res.StatusCode, &errStaleView{epoch: answer.Epoch}
+	}
+	return res.StatusCode, nil
+}
+
+// Used when another replica turns out to be on a newer view than ours (its writes, or its acks of ours, carry the
+// epoch): we take its view, since it has seen every change we have and more. If it has since taken us out of its
+// view, we are clearly up, so we put ourselves back in everyone's
+// Only one of these runs at a time; the rest are dropped, as the one running brings us up to date anyway
+func (s *Server) syncView(replicaIP string) {
+	// with raft, the group's log brings us up to date instead
+	if s.raft != nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.viewSyncing {
+		s.mu.Unlock()
+		return
+	}
+	s.viewSyncing = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.viewSyncing = false
+		s.mu.Unlock()
+	}()
+
+	ctx, sp := s.tracer.start(context.Background(), "sync view", spanInternal, "peer", replicaIP)
+	defer sp.finish()
+
+	var response struct {
+		View  []string `json:"view"`
+		Epoch uint64   `json:"epoch"`
+	}
+	if err := s.getPeerJSON(ctx, replicaIP, "/view", &response); err != nil {
+		s.log.warn("could not get newer view", "peer", replicaIP, "error", err)
+		sp.fail(err)
+		return
+	}
+
+	s.mu.Lock()
+	if !s.observeViewEpoch(response.Epoch) {
+		s.mu.Unlock()
+		return
+	}
+	view := make([]string, 0, len(response.View))
+	for _, addr := range response.View {
+		if !s.retired[addr] {
+			view = append(view, addr)
+		}
+	}
+	missing := containsVal(s.sAddress, view) < 0
+	if missing {
+		view = append(view, s.sAddress)
+	}
+	s.replicaArray = view
+	s.log.info("took newer view from peer", "peer", replicaIP, "view", view, "epoch", response.Epoch)
+	s.mu.Unlock()
+	sp.set("epoch", response.Epoch, "view", view)
+
+	if missing {
+		s.pushIpToReplicas(ctx)
+	}
+}
+
+// Helper function that handles PUT or DELETE /view when the view is decided by raft: the change is checked against our
+// view, proposed to the group, and answered once it has been applied here. The epoch is the index of its entry
+func (s *Server) proposeViewChange(w http.ResponseWriter, req *http.Request, replicaIP string) error {
+	s.mu.Lock()
+	retired := s.retired[replicaIP]
+	present := containsVal(replicaIP, s.replicaArray) >= 0
+	epoch := s.viewEpoch
+	s.mu.Unlock()
+
+	op := "view-add"
+	if req.Method == "DELETE" {
+		op = "view-remove"
+		if !present {
+			return errReplicaNotInView
+		}
+	} else {
+		if retired {
+			return errReplicaRetired
+		}
+		if present {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"result": "already present", "epoch": epoch})
+			return nil
+		}
+	}
+
+	if err := s.proposeView(req.Context(), op, replicaIP); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	response := map[string]interface{}{"result": "added", "epoch": s.viewEpoch}
+	if op == "view-remove" {
+		response["result"] = "deleted"
+	}
+	loggerFrom(req.Context()).info("view updated", "method", req.Method, "peer", replicaIP, "view", s.replicaArray, "epoch", s.viewEpoch)
+	s.mu.Unlock()
+	writeJSON(w, http.StatusCreated, response)
+	return nil
+}
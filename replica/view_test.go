@@ -0,0 +1,65 @@
+package replica
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// A view change made in an older epoch than ours is turned away, so a delayed one can't undo a newer change; one
+// without an epoch is only taken while our view doesn't have one either
+func TestViewChangeEpochs(t *testing.T) {
+	const self, peer, other = "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"
+	tests := []struct {
+		name       string
+		epoch      uint64 // ours before the change
+		method     string
+		change     viewChange
+		wantStatus int
+		wantEpoch  uint64
+		wantView   []string
+	}{
+		{name: "no epoch, none yet", method: "PUT", change: viewChange{SocketAddress: other},
+			wantStatus: http.StatusCreated, wantEpoch: 1, wantView: []string{self, peer, other}},
+		{name: "no epoch, ours has one", epoch: 3, method: "PUT", change: viewChange{SocketAddress: other},
+			wantStatus: http.StatusConflict, wantEpoch: 3, wantView: []string{self, peer}},
+		{name: "older epoch", epoch: 3, method: "DELETE", change: viewChange{SocketAddress: peer, Epoch: 2},
+			wantStatus: http.StatusConflict, wantEpoch: 3, wantView: []string{self, peer}},
+		{name: "same epoch", epoch: 3, method: "PUT", change: viewChange{SocketAddress: other, Epoch: 3},
+			wantStatus: http.StatusCreated, wantEpoch: 3, wantView: []string{self, peer, other}},
+		{name: "newer epoch", epoch: 3, method: "DELETE", change: viewChange{SocketAddress: peer, Epoch: 5},
+			wantStatus: http.StatusCreated, wantEpoch: 5, wantView: []string{self}},
+		{name: "newer epoch, nothing to change", epoch: 3, method: "PUT", change: viewChange{SocketAddress: peer, Epoch: 5},
+			wantStatus: http.StatusOK, wantEpoch: 5, wantView: []string{self, peer}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, testConfig(t, self, []string{self, peer}))
+			s.mu.Lock()
+			s.viewEpoch = tt.epoch
+			s.mu.Unlock()
+
+			body, _ := json.Marshal(tt.change)
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, "/view", bytes.NewReader(body)))
+
+			var answer struct {
+				Epoch uint64 `json:"epoch"`
+			}
+			json.NewDecoder(rec.Body).Decode(&answer)
+			if rec.Code != tt.wantStatus || answer.Epoch != tt.wantEpoch {
+				t.Errorf("%s /view = %d with epoch %d, want %d with epoch %d", tt.method, rec.Code, answer.Epoch, tt.wantStatus, tt.wantEpoch)
+			}
+
+			s.mu.Lock()
+			view, epoch := append([]string(nil), s.replicaArray...), s.viewEpoch
+			s.mu.Unlock()
+			if !reflect.DeepEqual(view, tt.wantView) || epoch != tt.wantEpoch {
+				t.Errorf("view is %v at epoch %d, want %v at epoch %d", view, epoch, tt.wantView, tt.wantEpoch)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watcher is a single client subscribed to changes on a key, or on every key starting with a prefix
+type watcher struct {
+	key    string
+	prefix bool
+}
+
+// how often we send a comment down idle watch streams so proxies don't close them
+var watchKeepAlive = 15 * time.Second
+
+// Helper function that checks if a watcher is interested in an entry of our log
+func (wt *watcher) matches(entry logEntry) bool {
+	if wt.prefix {
+		return strings.HasPrefix(entry.Key, wt.key)
+	}
+	return entry.Key == wt.key
+}
+
+// Helper function that checks if a change already happened before (or at) the given vector clock
+func happenedBefore(event vectorClock, since vectorClock) bool {
+	return since.covers(event)
+}
+
+// Helper function used to parse a vector clock given as comma separated integers, e.g. "1,0,2"
+func parseVectorClock(raw string) (vectorClock, error) {
+	parts := strings.Split(raw, ",")
+	vc := make(vectorClock, len(parts))
+	for i, part := range parts {
+		val, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || val < 0 {
+			return nil, fmt.Errorf("invalid vector clock entry %q", part)
+		}
+		vc[i] = val
+	}
+	return vc, nil
+}
+
+// Helper function used to format a vector clock the same way parseVectorClock reads it
+func formatVectorClock(vc vectorClock) string {
+	parts := make([]string, len(vc))
+	for i, val := range vc {
+		parts[i] = strconv.Itoa(val)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Handler function that streams changes to a key (?key=) or a prefix (?prefix=) as Server-Sent Events
+// Watchers can resume with ?since=<vector clock> or the Last-Event-ID header, in which case every change in
+// our log that the given vector clock hasn't seen is sent first
+func (s *Server) handleWatch(w http.ResponseWriter, req *http.Request) {
+	response := make(map[string]interface{})
+
+	query := req.URL.Query()
+	wt := &watcher{}
+	if key := query.Get("key"); key != "" {
+		wt.key = key
+	} else if _, ok := query["prefix"]; ok {
+		wt.key = query.Get("prefix")
+		wt.prefix = true
+	} else {
+		response["error"] = "Watch must specify a key or a prefix"
+	}
+
+	since := query.Get("since")
+	if lastID := req.Header.Get("Last-Event-ID"); lastID != "" {
+		since = lastID
+	}
+	var sinceVector vectorClock
+	resume := since != ""
+	if resume {
+		vc, err := parseVectorClock(since)
+		if err != nil {
+			response["error"] = err.Error()
+		}
+		sinceVector = vc
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		response["error"] = "Streaming is not supported"
+	}
+
+	if _, isError := response["error"]; isError || req.Method != "GET" {
+		if !isError {
+			response["error"] = "Watch only supports GET"
+		}
+		writeError(w, req, errInvalidRequest.saying(response["error"].(string)), nil)
+		return
+	}
+
+	// clients are only sent changes to keys they may read
+	p, err := s.authenticate(req)
+	if err != nil {
+		s.deny(w, req, http.StatusUnauthorized, "", wt.key, err.Error())
+		return
+	}
+	if p != nil && !wt.prefix && !p.can(wt.key, false) {
+		s.deny(w, req, http.StatusForbidden, p.name, wt.key, "no read access")
+		return
+	}
+
+	// without a vector clock to resume from, the watcher only wants changes from now on, i.e. any not published yet
+	from := int64(1)
+	if !resume {
+		s.logMu.Lock()
+		from = s.logSynced + 1
+		s.logMu.Unlock()
+	}
+	backlog, sub := s.subscribeLog(from, p.readable(wt.matches))
+	defer s.unsubscribeLog(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for _, entry := range backlog {
+		// a linearizable write has no place in the vector clock, so there's no telling whether the watcher saw it
+		if entry.RaftIndex != 0 || !happenedBefore(entry.VectorClock, sinceVector) {
+			writeEvent(w, entry)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case entry, open := <-sub.entries:
+			if !open {
+				return
+			}
+			writeEvent(w, entry)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// Helper function that writes a single change out in Server-Sent Event format
+// The event id is the vector clock of the change, so a reconnecting browser resumes right where it left off
+func writeEvent(w http.ResponseWriter, entry logEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fallbackLogger.error("problem marshalling change event", "lsn", entry.LSN, "error", err)
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", formatVectorClock(entry.VectorClock), entry.Op, data)
+}
@@ -0,0 +1,185 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseVectorClock(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    vectorClock
+		wantErr bool
+	}{
+		{raw: "0", want: vectorClock{0}},
+		{raw: "1,0,2", want: vectorClock{1, 0, 2}},
+		{raw: " 3, 4 ", want: vectorClock{3, 4}},
+		{raw: "", wantErr: true},
+		{raw: "1,,2", wantErr: true},
+		{raw: "1,-1", wantErr: true},
+		{raw: "a,b", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseVectorClock(tt.raw)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseVectorClock(%q) = %v, %v; want %v (error %v)", tt.raw, got, err, tt.want, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr {
+			if again, _ := parseVectorClock(formatVectorClock(got)); !reflect.DeepEqual(again, got) {
+				t.Errorf("%v doesn't survive formatting and parsing again: %v", got, again)
+			}
+		}
+	}
+}
+
+func TestWatcherMatches(t *testing.T) {
+	tests := []struct {
+		watcher watcher
+		key     string
+		want    bool
+	}{
+		{watcher: watcher{key: "a"}, key: "a", want: true},
+		{watcher: watcher{key: "a"}, key: "ab"},
+		{watcher: watcher{key: "a/", prefix: true}, key: "a/b", want: true},
+		{watcher: watcher{key: "a/", prefix: true}, key: "b/a"},
+		{watcher: watcher{key: "", prefix: true}, key: "anything", want: true},
+	}
+	for _, tt := range tests {
+		if got := tt.watcher.matches(logEntry{Key: tt.key}); got != tt.want {
+			t.Errorf("%+v matches %q = %v, want %v", tt.watcher, tt.key, got, tt.want)
+		}
+	}
+}
+
+// sseEvent is one event read off a Server-Sent Events stream
+type sseEvent struct {
+	id    string
+	event string
+	entry logEntry
+}
+
+// Helper function that reads Server-Sent Events off a stream until it ends, sending each one on the channel
+func readEvents(body io.Reader, events chan<- sseEvent) {
+	defer close(events)
+	var ev sseEvent
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.entry)
+		case line == "" && ev.event != "":
+			events <- ev
+			ev = sseEvent{}
+		}
+	}
+}
+
+// Helper function that opens a watch stream, returning the events it sends
+func watch(t *testing.T, url string) <-chan sseEvent {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s = %d", url, res.StatusCode)
+	}
+	events := make(chan sseEvent, 16)
+	go readEvents(res.Body, events)
+	return events
+}
+
+// Helper function that waits for the next event of a stream, failing the test if none comes
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+// A watcher is sent the changes to what it watches as they happen, and on resuming, the ones it hasn't seen yet
+func TestWatch(t *testing.T) {
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	srv := httptest.NewServer(s.Handler())
+	// registered before the streams are opened, so they are closed first
+	t.Cleanup(srv.Close)
+
+	put := func(key string, body string) {
+		t.Helper()
+		if rec := serve(s, "PUT", "/kvs/"+key, body); rec.Code/100 != 2 {
+			t.Fatalf("PUT %s = %d: %s", key, rec.Code, rec.Body)
+		}
+	}
+	put("a", `{"value": 0}`)
+
+	byKey := watch(t, srv.URL+"/watch?key=a")
+	byPrefix := watch(t, srv.URL+"/watch?prefix=b/")
+	put("b/1", `{"value": 1}`)
+	put("a", `{"value": 2}`)
+	put("c", `{"value": 3}`)
+	if rec := serve(s, "DELETE", "/kvs/a", ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE a = %d", rec.Code)
+	}
+
+	tests := []struct {
+		name   string
+		events <-chan sseEvent
+		want   []string // op and key of each event
+	}{
+		{name: "key", events: byKey, want: []string{"put a", "delete a"}},
+		{name: "prefix", events: byPrefix, want: []string{"put b/1"}},
+		// the first PUT of a is at 1, which the watcher has seen
+		{name: "resumed", events: watch(t, srv.URL+"/watch?key=a&since=1"), want: []string{"put a", "delete a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, want := range tt.want {
+				ev := nextEvent(t, tt.events)
+				if got := ev.event + " " + ev.entry.Key; got != want {
+					t.Errorf("got %s, want %s", got, want)
+				}
+				if ev.id != formatVectorClock(ev.entry.VectorClock) {
+					t.Errorf("event id %s isn't its vector clock %v", ev.id, ev.entry.VectorClock)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchBadRequests(t *testing.T) {
+	s := newServer(t, testConfig(t, "127.0.0.1:1", []string{"127.0.0.1:1"}))
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{method: "GET", path: "/watch"},
+		{method: "GET", path: "/watch?key=a&since=x"},
+		{method: "POST", path: "/watch?key=a"},
+	}
+	for _, tt := range tests {
+		if rec := serve(s, tt.method, tt.path, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %s = %d, want 400", tt.method, tt.path, rec.Code)
+		}
+	}
+}